@@ -59,6 +59,21 @@ func GetSubnetPrefix(ipAddress *net.IPNet) *net.IPNet {
 	}
 }
 
+// GetSubnetBroadcastAddress returns the broadcast address of a subnet prefix.
+func GetSubnetBroadcastAddress(prefix *net.IPNet) net.IP {
+	ip := prefix.IP.To4()
+	if ip == nil {
+		ip = prefix.IP.To16()
+	}
+
+	broadcast := make(net.IP, len(ip))
+	for i := 0; i < len(ip); i++ {
+		broadcast[i] = ip[i] | ^prefix.Mask[len(prefix.Mask)-len(ip)+i]
+	}
+
+	return broadcast
+}
+
 // ComputeIPAddress computes an IP address given its subnet prefix and host ID.
 func ComputeIPAddress(prefix *net.IPNet, hostID net.IP) net.IP {
 	// Always treat as IPv6 address to ensure compatibility with both IPv4 and IPv6.
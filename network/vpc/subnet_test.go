@@ -49,3 +49,12 @@ func TestNewSubnet(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, subnet)
 }
+
+// TestGetSubnetBroadcastAddress tests subnet broadcast address computation.
+func TestGetSubnetBroadcastAddress(t *testing.T) {
+	_, anySubnetPrefix, _ := net.ParseCIDR(anySubnetPrefixString)
+	assert.Equal(t, "12.34.59.255", GetSubnetBroadcastAddress(anySubnetPrefix).String())
+
+	ipAddress, _ := GetIPAddressFromString("10.0.1.10/24")
+	assert.Equal(t, "10.0.1.255", GetSubnetBroadcastAddress(GetSubnetPrefix(ipAddress)).String())
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"sort"
+
+	"github.com/Microsoft/hcsshim"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// hnsACLPolicyAllProtocols represents all the protocols.
+	hnsACLPolicyAllProtocols = 256
+	// hnsACLPolicyProtocolTCP and hnsACLPolicyProtocolUDP are the IANA protocol numbers.
+	hnsACLPolicyProtocolTCP = 6
+	hnsACLPolicyProtocolUDP = 17
+	// dnsPort is the port of DNS servers.
+	dnsPort = "53"
+
+	// HNS evaluates ACL policies in increasing priority number order.
+	// hnsACLPriorityEssential is the priority of rules allowing traffic essential to the endpoint.
+	hnsACLPriorityEssential = 100
+	// hnsACLPriorityAllow is the priority of user-provided allow rules.
+	hnsACLPriorityAllow = 200
+	// hnsACLPriorityDefaultDeny is the priority of the rules blocking all other traffic.
+	hnsACLPriorityDefaultDeny = 1000
+)
+
+// addACLPolicies adds the ACL policies for the network's allow rules to an HNS endpoint. If the
+// network is default-deny, it also blocks all traffic not explicitly allowed except the
+// traffic to the gateway and DNS servers essential to the endpoint. If the endpoint has an
+// egress allowlist, the traffic it sends is blocked likewise except to the allowed CIDR blocks.
+// The policies are added in increasing priority number order.
+func (nb *BridgeBuilder) addACLPolicies(
+	hnsEndpoint *hcsshim.HNSEndpoint, nw *Network, ep *Endpoint) error {
+	var policies []hcsshim.ACLPolicy
+
+	denyEgress := nw.DefaultDeny || len(ep.EgressAllowedCIDRs) != 0
+
+	if denyEgress {
+		policies = append(policies, nb.newACLPolicy(hcsshim.Allow, hcsshim.Out,
+			hnsACLPolicyAllProtocols, nw.GatewayIPAddress.String(), "", hnsACLPriorityEssential))
+	}
+	if nw.DefaultDeny {
+		policies = append(policies, nb.newACLPolicy(hcsshim.Allow, hcsshim.In,
+			hnsACLPolicyAllProtocols, nw.GatewayIPAddress.String(), "", hnsACLPriorityEssential))
+	}
+	if denyEgress {
+		for _, dnsServer := range nw.DNSServers {
+			for _, protocol := range []uint16{hnsACLPolicyProtocolUDP, hnsACLPolicyProtocolTCP} {
+				policies = append(policies, nb.newACLPolicy(hcsshim.Allow, hcsshim.Out,
+					protocol, dnsServer, dnsPort, hnsACLPriorityEssential))
+			}
+		}
+	}
+
+	for _, rule := range nw.ACLAllowRules {
+		direction := hcsshim.Out
+		if rule.Direction == ACLDirectionIn {
+			direction = hcsshim.In
+		}
+		protocol := rule.Protocol
+		if protocol == 0 {
+			protocol = hnsACLPolicyAllProtocols
+		}
+
+		priority := rule.Priority
+		if priority == 0 {
+			priority = hnsACLPriorityAllow
+		}
+
+		policies = append(policies, nb.newACLPolicy(hcsshim.Allow, direction,
+			protocol, rule.RemoteAddresses, rule.RemotePorts, priority))
+	}
+
+	for _, cidr := range ep.EgressAllowedCIDRs {
+		policies = append(policies, nb.newACLPolicy(hcsshim.Allow, hcsshim.Out,
+			hnsACLPolicyAllProtocols, cidr, "", hnsACLPriorityAllow))
+	}
+
+	if denyEgress {
+		policies = append(policies, nb.newACLPolicy(hcsshim.Block, hcsshim.Out,
+			hnsACLPolicyAllProtocols, "", "", hnsACLPriorityDefaultDeny))
+	}
+	if nw.DefaultDeny {
+		policies = append(policies, nb.newACLPolicy(hcsshim.Block, hcsshim.In,
+			hnsACLPolicyAllProtocols, "", "", hnsACLPriorityDefaultDeny))
+	}
+
+	// List the policies in evaluation order, keeping the order of rules with the same priority.
+	sort.SliceStable(policies, func(i, j int) bool {
+		return policies[i].Priority < policies[j].Priority
+	})
+
+	// Add either all or none of the policies.
+	aclEndpoint := &hcsshim.HNSEndpoint{}
+	for _, policy := range policies {
+		err := nb.addEndpointPolicy(aclEndpoint, policy)
+		if err != nil {
+			log.Errorf("Failed to add endpoint ACL policy: %v.", err)
+			return err
+		}
+	}
+	hnsEndpoint.Policies = append(hnsEndpoint.Policies, aclEndpoint.Policies...)
+
+	return nil
+}
+
+// newACLPolicy returns a new HNS ACL policy.
+func (nb *BridgeBuilder) newACLPolicy(
+	action hcsshim.ActionType,
+	direction hcsshim.DirectionType,
+	protocol uint16,
+	remoteAddresses string,
+	remotePorts string,
+	priority uint16) hcsshim.ACLPolicy {
+	return hcsshim.ACLPolicy{
+		Type:            hcsshim.ACL,
+		Action:          action,
+		Direction:       direction,
+		Protocol:        protocol,
+		RemoteAddresses: remoteAddresses,
+		RemotePorts:     remotePorts,
+		Priority:        priority,
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
+	"github.com/aws/amazon-vpc-cni-plugins/network/vpc"
+
+	"github.com/Microsoft/hcsshim"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// managementProbeAddress is an address the host reaches via its primary management
+	// interface: the instance metadata service, only reachable via the primary ENI.
+	managementProbeAddress = "169.254.169.254:80"
+)
+
+// adapterLister lists the network adapters on the host.
+// It exists so that the adapters can be replaced in unit tests.
+type adapterLister interface {
+	Interfaces() ([]net.Interface, error)
+	ManagementAdapterName() (string, error)
+}
+
+// netAdapterLister implements the adapterLister interface using Go's net package.
+type netAdapterLister struct{}
+
+// Interfaces returns the network adapters on the host.
+func (l *netAdapterLister) Interfaces() ([]net.Interface, error) {
+	return net.Interfaces()
+}
+
+// ManagementAdapterName returns the name of the adapter of the host's primary management
+// interface, which has the source address the host selects for the management probe address.
+// Dialing a UDP socket selects the source address without sending any traffic.
+func (l *netAdapterLister) ManagementAdapterName() (string, error) {
+	conn, err := net.Dial("udp", managementProbeAddress)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(localIP) {
+				return iface.Name, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no adapter has source address %s", localIP)
+}
+
+// adapterLister returns the network adapter lister used by the builder.
+func (nb *BridgeBuilder) adapterLister() adapterLister {
+	if nb.adapters == nil {
+		return &netAdapterLister{}
+	}
+
+	return nb.adapters
+}
+
+// getAdapterName returns the name of the network adapter of the shared ENI. The adapter is
+// selected by its interface index if the network has one, or by the ENI's link name otherwise.
+func (nb *BridgeBuilder) getAdapterName(nw *Network) (string, error) {
+	if nw.AdapterIndex == 0 {
+		return nw.SharedENI.GetLinkName(), nil
+	}
+
+	interfaces, err := nb.adapterLister().Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	for _, iface := range interfaces {
+		if iface.Index == nw.AdapterIndex {
+			return iface.Name, nil
+		}
+	}
+
+	return "", &ErrAdapterNotFound{
+		Index:      nw.AdapterIndex,
+		LinkName:   nw.SharedENI.GetLinkName(),
+		MACAddress: nw.SharedENI.GetMACAddress(),
+	}
+}
+
+// selectAdapterName returns the name of the network adapter to bind the network to. This is the
+// shared ENI's adapter or, while it is absent, the network's fallback adapter.
+func (nb *BridgeBuilder) selectAdapterName(nw *Network) (string, error) {
+	adapterName, err := nb.getAdapterName(nw)
+	if nw.FallbackAdapterName == "" {
+		return adapterName, err
+	}
+
+	// Adapters selected by link name are not looked up by getAdapterName.
+	if err == nil && nw.AdapterIndex == 0 {
+		err = nb.checkAdapterExists(nw.SharedENI)
+	}
+	if _, ok := err.(*ErrAdapterNotFound); ok {
+		log.Warnf("Binding network to fallback adapter %s: %v.", nw.FallbackAdapterName, err)
+		return nw.FallbackAdapterName, nil
+	}
+
+	return adapterName, err
+}
+
+// shouldRebindHNSNetwork returns whether an existing HNS network bound to the fallback adapter
+// must be recreated to bind it to the shared ENI's adapter, which has returned.
+func (nb *BridgeBuilder) shouldRebindHNSNetwork(nw *Network, hnsNetwork *hcsshim.HNSNetwork) bool {
+	if nw.FallbackAdapterName == "" || hnsNetwork.NetworkAdapterName != nw.FallbackAdapterName {
+		return false
+	}
+
+	adapterName, err := nb.selectAdapterName(nw)
+	if err != nil || adapterName == nw.FallbackAdapterName {
+		return false
+	}
+
+	// Deleting a network in use would disconnect its endpoints.
+	hnsEndpoints, err := nb.listHNSEndpoints(hnsNetwork.Name)
+	if err != nil || len(hnsEndpoints) != 0 {
+		log.Warnf("HNS network %s is bound to fallback adapter %s and has endpoints, "+
+			"not rebinding it to adapter %s.", hnsNetwork.Name, nw.FallbackAdapterName, adapterName)
+		return false
+	}
+
+	log.Infof("Rebinding HNS network %s from fallback adapter %s to adapter %s.",
+		hnsNetwork.Name, nw.FallbackAdapterName, adapterName)
+
+	return true
+}
+
+// checkAdapterExists returns ErrAdapterNotFound if no network adapter on the host matches the
+// shared ENI, by link name or, if the link name is unknown, by MAC address.
+func (nb *BridgeBuilder) checkAdapterExists(sharedENI *eni.ENI) error {
+	interfaces, err := nb.adapterLister().Interfaces()
+	if err != nil {
+		return err
+	}
+
+	for _, iface := range interfaces {
+		if sharedENI.GetLinkName() != "" {
+			if iface.Name == sharedENI.GetLinkName() {
+				return nil
+			}
+		} else if vpc.CompareMACAddress(iface.HardwareAddr, sharedENI.GetMACAddress()) {
+			return nil
+		}
+	}
+
+	return &ErrAdapterNotFound{
+		LinkName:   sharedENI.GetLinkName(),
+		MACAddress: sharedENI.GetMACAddress(),
+	}
+}
+
+// checkManagementAdapter returns ErrManagementAdapter if the adapter the network is bound to is
+// the host's primary management interface and the network refuses it. The management interface
+// is the adapter itself or, once a network is bound to it, its host vNIC. The check is skipped
+// if the management interface is unknown.
+func (nb *BridgeBuilder) checkManagementAdapter(nw *Network, adapterName string) error {
+	if nw.ManagementAdapterAction == ManagementAdapterAllow {
+		return nil
+	}
+
+	managementAdapterName, err := nb.adapterLister().ManagementAdapterName()
+	if err != nil {
+		log.Warnf("Failed to find the host's management interface: %v.", err)
+		return nil
+	}
+	if managementAdapterName != adapterName &&
+		managementAdapterName != fmt.Sprintf(hostVNICNameFormat, adapterName) {
+		return nil
+	}
+
+	managementErr := &ErrManagementAdapter{AdapterName: adapterName}
+	if nw.ManagementAdapterAction == ManagementAdapterRefuse {
+		log.Errorf("Refusing network adapter: %v.", managementErr)
+		return managementErr
+	}
+
+	log.Warnf("Creating network on management adapter, host connectivity may be disrupted: %v.",
+		managementErr)
+
+	return nil
+}
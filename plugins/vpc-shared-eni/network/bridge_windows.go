@@ -16,25 +16,70 @@ package network
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"net"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/amazon-vpc-cni-plugins/network/vpc"
 
 	"github.com/Microsoft/hcsshim"
-	"github.com/Microsoft/hcsshim/hcn"
 	log "github.com/cihub/seelog"
 )
 
 const (
 	// hnsL2Bridge is the HNS network type used by this plugin on Windows.
 	hnsL2Bridge = "l2bridge"
+	// hnsTransparent is the HNS network type used in transparent mode.
+	hnsTransparent = "transparent"
+	// hnsNAT is the HNS network type NATing the traffic of its endpoints with the host's address.
+	hnsNAT = "nat"
 
 	// hnsNetworkNameFormat is the format used for generating bridge names (e.g. "vpcbr1").
 	hnsNetworkNameFormat = "%sbr%s"
+	// hnsNetworkNameDiscriminatorFormat is the format of the bridge names with a discriminator.
+	hnsNetworkNameDiscriminatorFormat = "%sbr%s-%s"
 
 	// hnsEndpointNameFormat is the format of the names generated for HNS endpoints.
 	hnsEndpointNameFormat = "cid-%s"
+
+	// containerNetNSPrefix is the prefix of the network namespace of app containers, followed by
+	// the ID of the infra container whose namespace they share.
+	containerNetNSPrefix = "container:"
+
+	// hnsNetworkVersionKey is the HNS network metadata key for the network version.
+	hnsNetworkVersionKey = "VpcSharedEniNetworkVersion"
+	// hnsNetworkVersion identifies the layout of HNS networks created by this plugin.
+	// Increment it when changing how networks are created.
+	hnsNetworkVersion = "1"
+	// hnsNetworkVPCIDKey and hnsNetworkSubnetIDKey are the HNS network metadata keys for the
+	// IDs of the VPC and subnet that the network represents.
+	hnsNetworkVPCIDKey    = "VpcSharedEniVpcId"
+	hnsNetworkSubnetIDKey = "VpcSharedEniSubnetId"
+	// hnsNetworkDNSKey is the HNS network metadata key set on networks created with DNS
+	// settings.
+	hnsNetworkDNSKey = "VpcSharedEniNetworkDns"
+	// hnsEndpointCNINetworkKey is the HNS endpoint metadata key for the CNI network name.
+	hnsEndpointCNINetworkKey = "VpcSharedEniCniNetwork"
+	// hnsEndpointHostRoutesKey is the HNS endpoint metadata key for the comma-separated
+	// destinations of the endpoint's host routes.
+	hnsEndpointHostRoutesKey = "VpcSharedEniHostRoutes"
+
+	// hnsFriendlyNameMaxLength is the maximum length of HNS endpoint friendly names, well within
+	// the limit on Windows interface aliases.
+	hnsFriendlyNameMaxLength = 128
+	// hnsEndpointNameMaxLength is the default maximum length of HNS endpoint names, the limit on
+	// Windows interface aliases. hnsEndpointNameMinLength is the smallest maximum length allowed,
+	// which leaves room for the name prefix and the hash of truncated names.
+	hnsEndpointNameMaxLength = 256
+	hnsEndpointNameMinLength = 32
+
+	// hnsErrorNotSupported is the message of the Win32 ERROR_NOT_SUPPORTED error, which HNS
+	// returns for network types not supported by the host. win32ErrorNotSupported is its code.
+	hnsErrorNotSupported   = "The request is not supported."
+	win32ErrorNotSupported = 0x32
 )
 
 // nsType identifies the namespace type for the containers.
@@ -49,9 +94,46 @@ const (
 	hcnNamespace
 )
 
+const (
+	// hcnNamespaceMaxRetryInterval is the maximum interval between HCN namespace operation retries.
+	hcnNamespaceMaxRetryInterval = 2 * time.Second
+	// hnsGlobalsRetryInterval is the initial interval between retries of HNS globals queries.
+	hnsGlobalsRetryInterval = 250 * time.Millisecond
+	// hnsGlobalsMaxRetryInterval is the maximum interval between retries of HNS globals queries.
+	hnsGlobalsMaxRetryInterval = time.Second
+	// infraEndpointRetryInterval is the initial interval between lookups of an infra container's
+	// endpoint that is not created yet.
+	infraEndpointRetryInterval = 100 * time.Millisecond
+	// infraEndpointMaxRetryInterval is the maximum interval between lookups of an infra
+	// container's endpoint.
+	infraEndpointMaxRetryInterval = time.Second
+	// networkReadyRetryInterval is the initial interval between polls of a new network's state.
+	networkReadyRetryInterval = 100 * time.Millisecond
+	// networkReadyMaxRetryInterval is the maximum interval between polls of a new network's state.
+	networkReadyMaxRetryInterval = time.Second
+	// endpointReadyRetryInterval is the initial interval between polls of a new endpoint's IP
+	// address in its compartment.
+	endpointReadyRetryInterval = 50 * time.Millisecond
+	// endpointReadyMaxRetryInterval is the maximum interval between polls of a new endpoint's IP
+	// address in its compartment.
+	endpointReadyMaxRetryInterval = 500 * time.Millisecond
+)
+
+const (
+	// hnsMinVNI and hnsMaxVNI are the range of VXLAN network identifiers accepted by HNS.
+	// HNS reserves the identifiers below 4096.
+	hnsMinVNI = 4096
+	hnsMaxVNI = 1<<24 - 1
+)
+
 var (
 	// hnsMinVersion is the minimum version of HNS supported by this plugin.
 	hnsMinVersion = hcsshim.HNSVersion1803
+	// hnsMinWindowsBuild is the Windows build that shipped hnsMinVersion.
+	hnsMinWindowsBuild = 17134
+	// hcnNamespaceIDPattern matches HCN namespace IDs, which are GUIDs unlike container IDs.
+	hcnNamespaceIDPattern = regexp.MustCompile(
+		`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
 )
 
 // hnsRoutePolicy is an HNS route policy.
@@ -59,38 +141,104 @@ var (
 type hnsRoutePolicy struct {
 	hcsshim.Policy
 	DestinationPrefix string `json:"DestinationPrefix,omitempty"`
+	NextHop           string `json:"NextHop,omitempty"`
 	NeedEncap         bool   `json:"NeedEncap,omitempty"`
 }
 
 // BridgeBuilder implements NetworkBuilder interface by bridging containers to an ENI on Windows.
-type BridgeBuilder struct{}
+type BridgeBuilder struct {
+	// Config is the configuration of the builder.
+	Config
+
+	// hns is the client used to call HNS. A nil value selects the hcsshim implementation.
+	hns hnsClient
+	// eniIPs discovers the ENI IP addresses. A nil value selects the instance metadata service.
+	eniIPs eniIPDiscoverer
+	// adapters lists the host's network adapters. A nil value selects the net package.
+	adapters adapterLister
+	// routes installs the host routes of endpoints. A nil value selects netsh.
+	routes hostRouter
+	// compartments lists the IP addresses in network compartments. A nil value selects iphlpapi.
+	compartments compartmentAddressLister
+	// attachDurations holds the recent endpoint attach durations summarized by AttachDurations.
+	attachDurations attachDurations
+	// endpointCalls holds the in-flight FindOrCreateEndpoint calls, by call key.
+	endpointCalls sync.Map
+	// networkLocks holds the lock of each network, by network name.
+	networkLocks sync.Map
+	// snatExceptions holds the SNAT exceptions derived from each network's settings, by network
+	// name.
+	snatExceptions sync.Map
+	// endpointOperations is the semaphore bounding the number of concurrent endpoint operations.
+	endpointOperations     chan struct{}
+	endpointOperationsOnce sync.Once
+}
 
 // FindOrCreateNetwork creates a new HNS network.
 func (nb *BridgeBuilder) FindOrCreateNetwork(nw *Network) error {
-	// Check that the HNS version is supported.
-	err := nb.checkHNSVersion()
+	err := nb.validateNetwork(nw)
 	if err != nil {
+		log.Errorf("Invalid network: %v.", err)
 		return err
 	}
 
-	// HNS API does not support creating virtual switches in compartments other than the host's.
-	if nw.BridgeNetNSPath != "" {
-		return fmt.Errorf("Bridge must be in host network namespace on Windows")
+	// Check that the HNS version is supported.
+	err = nb.checkHNSVersion()
+	if err != nil {
+		return err
 	}
 
+	// Derive the SNAT exceptions shared by the network's endpoints.
+	nb.getNetworkSNATExceptions(nw)
+
 	// Check if the network already exists.
 	networkName := nb.generateHNSNetworkName(nw)
-	hnsNetwork, err := hcsshim.GetHNSNetworkByName(networkName)
+	hnsNetwork, err := nb.client().GetHNSNetworkByName(networkName)
 	if err == nil {
 		log.Infof("Found existing HNS network %s.", networkName)
-		return nil
+		metadata, err := nb.getHNSNetworkMetadata(hnsNetwork.Id)
+		if err != nil {
+			// The network metadata is informational. Check the existing network without it.
+			log.Errorf("Failed to read HNS network metadata, ignoring: %v.", err)
+			metadata = make(map[string]string)
+		}
+
+		if !nb.shouldRecreateHNSNetwork(nw, hnsNetwork, metadata) &&
+			!nb.shouldRebindHNSNetwork(nw, hnsNetwork) &&
+			!nb.shouldResubnetHNSNetwork(nw, hnsNetwork) &&
+			!nb.shouldRecreateHNSNetworkDNS(nw, hnsNetwork, metadata) {
+			nb.readNetworkTags(nw, metadata)
+			return nil
+		}
+
+		// Delete the incompatible network so that it is recreated below.
+		log.Infof("Deleting incompatible HNS network name: %s ID: %s", networkName, hnsNetwork.Id)
+		_, err = nb.client().HNSNetworkRequest("DELETE", hnsNetwork.Id, "")
+		if err != nil {
+			log.Errorf("Failed to delete HNS network: %v.", err)
+			return err
+		}
+		nb.deleteStoredHNSNetworkMetadata(hnsNetwork.Id)
+		nb.eventSink().NetworkDeleted(newNetworkEvent(hnsNetwork))
+	}
+
+	adapterName, err := nb.selectAdapterName(nw)
+	if err != nil {
+		log.Errorf("Failed to find network adapter: %v.", err)
+		return err
+	}
+
+	// Binding the network to the host's management interface can disconnect the host.
+	err = nb.checkManagementAdapter(nw, adapterName)
+	if err != nil {
+		return err
 	}
 
 	// Initialize the HNS network.
 	hnsNetwork = &hcsshim.HNSNetwork{
 		Name:               networkName,
-		Type:               hnsL2Bridge,
-		NetworkAdapterName: nw.SharedENI.GetLinkName(),
+		Type:               nb.getHNSNetworkType(nw),
+		NetworkAdapterName: adapterName,
 
 		Subnets: []hcsshim.Subnet{
 			{
@@ -99,72 +247,386 @@ func (nb *BridgeBuilder) FindOrCreateNetwork(nw *Network) error {
 			},
 		},
 	}
+	hnsNetwork.DNSServerList, hnsNetwork.DNSSuffix = nb.generateHNSNetworkDNS(nw)
+
+	// Create the HNS network. Minimal Windows SKUs do not support all network types.
+	metadata := nb.generateHNSNetworkMetadata(nw)
+	hnsResponse, err := nb.createHNSNetwork(nw, hnsNetwork, metadata)
+	if err != nil && isHNSNetworkTypeUnsupported(err, hnsNetwork.Type) {
+		unsupportedErr := &ErrNetworkTypeUnsupported{NetworkType: hnsNetwork.Type, Err: err}
+		if nw.FallbackNetworkType == "" {
+			log.Errorf("Failed to create HNS network: %v.", unsupportedErr)
+			return unsupportedErr
+		}
+
+		log.Warnf("Falling back to network type %s: %v.", nw.FallbackNetworkType, unsupportedErr)
+		hnsNetwork.Type = nw.FallbackNetworkType
+		hnsResponse, err = nb.createHNSNetwork(nw, hnsNetwork, metadata)
+	}
+	if err != nil {
+		// HNS does not report which of the network settings is invalid. Look for the most
+		// likely cause, the shared ENI being detached from the host.
+		adapterErr := nb.checkAdapterExists(nw.SharedENI)
+		if _, ok := adapterErr.(*ErrAdapterNotFound); ok {
+			log.Errorf("Failed to find network adapter: %v.", adapterErr)
+			return adapterErr
+		}
+		return err
+	}
+
+	log.Infof("Received HNS network response: %+v.", hnsResponse)
 
-	buf, err := json.Marshal(hnsNetwork)
+	// HNS can report success without returning a complete network on some failure modes.
+	err = nb.validateHNSNetworkResponse(hnsResponse, networkName)
 	if err != nil {
+		log.Errorf("Received malformed HNS network response: %v.", err)
+		if hnsResponse != nil && hnsResponse.Id != "" {
+			// Cleanup the partially created network.
+			log.Infof("Deleting the malformed HNS network %s.", hnsResponse.Id)
+			_, delErr := nb.client().HNSNetworkRequest("DELETE", hnsResponse.Id, "")
+			if delErr != nil {
+				log.Errorf("Failed to delete HNS network: %v.", delErr)
+			}
+		}
+
 		return err
 	}
+
+	nb.storeHNSNetworkMetadata(hnsResponse.Id, metadata)
+	nb.eventSink().NetworkCreated(newNetworkEvent(hnsResponse))
+
+	if nb.NetworkReadyTimeout != 0 {
+		return nb.waitForHNSNetworkReady(hnsResponse)
+	}
+
+	return nil
+}
+
+// createHNSNetwork sends the request to create an HNS network with the given metadata. Isolating
+// the switch prevents the host from sharing the virtual switch with the containers. Disabling the
+// management OS prevents HNS from moving the host's connectivity on the adapter to a vNIC.
+func (nb *BridgeBuilder) createHNSNetwork(nw *Network, hnsNetwork *hcsshim.HNSNetwork,
+	metadata map[string]string) (*hcsshim.HNSNetwork, error) {
+	buf, err := json.Marshal(hnsNetworkWithMetadata{
+		HNSNetwork:          *hnsNetwork,
+		AdditionalParams:    metadata,
+		IsolateSwitch:       nw.IsolateSwitch,
+		DisableManagementOS: nw.DisableManagementOS,
+	})
+	if err != nil {
+		return nil, err
+	}
 	hnsRequest := string(buf)
 
-	// Create the HNS network.
 	log.Infof("Creating HNS network: %+v", hnsRequest)
-	hnsResponse, err := hcsshim.HNSNetworkRequest("POST", "", hnsRequest)
+	hnsResponse, err := nb.client().HNSNetworkRequest("POST", "", hnsRequest)
 	if err != nil {
 		log.Errorf("Failed to create HNS network: %v.", err)
-		return err
+		return nil, err
 	}
 
-	log.Infof("Received HNS network response: %+v.", hnsResponse)
+	return hnsResponse, nil
+}
 
-	return nil
+// isHNSNetworkTypeUnsupported returns whether HNS failed to create a network because the host
+// does not support its type.
+func isHNSNetworkTypeUnsupported(err error, networkType string) bool {
+	// HNS reports ERROR_NOT_SUPPORTED either in its response or as the result of the HNS call,
+	// without naming the network type.
+	message := err.Error()
+	if strings.HasSuffix(message, ": "+hnsErrorNotSupported) ||
+		strings.HasSuffix(message, fmt.Sprintf("(%#x)", win32ErrorNotSupported)) {
+		return true
+	}
+
+	// Other failures are attributed to the network type only if they name it.
+	message = strings.ToLower(message)
+	return strings.Contains(message, strings.ToLower(networkType)) &&
+		(strings.Contains(message, "not supported") || strings.Contains(message, "unsupported"))
+}
+
+// waitForHNSNetworkReady polls a new HNS network until it reports its subnets, which is when
+// endpoints can be created in it, or times out.
+func (nb *BridgeBuilder) waitForHNSNetworkReady(hnsNetwork *hcsshim.HNSNetwork) error {
+	err := retryOperation("HNS network readiness check", nb.NetworkReadyTimeout,
+		networkReadyRetryInterval, networkReadyMaxRetryInterval, func() error {
+			hnsResponse, err := nb.client().HNSNetworkRequest("GET", hnsNetwork.Id, "")
+			if err != nil {
+				return err
+			}
+			if len(hnsResponse.Subnets) == 0 {
+				return fmt.Errorf("HNS network %s has no subnets yet", hnsNetwork.Name)
+			}
+			return nil
+		})
+	if err != nil {
+		log.Errorf("HNS network %s is not ready: %v.", hnsNetwork.Name, err)
+	}
+
+	return err
 }
 
-// DeleteNetwork deletes an existing HNS network.
+// DeleteNetwork deletes an existing HNS network. Networks preserving their adapter binding are
+// kept if no other network is bound to their adapter.
 func (nb *BridgeBuilder) DeleteNetwork(nw *Network) error {
 	// Find the HNS network ID.
 	networkName := nb.generateHNSNetworkName(nw)
-	hnsNetwork, err := hcsshim.GetHNSNetworkByName(networkName)
+	hnsNetwork, err := nb.client().GetHNSNetworkByName(networkName)
 	if err != nil {
+		if hcsshim.IsNotExist(err) {
+			return nb.deleteAbsent(nw, DeleteObjectNetwork, &nw.DeleteResult, err)
+		}
 		return err
 	}
 
+	// Deleting the last network bound to an adapter removes its virtual switch, which resets the
+	// adapter and briefly disconnects the host.
+	if nw.PreserveAdapterBinding {
+		shared, err := nb.isAdapterShared(hnsNetwork)
+		if err != nil {
+			log.Errorf("Failed to list HNS networks: %v.", err)
+			return err
+		}
+		if !shared {
+			log.Infof("Keeping HNS network %s to preserve the binding of adapter %s.",
+				networkName, hnsNetwork.NetworkAdapterName)
+			return nil
+		}
+	}
+
 	// Delete the HNS network.
 	log.Infof("Deleting HNS network name: %s ID: %s", networkName, hnsNetwork.Id)
-	_, err = hcsshim.HNSNetworkRequest("DELETE", hnsNetwork.Id, "")
+	_, err = nb.client().HNSNetworkRequest("DELETE", hnsNetwork.Id, "")
 	if err != nil {
 		log.Errorf("Failed to delete HNS network: %v.", err)
+		return err
+	}
+	nb.deleteStoredHNSNetworkMetadata(hnsNetwork.Id)
+	nb.eventSink().NetworkDeleted(newNetworkEvent(hnsNetwork))
+	nw.DeleteResult = DeleteResultDeleted
+	nb.metricsSink().DeleteCompleted(DeleteObjectNetwork, DeleteResultDeleted)
+
+	// Some Windows builds leave residual state behind after deleting a network.
+	if nw.VerifyDelete {
+		residue, err := nb.findHNSNetworkResidue(nw, hnsNetwork)
+		if err != nil {
+			log.Warnf("Failed to verify HNS network %s is deleted: %v.", networkName, err)
+		} else if len(residue) != 0 {
+			log.Warnf("HNS network %s was not fully deleted, residue: %v.", networkName, residue)
+		}
 	}
 
-	return err
+	return nil
 }
 
-// FindOrCreateEndpoint creates a new HNS endpoint in the network.
+// endpointCall is an in-flight FindOrCreateEndpoint call, whose result is shared with the
+// concurrent duplicate calls.
+type endpointCall struct {
+	done   chan struct{}
+	result Endpoint
+	err    error
+}
+
+// FindOrCreateEndpoint creates a new HNS endpoint in the network. Concurrent duplicate calls for
+// the same endpoint and container, such as CNI ADDs retried by the runtime after a timeout, wait
+// for and return the result of the first call instead of calling HNS again.
 func (nb *BridgeBuilder) FindOrCreateEndpoint(nw *Network, ep *Endpoint) error {
-	// This plugin does not yet support IPv6, or multiple IPv4 addresses.
-	if len(ep.IPAddresses) > 1 || ep.IPAddresses[0].IP.To4() == nil {
-		return fmt.Errorf("Only a single IPv4 address per endpoint is supported on Windows")
+	callKey := nb.generateEndpointCallKey(nw, ep)
+	call := &endpointCall{done: make(chan struct{})}
+	if inFlight, loaded := nb.endpointCalls.LoadOrStore(callKey, call); loaded {
+		first := inFlight.(*endpointCall)
+		log.Infof("Waiting for the in-flight call for endpoint of container %s.", ep.ContainerID)
+		<-first.done
+		// Return the whole result of the first call, but keep the waiter's own references to
+		// its inputs, which the first caller owns in the result.
+		result := first.result
+		result.Policies = ep.Policies
+		result.ExtraEndpointFields = ep.ExtraEndpointFields
+		result.Metered = ep.Metered
+		result.HostRoutes = ep.HostRoutes
+		result.Routes = ep.Routes
+		result.EgressAllowedCIDRs = ep.EgressAllowedCIDRs
+		result.AdditionalSNATExceptions = ep.AdditionalSNATExceptions
+		*ep = result
+		return first.err
+	}
+
+	err := nb.findOrCreateEndpointWithRetry(nw, ep)
+
+	call.result, call.err = *ep, err
+	nb.endpointCalls.Delete(callKey)
+	close(call.done)
+
+	return err
+}
+
+// findOrCreateEndpointWithRetry finds or creates the HNS endpoint in the network, and retries
+// the whole operation after the failures in the configured error classes. The HNS endpoint
+// created by a failed attempt is deleted, and the endpoint reset, before the next attempt.
+func (nb *BridgeBuilder) findOrCreateEndpointWithRetry(nw *Network, ep *Endpoint) error {
+	config := nb.config()
+	if config.EndpointRetryLimit <= 0 || len(config.EndpointRetryErrors) == 0 {
+		return nb.findOrCreateEndpoint(nw, ep)
+	}
+
+	// Endpoints that existed before the first attempt are never deleted.
+	nsType, namespaceIdentifier := nb.getNamespaceIdentifier(ep)
+	endpointName := nb.generateHNSEndpointName(ep, namespaceIdentifier)
+	_, err := nb.client().GetHNSEndpointByName(endpointName)
+	existed := err == nil
+
+	request := *ep
+	for retry := 0; ; retry++ {
+		err = nb.findOrCreateEndpoint(nw, ep)
+		if err == nil || retry == config.EndpointRetryLimit ||
+			!isRetryableEndpointError(err, config.EndpointRetryErrors) {
+			return err
+		}
+
+		log.Warnf("Retrying endpoint creation for container %s after failure: %v.",
+			ep.ContainerID, err)
+		if !existed {
+			nb.deletePartialEndpoint(endpointName, nsType, namespaceIdentifier)
+		}
+		*ep = request
+		time.Sleep(config.EndpointRetryInterval)
+	}
+}
+
+// isRetryableEndpointError returns whether an error is in one of the given error classes.
+func isRetryableEndpointError(err error, errorClasses []string) bool {
+	message := strings.ToLower(err.Error())
+	for _, errorClass := range errorClasses {
+		if errorClass != "" && strings.Contains(message, strings.ToLower(errorClass)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deletePartialEndpoint deletes the HNS endpoint left behind by a failed endpoint creation, if
+// any. Failures are logged and ignored, as the next attempt finds the endpoint instead.
+func (nb *BridgeBuilder) deletePartialEndpoint(
+	endpointName string, netNSType nsType, namespaceIdentifier string) {
+	hnsEndpoint, err := nb.client().GetHNSEndpointByName(endpointName)
+	if err != nil {
+		return
+	}
+
+	if netNSType == hcnNamespace {
+		err = nb.removeHCNNamespaceEndpoint(namespaceIdentifier, hnsEndpoint.Id)
+		if err != nil {
+			log.Warnf("Failed to detach partial HNS endpoint %s: %v.", hnsEndpoint.Id, err)
+		}
+	}
+
+	log.Infof("Deleting the partial HNS endpoint %s.", hnsEndpoint.Id)
+	_, err = nb.client().HNSEndpointRequest("DELETE", hnsEndpoint.Id, "")
+	if err != nil {
+		log.Errorf("Failed to delete HNS endpoint: %v.", err)
+	}
+}
+
+// findOrCreateEndpoint finds or creates the HNS endpoint in the network.
+func (nb *BridgeBuilder) findOrCreateEndpoint(nw *Network, ep *Endpoint) error {
+	err := nb.validateEndpoint(nw, ep)
+	if err != nil {
+		log.Errorf("Invalid endpoint: %v.", err)
+		return err
+	}
+
+	// Refuse IP addresses owned by the host, which would conflict with the host's own traffic.
+	err = nb.checkEndpointIPConflict(nw, ep)
+	if err != nil {
+		log.Errorf("Invalid endpoint IP address: %v.", err)
+		return err
 	}
 
 	// Query the namespace identifier.
 	nsType, namespaceIdentifier := nb.getNamespaceIdentifier(ep)
+	endpointName := nb.generateHNSEndpointName(ep, namespaceIdentifier)
+
+	// Wait for the infra container's endpoint without blocking its creation.
+	if nsType == appContainerNS && nb.InfraEndpointTimeout != 0 {
+		nb.waitForHNSEndpoint(endpointName, nb.InfraEndpointTimeout)
+	}
+
+	// Create endpoints in the same network one at a time.
+	unlock := nb.lockNetwork(nw)
+	defer unlock()
+
+	release := nb.acquireEndpointOperation()
+	defer release()
 
 	// Check if the endpoint already exists.
-	endpointName := nb.generateHNSEndpointName(ep, namespaceIdentifier)
-	hnsEndpoint, err := hcsshim.GetHNSEndpointByName(endpointName)
-	if err == nil {
+	hnsEndpoint, err := nb.client().GetHNSEndpointByName(endpointName)
+	found := err == nil
+	if found && (nsType == infraContainerNS || nsType == hcnNamespace) {
+		found, err = nb.resolveEndpointIPMismatch(nw, ep, hnsEndpoint, nsType, namespaceIdentifier)
+		if err != nil {
+			return err
+		}
+	}
+	if found && (nsType == infraContainerNS || nsType == hcnNamespace) {
+		found, err = nb.resolveEndpointSubnetMismatch(nw, ep, hnsEndpoint, nsType, namespaceIdentifier)
+		if err != nil {
+			return err
+		}
+	}
+	if found {
 		log.Infof("Found existing HNS endpoint %s.", endpointName)
-		if nsType == infraContainerNS || nsType == hcnNamespace {
+		attached := false
+		if ep.Key != "" && nsType == infraContainerNS {
+			attached, err = nb.isEndpointAttachedToContainer(hnsEndpoint, ep.ContainerID)
+			if err != nil {
+				return err
+			}
+		}
+		if ep.Key != "" && nsType == infraContainerNS && !attached {
+			// Endpoints with a key outlive their infra container. Attach the existing endpoint to
+			// the restarted infra container, which has a new container ID.
+			err = nb.attachEndpointV1(hnsEndpoint, ep.ContainerID, nsType)
+		} else if ep.Key != "" && nsType == hcnNamespace {
+			// Attach the existing endpoint to the namespace, unless it is already attached.
+			err = nb.resolveEndpointNamespaceMismatch(nw, hnsEndpoint, namespaceIdentifier)
+			if err == nil {
+				err = nb.attachEndpointV2(hnsEndpoint, namespaceIdentifier)
+			}
+		} else if nsType == infraContainerNS || nsType == hcnNamespace {
 			// This is a benign duplicate create call for an existing endpoint.
 			// The endpoint was already attached in a previous call. Ignore and return success.
-			log.Infof("HNS endpoint %s is already attached to container ID %s.",
+			// Orchestrators repeat the call while the container crash loops, so the call is
+			// counted rather than logged by default.
+			nb.metricsSink().DuplicateEndpointCreate(nsType.label())
+			logf := log.Debugf
+			if nb.LogDuplicateCreates {
+				logf = log.Infof
+			}
+			logf("HNS endpoint %s is already attached to container ID %s.",
 				endpointName, ep.ContainerID)
 		} else {
 			// Attach the existing endpoint to the container's network namespace.
 			// Attachment of endpoint to each container would occur only when using HNS V1 APIs.
-			err = nb.attachEndpointV1(hnsEndpoint, ep.ContainerID)
+			err = nb.attachEndpointV1(hnsEndpoint, ep.ContainerID, nsType)
 		}
 
-		ep.MACAddress, _ = net.ParseMAC(hnsEndpoint.MacAddress)
+		if err == nil {
+			ep.MACAddress, err = nb.parseHNSEndpointMAC(nw, hnsEndpoint)
+		}
+		if err == nil && ep.CNINetworkName == "" {
+			nb.readEndpointTags(ep, hnsEndpoint)
+		}
+		if len(ep.IPAddresses) == 0 && hnsEndpoint.IPAddress != nil {
+			// Return the IP address allocated when the endpoint was created.
+			ep.IPAddresses = []net.IPNet{{
+				IP:   hnsEndpoint.IPAddress,
+				Mask: net.CIDRMask(int(hnsEndpoint.PrefixLength), 8*net.IPv4len),
+			}}
+		}
+		if err == nil {
+			ep.CompartmentID = nb.getCompartmentID(nsType, namespaceIdentifier)
+		}
 		return err
 	} else {
 		if nsType != infraContainerNS && nsType != hcnNamespace {
@@ -174,88 +636,56 @@ func (nb *BridgeBuilder) FindOrCreateEndpoint(nw *Network, ep *Endpoint) error {
 		}
 	}
 
-	// Initialize the HNS endpoint.
-	hnsEndpoint = &hcsshim.HNSEndpoint{
-		Name:               endpointName,
-		VirtualNetworkName: nb.generateHNSNetworkName(nw),
-		DNSSuffix:          strings.Join(nw.DNSSuffixSearchList, ","),
-		DNSServerList:      strings.Join(nw.DNSServers, ","),
-	}
-
-	// Set the endpoint IP address.
-	hnsEndpoint.IPAddress = ep.IPAddresses[0].IP
-	pl, _ := ep.IPAddresses[0].Mask.Size()
-	hnsEndpoint.PrefixLength = uint8(pl)
-
-	// SNAT endpoint traffic to ENI primary IP address...
-	var snatExceptions []string
-	if nw.VPCCIDRs == nil {
-		// ...except if the destination is in the same subnet as the ENI.
-		snatExceptions = []string{vpc.GetSubnetPrefix(&nw.ENIIPAddresses[0]).String()}
-	} else {
-		// ...or, if known, the same VPC.
-		for _, cidr := range nw.VPCCIDRs {
-			snatExceptions = append(snatExceptions, cidr.String())
+	// HNS fails to create endpoints in missing networks with an opaque error.
+	if nw.RequireExistingNetwork {
+		err = nb.checkNetworkExists(nw)
+		if err != nil {
+			return err
 		}
 	}
-	if nw.ServiceCIDR != "" {
-		// ...or the destination is a service endpoint.
-		snatExceptions = append(snatExceptions, nw.ServiceCIDR)
-	}
-
-	err = nb.addEndpointPolicy(
-		hnsEndpoint,
-		hcsshim.OutboundNatPolicy{
-			Policy: hcsshim.Policy{Type: hcsshim.OutboundNat},
-			// Implicit VIP: nw.ENIIPAddresses[0].IP.String(),
-			Exceptions: snatExceptions,
-		})
-	if err != nil {
-		log.Errorf("Failed to add endpoint SNAT policy: %v.", err)
-		return err
-	}
 
-	// Route traffic sent to service endpoints to the host. The load balancer running
-	// in the host network namespace then forwards traffic to its final destination.
-	if nw.ServiceCIDR != "" {
-		// Set route policy for service subnet.
-		// NextHop is implicitly the host.
-		err = nb.addEndpointPolicy(
-			hnsEndpoint,
-			hnsRoutePolicy{
-				Policy:            hcsshim.Policy{Type: hcsshim.Route},
-				DestinationPrefix: nw.ServiceCIDR,
-				NeedEncap:         true,
-			})
+	// Attaching the endpoint to a missing HCN namespace would fail after creating it.
+	if nsType == hcnNamespace {
+		err = nb.findOrCreateHCNNamespace(nw, namespaceIdentifier)
 		if err != nil {
-			log.Errorf("Failed to add endpoint route policy for service subnet: %v.", err)
 			return err
 		}
+	}
 
-		// Set route policy for host primary IP address.
-		err = nb.addEndpointPolicy(
-			hnsEndpoint,
-			hnsRoutePolicy{
-				Policy:            hcsshim.Policy{Type: hcsshim.Route},
-				DestinationPrefix: nw.ENIIPAddresses[0].IP.String() + "/32",
-				NeedEncap:         true,
-			})
+	if len(ep.IPAddresses) == 0 {
+		ipAddress, err := nb.allocateEndpointIP(nw)
 		if err != nil {
-			log.Errorf("Failed to add endpoint route policy for host: %v.", err)
+			log.Errorf("Failed to allocate endpoint IP address: %v.", err)
 			return err
 		}
+		ep.IPAddresses = []net.IPNet{ipAddress}
 	}
 
-	// Encode the endpoint request.
-	buf, err := json.Marshal(hnsEndpoint)
+	// Initialize the HNS endpoint.
+	hnsEndpoint, err = nb.newHNSEndpoint(nw, ep, endpointName)
 	if err != nil {
 		return err
 	}
-	hnsRequest := string(buf)
+
+	// Encode the endpoint request. The request goes through the HNS V1 API, so endpoints in HCN
+	// namespaces also carry their DNS settings in the HNS V1 fields.
+	// A low route metric makes the endpoint's routes preferred over the host's routes.
+	request := &hnsEndpointRequest{
+		HNSEndpoint:      *hnsEndpoint,
+		AdditionalParams: nb.generateHNSEndpointMetadata(ep),
+		EnableLowMetric:  ep.EnableLowMetric,
+		PortFriendlyName: nb.generateHNSEndpointFriendlyName(ep),
+		Metered:          ep.Metered,
+	}
+	hnsRequest, err := nb.encodeHNSEndpointRequest(request, ep.ExtraEndpointFields)
+	if err != nil {
+		log.Errorf("Failed to encode HNS endpoint request: %v.", err)
+		return err
+	}
 
 	// Create the HNS endpoint.
 	log.Infof("Creating HNS endpoint: %+v", hnsRequest)
-	hnsResponse, err := hcsshim.HNSEndpointRequest("POST", "", hnsRequest)
+	hnsResponse, err := nb.client().HNSEndpointRequest("POST", "", hnsRequest)
 	if err != nil {
 		log.Errorf("Failed to create HNS endpoint: %v.", err)
 		return err
@@ -263,17 +693,29 @@ func (nb *BridgeBuilder) FindOrCreateEndpoint(nw *Network, ep *Endpoint) error {
 
 	log.Infof("Received HNS endpoint response: %+v.", hnsResponse)
 
+	// HNS can assign a different IP address than requested, e.g. when falling back to its pool.
+	err = nb.validateHNSEndpointResponse(hnsResponse, ep)
+	if err != nil {
+		log.Errorf("Received invalid HNS endpoint response: %v.", err)
+	}
+	if err == nil {
+		ep.MACAddress, err = nb.parseHNSEndpointMAC(nw, hnsResponse)
+	}
+
 	// Attach the HNS endpoint to the container's network namespace.
-	if nsType == infraContainerNS {
-		err = nb.attachEndpointV1(hnsResponse, ep.ContainerID)
+	if err == nil && nsType == infraContainerNS {
+		err = nb.attachEndpointV1(hnsResponse, ep.ContainerID, nsType)
 	}
-	if nsType == hcnNamespace {
+	if err == nil && nsType == hcnNamespace {
 		err = nb.attachEndpointV2(hnsResponse, namespaceIdentifier)
 	}
+	if err == nil {
+		err = nb.addHostRoutes(ep, hnsResponse)
+	}
 	if err != nil {
 		// Cleanup the failed endpoint.
 		log.Infof("Deleting the failed HNS endpoint %s.", hnsResponse.Id)
-		_, delErr := hcsshim.HNSEndpointRequest("DELETE", hnsResponse.Id, "")
+		_, delErr := nb.client().HNSEndpointRequest("DELETE", hnsResponse.Id, "")
 		if delErr != nil {
 			log.Errorf("Failed to delete HNS endpoint: %v.", delErr)
 		}
@@ -281,94 +723,1228 @@ func (nb *BridgeBuilder) FindOrCreateEndpoint(nw *Network, ep *Endpoint) error {
 		return err
 	}
 
-	// Return network interface MAC address.
-	ep.MACAddress, _ = net.ParseMAC(hnsResponse.MacAddress)
+	// Return network interface compartment.
+	ep.CompartmentID = nb.getCompartmentID(nsType, namespaceIdentifier)
+
+	// The endpoint is left in place if it is not ready in time, to be deleted by the caller.
+	if nb.EndpointReadyTimeout != 0 && ep.CompartmentID != 0 {
+		err = nb.waitForEndpointReady(ep.CompartmentID, ep.IPAddresses[0].IP)
+		if err != nil {
+			return err
+		}
+	}
+
+	nb.eventSink().EndpointCreated(newEndpointEvent(hnsResponse, ep.ContainerID))
 
 	return nil
 }
 
-// DeleteEndpoint deletes an existing HNS endpoint.
+// CreateEndpointAsync creates a new HNS endpoint in the network without waiting for it, and
+// calls the callback with the result. Endpoints in the same network are still created one at
+// a time.
+func (nb *BridgeBuilder) CreateEndpointAsync(
+	nw *Network, ep *Endpoint, callback func(ep *Endpoint, err error)) {
+	go func() {
+		err := nb.FindOrCreateEndpoint(nw, ep)
+		callback(ep, err)
+	}()
+}
+
+// DeleteEndpoint deletes an existing HNS endpoint. The deletion runs in phases, in this order:
+//  1. Find the HNS endpoint of the container's namespace.
+//  2. Detach the HNS endpoint from the container or HCN namespace.
+//  3. Delete the HNS endpoint, unless it is still used by the infra container, it has a key or,
+//     unless forced, it is still in an HCN namespace.
+//  4. Delete the HNS network, if configured to and it has no endpoints left.
+//
+// Endpoints with a key outlive their infra container or HCN namespace, so that the restarted
+// container keeps its IP address. They are deleted by GC once their key is no longer in use.
 func (nb *BridgeBuilder) DeleteEndpoint(nw *Network, ep *Endpoint) error {
+	deleted, err := nb.deleteEndpoint(nw, ep, false)
+	if err != nil || !deleted || !nw.DeleteWithLastEndpoint {
+		return err
+	}
+
+	return nb.deleteNetworkIfUnused(nw)
+}
+
+// deleteEndpoint deletes an existing HNS endpoint, including endpoints with a key if deleteKeyed
+// is set, and returns whether it was deleted. The HNS network is never deleted.
+func (nb *BridgeBuilder) deleteEndpoint(nw *Network, ep *Endpoint, deleteKeyed bool) (bool, error) {
+	release := nb.acquireEndpointOperation()
+	defer release()
+
 	// Query the namespace identifier.
 	nsType, namespaceIdentifier := nb.getNamespaceIdentifier(ep)
 
 	// Find the HNS endpoint ID.
 	endpointName := nb.generateHNSEndpointName(ep, namespaceIdentifier)
-	hnsEndpoint, err := hcsshim.GetHNSEndpointByName(endpointName)
+	hnsEndpoint, err := nb.client().GetHNSEndpointByName(endpointName)
 	if err != nil {
-		return err
+		if hcsshim.IsNotExist(err) {
+			return false, nb.deleteAbsent(nw, DeleteObjectEndpoint, &ep.DeleteResult, err)
+		}
+		return false, err
+	}
+
+	err = nb.detachEndpoint(nw, hnsEndpoint, ep, nsType, namespaceIdentifier)
+	if err != nil {
+		return false, err
+	}
+
+	// The rest of the delete logic applies to infrastructure containers and HCN namespaces only.
+	if !nb.shouldDeleteEndpoint(nsType) {
+		// For non-infra containers, the endpoint and network must not be deleted.
+		return false, nil
+	}
+
+	if ep.Key != "" && !deleteKeyed {
+		log.Infof("Keeping HNS endpoint %s with key %s for the restarted container.",
+			hnsEndpoint.Name, ep.Key)
+		return false, nil
+	}
+
+	// Detaching from the HCN namespace is best effort, and the endpoint may still be in use.
+	if nsType == hcnNamespace && !nw.ForceEndpointDelete {
+		err = nb.checkEndpointUnreferenced(hnsEndpoint)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = nb.removeHNSEndpoint(nw, ep, hnsEndpoint)
+	if err != nil {
+		return false, err
 	}
+	ep.DeleteResult = DeleteResultDeleted
+	nb.metricsSink().DeleteCompleted(DeleteObjectEndpoint, DeleteResultDeleted)
 
-	// Detach the HNS endpoint from the container's network namespace.
+	return true, nil
+}
+
+// detachEndpoint detaches an HNS endpoint from the container's network namespace.
+func (nb *BridgeBuilder) detachEndpoint(
+	nw *Network, hnsEndpoint *hcsshim.HNSEndpoint, ep *Endpoint,
+	netNSType nsType, namespaceIdentifier string) error {
 	log.Infof("Detaching HNS endpoint %s from container %s netns.", hnsEndpoint.Id, ep.ContainerID)
-	if nsType == hcnNamespace {
+	if netNSType == hcnNamespace && nw.RequireHCNNamespaceDetach {
+		// Some builds of HNS leave residue behind when deleting endpoints still in a namespace.
+		// Retry the detach, and keep the endpoint if it fails.
+		err := nb.retryHCNNamespaceOperation(func() error {
+			return nb.removeHCNNamespaceEndpoint(namespaceIdentifier, hnsEndpoint.Id)
+		})
+		if err != nil {
+			log.Errorf("Failed to detach HNS endpoint %s from ns %s: %v.",
+				hnsEndpoint.Id, namespaceIdentifier, err)
+		}
+		return err
+	}
+	if netNSType == hcnNamespace {
 		// Detach the HNS endpoint from the namespace, if we can.
 		// HCN Namespace and HNS Endpoint have a 1-1 relationship, therefore,
 		// even if detachment of endpoint from namespace fails, we can still proceed to delete it.
-		err = hcn.RemoveNamespaceEndpoint(namespaceIdentifier, hnsEndpoint.Id)
+		err := nb.client().RemoveNamespaceEndpoint(namespaceIdentifier, hnsEndpoint.Id)
 		if err != nil {
 			log.Errorf("Failed to detach endpoint, ignoring: %v", err)
 		}
-	} else {
-		err = hcsshim.HotDetachEndpoint(ep.ContainerID, hnsEndpoint.Id)
-		if err != nil && err != hcsshim.ErrComputeSystemDoesNotExist {
-			return err
-		}
-
-		// The rest of the delete logic applies to infrastructure container only.
-		if nsType == appContainerNS {
-			// For non-infra containers, the network must not be deleted.
-			return nil
-		}
+		return nil
 	}
 
-	// Delete the HNS endpoint.
-	log.Infof("Deleting HNS endpoint name: %s ID: %s", endpointName, hnsEndpoint.Id)
-	_, err = hcsshim.HNSEndpointRequest("DELETE", hnsEndpoint.Id, "")
-	if err != nil {
-		log.Errorf("Failed to delete HNS endpoint: %v.", err)
+	err := nb.client().HotDetachEndpoint(ep.ContainerID, hnsEndpoint.Id)
+	if err != nil && err != hcsshim.ErrComputeSystemDoesNotExist {
+		return err
 	}
 
-	return err
+	return nil
 }
 
-// attachEndpointV1 attaches an HNS endpoint to a container's network namespace using HNS V1 APIs.
-func (nb *BridgeBuilder) attachEndpointV1(ep *hcsshim.HNSEndpoint, containerID string) error {
-	log.Infof("Attaching HNS endpoint %s to container %s.", ep.Id, containerID)
-	err := hcsshim.HotAttachEndpoint(containerID, ep.Id)
-	if err != nil {
-		// Attach can fail if the container is no longer running and/or its network namespace
-		// has been cleaned up.
-		log.Errorf("Failed to attach HNS endpoint %s: %v.", ep.Id, err)
+// resolveEndpointIPMismatch handles an existing HNS endpoint with a different IP address than
+// requested, according to the network's EndpointIPMismatchAction. It returns whether the
+// existing endpoint is kept.
+func (nb *BridgeBuilder) resolveEndpointIPMismatch(
+	nw *Network, ep *Endpoint, hnsEndpoint *hcsshim.HNSEndpoint,
+	netNSType nsType, namespaceIdentifier string) (bool, error) {
+	if len(ep.IPAddresses) == 0 || hnsEndpoint.IPAddress == nil ||
+		hnsEndpoint.IPAddress.Equal(ep.IPAddresses[0].IP) {
+		return true, nil
 	}
 
-	return err
-}
+	mismatchErr := &ErrEndpointIPMismatch{
+		EndpointName:       hnsEndpoint.Name,
+		IPAddress:          hnsEndpoint.IPAddress,
+		RequestedIPAddress: ep.IPAddresses[0].IP,
+	}
+
+	switch nw.EndpointIPMismatchAction {
+	case EndpointMismatchError:
+		log.Errorf("Invalid existing endpoint: %v.", mismatchErr)
+		return false, mismatchErr
+	case EndpointMismatchRecreate:
+		log.Warnf("Recreating stale endpoint: %v.", mismatchErr)
+		err := nb.detachEndpoint(nw, hnsEndpoint, ep, netNSType, namespaceIdentifier)
+		if err != nil {
+			return false, err
+		}
+		return false, nb.removeHNSEndpoint(nw, ep, hnsEndpoint)
+	default:
+		log.Warnf("Reusing existing endpoint: %v.", mismatchErr)
+		return true, nil
+	}
+}
+
+// resolveEndpointSubnetMismatch handles an existing HNS endpoint with an IP address outside the
+// ENI subnet, according to the network's EndpointSubnetMismatchAction. It returns whether the
+// existing endpoint is kept. Recreated endpoints without requested IP addresses are allocated
+// a secondary IP address of the ENI.
+func (nb *BridgeBuilder) resolveEndpointSubnetMismatch(
+	nw *Network, ep *Endpoint, hnsEndpoint *hcsshim.HNSEndpoint,
+	netNSType nsType, namespaceIdentifier string) (bool, error) {
+	mismatchErr := nb.checkEndpointSubnet(nw, hnsEndpoint)
+	if mismatchErr == nil {
+		return true, nil
+	}
+
+	switch nw.EndpointSubnetMismatchAction {
+	case EndpointMismatchError:
+		log.Errorf("Invalid existing endpoint: %v.", mismatchErr)
+		return false, mismatchErr
+	case EndpointMismatchRecreate:
+		log.Warnf("Recreating stale endpoint: %v.", mismatchErr)
+		err := nb.detachEndpoint(nw, hnsEndpoint, ep, netNSType, namespaceIdentifier)
+		if err != nil {
+			return false, err
+		}
+		return false, nb.removeHNSEndpoint(nw, ep, hnsEndpoint)
+	default:
+		log.Warnf("Reusing existing endpoint: %v.", mismatchErr)
+		return true, nil
+	}
+}
+
+// checkEndpointSubnet returns ErrEndpointSubnetMismatch if an HNS endpoint has an IP address
+// outside the ENI subnet, e.g. after the network's subnet changed.
+func (nb *BridgeBuilder) checkEndpointSubnet(
+	nw *Network, hnsEndpoint *hcsshim.HNSEndpoint) *ErrEndpointSubnetMismatch {
+	subnet := vpc.GetSubnetPrefix(&nw.ENIIPAddresses[0])
+	for _, ipAddress := range nb.getHNSEndpointIPAddresses(hnsEndpoint) {
+		if !subnet.Contains(ipAddress) {
+			return &ErrEndpointSubnetMismatch{
+				EndpointName: hnsEndpoint.Name,
+				IPAddress:    ipAddress,
+				Subnet:       subnet.String(),
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveEndpointNamespaceMismatch handles an existing HNS endpoint attached to another HCN
+// namespace than requested, according to the network's StaleNamespaceAction. Endpoints that
+// outlive their namespace stay attached to it until they are detached.
+func (nb *BridgeBuilder) resolveEndpointNamespaceMismatch(
+	nw *Network, hnsEndpoint *hcsshim.HNSEndpoint, namespaceIdentifier string) error {
+	if nw.StaleNamespaceAction == StaleNamespaceAttach {
+		return nil
+	}
+
+	namespaceID, err := nb.client().GetHCNEndpointNamespace(hnsEndpoint.Id)
+	if err != nil {
+		log.Errorf("Failed to query ns of HNS endpoint %s: %v.", hnsEndpoint.Id, err)
+		return err
+	}
+	if namespaceID == "" || namespaceID == namespaceIdentifier {
+		return nil
+	}
+
+	live, err := nb.client().HCNNamespaceExists(namespaceID)
+	if err != nil {
+		log.Errorf("Failed to query HCN namespace %s: %v.", namespaceID, err)
+		return err
+	}
+
+	mismatchErr := &ErrEndpointNamespaceMismatch{
+		EndpointName:         hnsEndpoint.Name,
+		NamespaceID:          namespaceID,
+		RequestedNamespaceID: namespaceIdentifier,
+		Live:                 live,
+	}
+	if live || nw.StaleNamespaceAction == StaleNamespaceError {
+		log.Errorf("Invalid existing endpoint: %v.", mismatchErr)
+		return mismatchErr
+	}
+
+	// The stale namespace is gone, so failing to detach from it leaves nothing to clean up.
+	log.Warnf("Rehoming existing endpoint: %v.", mismatchErr)
+	err = nb.removeHCNNamespaceEndpoint(namespaceID, hnsEndpoint.Id)
+	if err != nil {
+		log.Warnf("Failed to detach HNS endpoint %s from stale ns %s, ignoring: %v.",
+			hnsEndpoint.Id, namespaceID, err)
+	}
+
+	return nil
+}
+
+// removeHCNNamespaceEndpoint removes an endpoint from an HCN namespace. Endpoints that are no
+// longer in the namespace, such as after the namespace was deleted, are already detached.
+func (nb *BridgeBuilder) removeHCNNamespaceEndpoint(namespaceID string, endpointID string) error {
+	err := nb.client().RemoveNamespaceEndpoint(namespaceID, endpointID)
+	if err == nil {
+		return nil
+	}
+
+	endpointNamespaceID, lookupErr := nb.client().GetHCNEndpointNamespace(endpointID)
+	if lookupErr == nil && endpointNamespaceID != namespaceID {
+		log.Infof("HNS endpoint %s is not in ns %s: %v.", endpointID, namespaceID, err)
+		return nil
+	}
+
+	return err
+}
+
+// shouldDeleteEndpoint returns whether the HNS endpoint of a namespace is deleted with the
+// namespace. Endpoints are shared by all containers in a pod or task, and deleted only with
+// the infra container or HCN namespace that they were created for.
+func (nb *BridgeBuilder) shouldDeleteEndpoint(netNSType nsType) bool {
+	return netNSType != appContainerNS
+}
+
+// checkEndpointUnreferenced returns an error if an HNS endpoint is still attached to an HCN namespace.
+func (nb *BridgeBuilder) checkEndpointUnreferenced(hnsEndpoint *hcsshim.HNSEndpoint) error {
+	namespaceID, err := nb.client().GetHCNEndpointNamespace(hnsEndpoint.Id)
+	if err != nil {
+		log.Errorf("Failed to query namespace of HNS endpoint %s: %v.", hnsEndpoint.Id, err)
+		return err
+	}
+	if namespaceID != "" {
+		log.Errorf("Not deleting HNS endpoint %s because it is in HCN namespace %s.",
+			hnsEndpoint.Id, namespaceID)
+		return fmt.Errorf("HNS endpoint %s is still in HCN namespace %s", hnsEndpoint.Id, namespaceID)
+	}
+
+	return nil
+}
+
+// releaseSNATPorts releases the SNAT ports reserved for an HNS endpoint, if HNS allows it.
+func (nb *BridgeBuilder) releaseSNATPorts(hnsEndpoint *hcsshim.HNSEndpoint) {
+	log.Infof("Releasing SNAT ports of HNS endpoint %s.", hnsEndpoint.Id)
+	err := nb.client().RemoveHCNEndpointNATPolicy(hnsEndpoint.Id)
+	if err != nil {
+		// The ports are released when the endpoint is deleted anyway.
+		log.Warnf("Failed to release SNAT ports of HNS endpoint %s, ignoring: %v.", hnsEndpoint.Id, err)
+	}
+}
+
+// removeHNSEndpoint deletes a detached HNS endpoint along with the host routes to it, releasing
+// its SNAT ports first if the network is configured to.
+func (nb *BridgeBuilder) removeHNSEndpoint(
+	nw *Network, ep *Endpoint, hnsEndpoint *hcsshim.HNSEndpoint) error {
+	// Some versions of HNS keep the endpoint's SNAT ports reserved for a while after deleting it.
+	if nw.ReleaseSNATPortsOnDelete {
+		nb.releaseSNATPorts(hnsEndpoint)
+	}
+
+	nb.deleteHostRoutes(ep, hnsEndpoint)
+
+	return nb.deleteHNSEndpoint(hnsEndpoint, ep.ContainerID)
+}
+
+// deleteHNSEndpoint deletes the HNS endpoint of a container.
+func (nb *BridgeBuilder) deleteHNSEndpoint(hnsEndpoint *hcsshim.HNSEndpoint, containerID string) error {
+	log.Infof("Deleting HNS endpoint name: %s ID: %s", hnsEndpoint.Name, hnsEndpoint.Id)
+	_, err := nb.client().HNSEndpointRequest("DELETE", hnsEndpoint.Id, "")
+	if err != nil {
+		log.Errorf("Failed to delete HNS endpoint: %v.", err)
+		return err
+	}
+	nb.eventSink().EndpointDeleted(newEndpointEvent(hnsEndpoint, containerID))
+
+	return nil
+}
+
+// isAdapterShared returns whether other HNS networks are bound to the adapter of an HNS network.
+func (nb *BridgeBuilder) isAdapterShared(hnsNetwork *hcsshim.HNSNetwork) (bool, error) {
+	hnsNetworks, err := nb.client().HNSListNetworkRequest()
+	if err != nil {
+		return false, err
+	}
+
+	for _, network := range hnsNetworks {
+		if network.Id != hnsNetwork.Id && network.NetworkAdapterName == hnsNetwork.NetworkAdapterName {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// deleteAbsent records the delete of a network or endpoint already absent from HNS. It returns
+// the lookup error unless the network ignores absent objects on delete.
+func (nb *BridgeBuilder) deleteAbsent(
+	nw *Network, objectType string, result *DeleteResult, err error) error {
+	*result = DeleteResultAbsent
+	nb.metricsSink().DeleteCompleted(objectType, DeleteResultAbsent)
+	if !nw.IgnoreAbsentOnDelete {
+		return err
+	}
+
+	log.Infof("Ignoring delete of absent HNS %s: %v.", objectType, err)
+	return nil
+}
+
+// deleteNetworkIfUnused deletes the HNS network if it exists and has no endpoints left.
+func (nb *BridgeBuilder) deleteNetworkIfUnused(nw *Network) error {
+	networkName := nb.generateHNSNetworkName(nw)
+	_, err := nb.client().GetHNSNetworkByName(networkName)
+	if err != nil {
+		if hcsshim.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	hnsEndpoints, err := nb.listHNSEndpoints(networkName)
+	if err != nil {
+		return err
+	}
+	if len(hnsEndpoints) != 0 {
+		log.Infof("HNS network %s still has %d endpoints.", networkName, len(hnsEndpoints))
+		return nil
+	}
+
+	return nb.DeleteNetwork(nw)
+}
+
+// CheckEndpoint returns whether an existing HNS endpoint has an IP address in the ENI subnet, and
+// the DNS settings and policies that would be applied when creating the endpoint in the network,
+// as defined by the CNI CHECK operation. DNS settings that differ are updated in place instead,
+// if the network's EndpointDNSMismatchAction is NetworkMismatchUpdate.
+func (nb *BridgeBuilder) CheckEndpoint(nw *Network, ep *Endpoint) error {
+	_, namespaceIdentifier := nb.getNamespaceIdentifier(ep)
+	endpointName := nb.generateHNSEndpointName(ep, namespaceIdentifier)
+
+	hnsEndpoint, err := nb.client().GetHNSEndpointByName(endpointName)
+	if err != nil {
+		log.Errorf("Failed to find HNS endpoint %s: %v.", endpointName, err)
+		return err
+	}
+
+	if mismatchErr := nb.checkEndpointSubnet(nw, hnsEndpoint); mismatchErr != nil {
+		log.Errorf("Invalid HNS endpoint: %v.", mismatchErr)
+		return mismatchErr
+	}
+
+	// DNS settings that drifted can be updated in place.
+	if mismatchErr := nb.checkEndpointDNS(nw, ep, hnsEndpoint); mismatchErr != nil {
+		if nw.EndpointDNSMismatchAction != NetworkMismatchUpdate {
+			log.Errorf("Invalid HNS endpoint: %v.", mismatchErr)
+			return mismatchErr
+		}
+		log.Warnf("Correcting HNS endpoint: %v.", mismatchErr)
+		err = nb.updateHNSEndpointDNS(nw, ep, hnsEndpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	desiredEndpoint, err := nb.newHNSEndpoint(nw, ep, endpointName)
+	if err != nil {
+		return err
+	}
+
+	missing, unexpected, err := diffPolicies(desiredEndpoint.Policies, hnsEndpoint.Policies)
+	if err != nil {
+		log.Errorf("Failed to compare policies of HNS endpoint %s: %v.", endpointName, err)
+		return err
+	}
+	if len(missing) != 0 || len(unexpected) != 0 {
+		log.Errorf("HNS endpoint %s policies differ, missing: %v unexpected: %v.",
+			endpointName, missing, unexpected)
+		return fmt.Errorf("HNS endpoint %s has %d missing and %d unexpected policies",
+			endpointName, len(missing), len(unexpected))
+	}
+	ordered, err := nb.checkPolicyOrder(nw, desiredEndpoint.Policies, hnsEndpoint.Policies)
+	if err != nil {
+		log.Errorf("Failed to compare policies of HNS endpoint %s: %v.", endpointName, err)
+		return err
+	}
+	if !ordered {
+		log.Errorf("HNS endpoint %s policies are not in %q order.", endpointName, nw.PolicyOrder)
+		return fmt.Errorf("HNS endpoint %s policies are not in %q order", endpointName, nw.PolicyOrder)
+	}
+
+	return nil
+}
+
+// ReapplyEndpointPolicies replaces the policies of an existing HNS endpoint with those that would
+// be applied when creating the endpoint in the network, if they differ.
+func (nb *BridgeBuilder) ReapplyEndpointPolicies(nw *Network, ep *Endpoint) error {
+	_, namespaceIdentifier := nb.getNamespaceIdentifier(ep)
+	endpointName := nb.generateHNSEndpointName(ep, namespaceIdentifier)
+
+	hnsEndpoint, err := nb.client().GetHNSEndpointByName(endpointName)
+	if err != nil {
+		log.Errorf("Failed to find HNS endpoint %s: %v.", endpointName, err)
+		return err
+	}
+
+	desiredEndpoint, err := nb.newHNSEndpoint(nw, ep, endpointName)
+	if err != nil {
+		return err
+	}
+
+	missing, unexpected, err := diffPolicies(desiredEndpoint.Policies, hnsEndpoint.Policies)
+	if err != nil {
+		log.Errorf("Failed to compare policies of HNS endpoint %s: %v.", endpointName, err)
+		return err
+	}
+	ordered, err := nb.checkPolicyOrder(nw, desiredEndpoint.Policies, hnsEndpoint.Policies)
+	if err != nil {
+		log.Errorf("Failed to compare policies of HNS endpoint %s: %v.", endpointName, err)
+		return err
+	}
+	if len(missing) == 0 && len(unexpected) == 0 && ordered {
+		return nil
+	}
+
+	return nb.applyEndpointPolicies(hnsEndpoint, desiredEndpoint.Policies)
+}
+
+// checkPolicyOrder returns whether the policies of an HNS endpoint are listed in the desired
+// order. The order is only compared when the network configures a policy order, as HNS applies
+// the generated policies the same regardless of their order.
+func (nb *BridgeBuilder) checkPolicyOrder(nw *Network, desired, actual []json.RawMessage) (bool, error) {
+	if nw.PolicyOrder == PolicyOrderGeneratedFirst {
+		return true, nil
+	}
+
+	return samePolicyOrder(desired, actual)
+}
+
+// applyEndpointPolicies replaces all policies of an HNS endpoint in a single update.
+func (nb *BridgeBuilder) applyEndpointPolicies(
+	hnsEndpoint *hcsshim.HNSEndpoint, policies []json.RawMessage) error {
+	buf, err := json.Marshal(hcsshim.HNSEndpoint{Policies: policies})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Applying %d policies to HNS endpoint %s.", len(policies), hnsEndpoint.Id)
+	_, err = nb.client().HNSEndpointRequest("POST", hnsEndpoint.Id, string(buf))
+	if err != nil {
+		log.Errorf("Failed to update policies of HNS endpoint %s: %v.", hnsEndpoint.Id, err)
+	}
+
+	return err
+}
+
+// Status returns whether the builder is ready to handle requests, as defined by the CNI STATUS
+// operation. The builder is ready when HNS is reachable and its version is supported.
+func (nb *BridgeBuilder) Status() error {
+	err := nb.checkHNSVersion()
+	if err != nil {
+		log.Errorf("HNS is not ready: %v.", err)
+	}
+
+	return err
+}
+
+// GC deletes the HNS endpoints in the network that are not referenced by any of the given
+// endpoint keys, as defined by the CNI GC operation. An endpoint key is the identifier that the
+// endpoint was created for, i.e. the infra container ID or the HCN namespace ID. The network
+// itself is deleted or retained when it has no endpoints left, according to its GC policy.
+func (nb *BridgeBuilder) GC(nw *Network, endpointKeys []string) error {
+	networkName := nb.generateHNSNetworkName(nw)
+
+	// Generate the names of all endpoints that are still in use.
+	validEndpointNames := make(map[string]bool)
+	for _, key := range endpointKeys {
+		validEndpointNames[nb.generateHNSEndpointName(&Endpoint{Key: key}, "")] = true
+	}
+
+	// Serialize with the endpoint creates in the network, which would reuse a stale endpoint
+	// being deleted.
+	unlock := nb.lockNetwork(nw)
+	defer unlock()
+
+	hnsEndpoints, err := nb.listHNSEndpoints(networkName)
+	if err != nil {
+		return err
+	}
+
+	endpointNamePrefix := fmt.Sprintf(hnsEndpointNameFormat, "")
+	for _, hnsEndpoint := range hnsEndpoints {
+		// Skip endpoints not created by this plugin and those in use.
+		if !strings.HasPrefix(hnsEndpoint.Name, endpointNamePrefix) ||
+			validEndpointNames[hnsEndpoint.Name] {
+			continue
+		}
+
+		// Continue with the remaining endpoints and report the failure at the end.
+		delErr := nb.deleteStaleEndpoint(nw, &hnsEndpoint)
+		if delErr != nil {
+			err = delErr
+		}
+	}
+
+	// Delete the network if it is left without endpoints, unless it is retained to avoid
+	// recreating it for the next endpoint.
+	if err == nil && nw.NetworkGCPolicy == NetworkGCDelete {
+		err = nb.deleteNetworkIfUnused(nw)
+	}
+
+	return err
+}
+
+// deleteStaleEndpoint detaches and deletes a stale HNS endpoint found by GC.
+func (nb *BridgeBuilder) deleteStaleEndpoint(nw *Network, hnsEndpoint *hcsshim.HNSEndpoint) error {
+	release := nb.acquireEndpointOperation()
+	defer release()
+
+	log.Infof("Deleting stale HNS endpoint name: %s ID: %s", hnsEndpoint.Name, hnsEndpoint.Id)
+	err := nb.detachStaleEndpoint(nw, hnsEndpoint)
+	if err != nil {
+		return err
+	}
+
+	return nb.removeHNSEndpoint(nw, &Endpoint{}, hnsEndpoint)
+}
+
+// detachStaleEndpoint detaches a stale HNS endpoint from the HCN namespace or the containers it
+// is still attached to, before it is deleted.
+func (nb *BridgeBuilder) detachStaleEndpoint(nw *Network, hnsEndpoint *hcsshim.HNSEndpoint) error {
+	namespaceID, err := nb.client().GetHCNEndpointNamespace(hnsEndpoint.Id)
+	if err != nil {
+		log.Errorf("Failed to query namespace of HNS endpoint %s: %v.", hnsEndpoint.Id, err)
+		return err
+	}
+	if namespaceID != "" {
+		return nb.detachEndpoint(nw, hnsEndpoint, &Endpoint{}, hcnNamespace, namespaceID)
+	}
+
+	containerIDs, err := nb.client().GetHNSEndpointContainers(hnsEndpoint.Id)
+	if err != nil {
+		log.Errorf("Failed to query containers of HNS endpoint %s: %v.", hnsEndpoint.Id, err)
+		return err
+	}
+	for _, containerID := range containerIDs {
+		err = nb.detachEndpoint(nw, hnsEndpoint, &Endpoint{ContainerID: containerID},
+			infraContainerNS, "")
+		if err != nil {
+			log.Errorf("Failed to detach HNS endpoint %s from container %s: %v.",
+				hnsEndpoint.Id, containerID, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MoveEndpoint moves an endpoint from one network to another, keeping its IP addresses and host
+// routes. If the endpoint cannot be created in the destination network, it is restored in the
+// source network, which is kept even if the endpoint was its last. App container endpoints are
+// moved with the endpoint of their infra container, and cannot be moved on their own.
+func (nb *BridgeBuilder) MoveEndpoint(ep *Endpoint, fromNw *Network, toNw *Network) error {
+	if nsType, _ := nb.getNamespaceIdentifier(ep); nsType == appContainerNS {
+		return fmt.Errorf("cannot move the endpoint of app container %s sharing the netns %s",
+			ep.ContainerID, ep.NetNSName)
+	}
+
+	// Check that the destination network can host the endpoint's IP addresses.
+	subnet := vpc.GetSubnetPrefix(&toNw.ENIIPAddresses[0])
+	for _, ipAddr := range ep.IPAddresses {
+		if !subnet.Contains(ipAddr.IP) {
+			return fmt.Errorf("endpoint IP address %s is not in destination subnet %s",
+				ipAddr.IP, subnet)
+		}
+	}
+
+	// Check that the destination network exists.
+	toNetworkName := nb.generateHNSNetworkName(toNw)
+	_, err := nb.client().GetHNSNetworkByName(toNetworkName)
+	if err != nil {
+		log.Errorf("Failed to find destination HNS network %s: %v.", toNetworkName, err)
+		return err
+	}
+
+	log.Infof("Moving endpoint for container %s to HNS network %s.", ep.ContainerID, toNetworkName)
+	_, err = nb.deleteEndpoint(fromNw, ep, true)
+	if err != nil {
+		log.Errorf("Failed to delete endpoint from source network: %v.", err)
+		return err
+	}
+
+	err = nb.FindOrCreateEndpoint(toNw, ep)
+	if err != nil {
+		log.Errorf("Failed to create endpoint in destination network: %v.", err)
+
+		// Restore the endpoint in the source network.
+		rollbackErr := nb.FindOrCreateEndpoint(fromNw, ep)
+		if rollbackErr != nil {
+			log.Errorf("Failed to restore endpoint in source network: %v.", rollbackErr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// AttachExistingEndpoint attaches an existing HNS endpoint to a namespace without creating an
+// endpoint, e.g. for endpoints created by an earlier plugin in a CNI chain. The namespace
+// identifier is either an HCN namespace ID, attached using HNS V2 APIs, or an infra container ID,
+// attached using HNS V1 APIs.
+func (nb *BridgeBuilder) AttachExistingEndpoint(endpointID string, namespaceIdentifier string) error {
+	release := nb.acquireEndpointOperation()
+	defer release()
+
+	hnsEndpoint, err := nb.client().HNSEndpointRequest("GET", endpointID, "")
+	if err != nil {
+		log.Errorf("Failed to find HNS endpoint %s: %v.", endpointID, err)
+		return err
+	}
+
+	if hcnNamespaceIDPattern.MatchString(namespaceIdentifier) {
+		return nb.attachEndpointV2(hnsEndpoint, namespaceIdentifier)
+	}
+
+	return nb.attachEndpointV1(hnsEndpoint, namespaceIdentifier, infraContainerNS)
+}
+
+// ListEndpointsOutsideSubnet returns the names of the HNS endpoints in the network with IP
+// addresses outside the ENI subnet, e.g. to recreate the endpoints orphaned by a subnet change.
+func (nb *BridgeBuilder) ListEndpointsOutsideSubnet(nw *Network) ([]string, error) {
+	hnsEndpoints, err := nb.listHNSEndpoints(nb.generateHNSNetworkName(nw))
+	if err != nil {
+		return nil, err
+	}
+
+	var endpointNames []string
+	for _, hnsEndpoint := range hnsEndpoints {
+		if mismatchErr := nb.checkEndpointSubnet(nw, &hnsEndpoint); mismatchErr != nil {
+			log.Warnf("Found stale endpoint: %v.", mismatchErr)
+			endpointNames = append(endpointNames, hnsEndpoint.Name)
+		}
+	}
+
+	return endpointNames, nil
+}
+
+// ListEndpointsByCNINetwork returns the names of the HNS endpoints in the network that belong to
+// the CNI network with the given name, e.g. to clean up the secondary interfaces of a pod.
+func (nb *BridgeBuilder) ListEndpointsByCNINetwork(nw *Network, cniNetworkName string) ([]string, error) {
+	hnsEndpoints, err := nb.listHNSEndpoints(nb.generateHNSNetworkName(nw))
+	if err != nil {
+		return nil, err
+	}
+
+	var endpointNames []string
+	for _, hnsEndpoint := range hnsEndpoints {
+		metadata, err := nb.client().GetHNSEndpointMetadata(hnsEndpoint.Id)
+		if err != nil {
+			log.Errorf("Failed to read metadata of HNS endpoint %s: %v.", hnsEndpoint.Id, err)
+			return nil, err
+		}
+		if metadata[hnsEndpointCNINetworkKey] == cniNetworkName {
+			endpointNames = append(endpointNames, hnsEndpoint.Name)
+		}
+	}
+
+	return endpointNames, nil
+}
+
+// GetEndpointNamespace returns the identifier of the namespace an endpoint is attached to. This is
+// the HCN namespace ID for endpoints in HCN namespaces, or the infra container ID otherwise. It
+// returns an empty string if the endpoint exists but is not attached.
+func (nb *BridgeBuilder) GetEndpointNamespace(ep *Endpoint) (string, error) {
+	nsType, namespaceIdentifier := nb.getNamespaceIdentifier(ep)
+	endpointName := nb.generateHNSEndpointName(ep, namespaceIdentifier)
+
+	hnsEndpoint, err := nb.client().GetHNSEndpointByName(endpointName)
+	if err != nil {
+		log.Errorf("Failed to find HNS endpoint %s: %v.", endpointName, err)
+		return "", err
+	}
+
+	if nsType == hcnNamespace {
+		// Endpoints in HCN namespaces are attached using HNS V2 APIs.
+		namespaceID, err := nb.client().GetHCNEndpointNamespace(hnsEndpoint.Id)
+		if err != nil {
+			log.Errorf("Failed to query namespace of HNS endpoint %s: %v.", hnsEndpoint.Id, err)
+			return "", err
+		}
+		return namespaceID, nil
+	}
+
+	// Endpoints are attached to infra and app containers using HNS V1 APIs. The infra container
+	// is always the first container the endpoint is attached to.
+	containerIDs, err := nb.client().GetHNSEndpointContainers(hnsEndpoint.Id)
+	if err != nil {
+		log.Errorf("Failed to query containers of HNS endpoint %s: %v.", hnsEndpoint.Id, err)
+		return "", err
+	}
+	if len(containerIDs) == 0 {
+		return "", nil
+	}
+
+	return containerIDs[0], nil
+}
+
+// UsedIPs returns the IP addresses of all HNS endpoints in the network, for reconciliation with
+// the IPAM plugin. An IP address is listed once per endpoint using it, so that addresses
+// allocated to multiple endpoints can be detected.
+func (nb *BridgeBuilder) UsedIPs(nw *Network) ([]net.IP, error) {
+	hnsEndpoints, err := nb.listHNSEndpoints(nb.generateHNSNetworkName(nw))
+	if err != nil {
+		return nil, err
+	}
+
+	var ipAddresses []net.IP
+	for _, hnsEndpoint := range hnsEndpoints {
+		ipAddresses = append(ipAddresses, nb.getHNSEndpointIPAddresses(&hnsEndpoint)...)
+	}
+
+	return ipAddresses, nil
+}
+
+// IsIPInUse returns whether an IP address is assigned to any HNS endpoint in the network, for
+// external IPAM plugins to check an address before creating an endpoint with it. All addresses
+// of endpoints with multiple IP addresses are checked.
+func (nb *BridgeBuilder) IsIPInUse(nw *Network, ipAddress net.IP) (bool, error) {
+	usedIPs, err := nb.UsedIPs(nw)
+	if err != nil {
+		return false, err
+	}
+
+	for _, usedIP := range usedIPs {
+		if usedIP.Equal(ipAddress) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// EndpointCount returns the number of HNS endpoints in the network, for capacity planning.
+func (nb *BridgeBuilder) EndpointCount(nw *Network) (int, error) {
+	networkName := nb.generateHNSNetworkName(nw)
+	hnsNetwork, err := nb.client().GetHNSNetworkByName(networkName)
+	if err != nil {
+		log.Errorf("Failed to find HNS network %s: %v.", networkName, err)
+		return 0, err
+	}
+
+	count, err := nb.client().CountHNSNetworkEndpoints(hnsNetwork.Id)
+	if err != nil {
+		log.Errorf("Failed to count endpoints of HNS network %s: %v.", networkName, err)
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// attachEndpointV1 attaches an HNS endpoint to a container's network namespace using HNS V1 APIs.
+func (nb *BridgeBuilder) attachEndpointV1(
+	ep *hcsshim.HNSEndpoint, containerID string, netNSType nsType) error {
+	log.Infof("Attaching HNS endpoint %s to container %s.", ep.Id, containerID)
+	start := time.Now()
+	err := nb.client().HotAttachEndpoint(containerID, ep.Id)
+	if err != nil {
+		// Attach can fail if the container is no longer running and/or its network namespace
+		// has been cleaned up.
+		log.Errorf("Failed to attach HNS endpoint %s: %v.", ep.Id, err)
+		return err
+	}
+
+	nb.recordAttachDuration(netNSType, time.Since(start))
+
+	return nil
+}
+
+// isEndpointAttachedToContainer returns whether an HNS endpoint is attached to a container using
+// HNS V1 APIs.
+func (nb *BridgeBuilder) isEndpointAttachedToContainer(
+	hnsEndpoint *hcsshim.HNSEndpoint, containerID string) (bool, error) {
+	containerIDs, err := nb.client().GetHNSEndpointContainers(hnsEndpoint.Id)
+	if err != nil {
+		log.Errorf("Failed to query containers of HNS endpoint %s: %v.", hnsEndpoint.Id, err)
+		return false, err
+	}
+
+	for _, id := range containerIDs {
+		if id == containerID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// attachEndpointV2 attaches an HNS endpoint to a network namespace using HNS V2 APIs.
+func (nb *BridgeBuilder) attachEndpointV2(ep *hcsshim.HNSEndpoint, netNSName string) error {
+	log.Infof("Adding HNS endpoint %s to ns %s.", ep.Id, netNSName)
+
+	// Check if endpoint is already in target namespace.
+	// HCN namespace operations can fail transiently while the namespace is being created.
+	var nsEndpoints []string
+	err := nb.retryHCNNamespaceOperation(func() error {
+		var err error
+		nsEndpoints, err = nb.client().GetNamespaceEndpointIds(netNSName)
+		return err
+	})
+	if err != nil {
+		log.Errorf("Failed to get endpoints from namespace %s: %v.", netNSName, err)
+		return err
+	}
+	for _, endpointID := range nsEndpoints {
+		if ep.Id == endpointID {
+			log.Infof("HNS endpoint %s is already in ns %s.", endpointID, netNSName)
+			return nil
+		}
+	}
+
+	// Add the endpoint to the target namespace.
+	start := time.Now()
+	err = nb.retryHCNNamespaceOperation(func() error {
+		return nb.client().AddNamespaceEndpoint(netNSName, ep.Id)
+	})
+	if err != nil {
+		log.Errorf("Failed to attach HNS endpoint %s: %v.", ep.Id, err)
+		return err
+	}
+
+	nb.recordAttachDuration(hcnNamespace, time.Since(start))
+
+	return nil
+}
+
+// findOrCreateHCNNamespace returns ErrHCNNamespaceNotFound if the HCN namespace does not exist,
+// unless the network allows creating missing namespaces.
+func (nb *BridgeBuilder) findOrCreateHCNNamespace(nw *Network, namespaceID string) error {
+	exists, err := nb.client().HCNNamespaceExists(namespaceID)
+	if err != nil {
+		log.Errorf("Failed to query HCN namespace %s: %v.", namespaceID, err)
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	if !nw.CreateMissingHCNNamespaces {
+		log.Errorf("Failed to find HCN namespace %s.", namespaceID)
+		return &ErrHCNNamespaceNotFound{NamespaceID: namespaceID}
+	}
+
+	log.Infof("Creating missing HCN namespace %s.", namespaceID)
+	err = nb.client().CreateHCNNamespace(namespaceID)
+	if err != nil {
+		log.Errorf("Failed to create HCN namespace %s: %v.", namespaceID, err)
+	}
+
+	return err
+}
+
+// getCompartmentID returns the ID of the network compartment of a namespace, or zero if unknown.
+// Compartment IDs are available only for HCN namespaces.
+func (nb *BridgeBuilder) getCompartmentID(netNSType nsType, namespaceIdentifier string) uint32 {
+	if netNSType != hcnNamespace {
+		return 0
+	}
+
+	compartmentID, err := nb.client().GetHCNNamespaceCompartmentID(namespaceIdentifier)
+	if err != nil {
+		// The compartment ID is informational only.
+		log.Warnf("Failed to query compartment of ns %s: %v.", namespaceIdentifier, err)
+		return 0
+	}
+
+	return compartmentID
+}
+
+// retryHCNNamespaceOperation calls an HCN namespace operation until it succeeds or times out,
+// with exponential backoff between the attempts. It returns the last error on timeout.
+func (nb *BridgeBuilder) retryHCNNamespaceOperation(operation func() error) error {
+	config := nb.config()
+
+	return retryOperation("HCN namespace operation", config.HCNNamespaceTimeout,
+		config.HCNNamespaceRetryInterval, hcnNamespaceMaxRetryInterval, operation)
+}
+
+// retryOperation calls an operation until it succeeds or times out, with the interval between
+// the attempts doubling up to the maximum interval. It returns the last error on timeout.
+func retryOperation(
+	name string, timeout, interval, maxInterval time.Duration, operation func() error) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := operation()
+		if err == nil || time.Now().Add(interval).After(deadline) {
+			return err
+		}
+
+		log.Warnf("%s failed, retrying in %v: %v.", name, interval, err)
+		time.Sleep(interval)
+
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+// waitForHNSEndpoint waits until the HNS endpoint with the given name exists or times out.
+func (nb *BridgeBuilder) waitForHNSEndpoint(endpointName string, timeout time.Duration) {
+	err := retryOperation("HNS endpoint lookup", timeout, infraEndpointRetryInterval,
+		infraEndpointMaxRetryInterval, func() error {
+			_, err := nb.client().GetHNSEndpointByName(endpointName)
+			return err
+		})
+	if err != nil {
+		log.Warnf("Timed out waiting for HNS endpoint %s: %v.", endpointName, err)
+	}
+}
+
+// newHNSEndpoint returns the HNS endpoint, including its policies, for an endpoint in the network.
+func (nb *BridgeBuilder) newHNSEndpoint(
+	nw *Network, ep *Endpoint, endpointName string) (*hcsshim.HNSEndpoint, error) {
+	hnsEndpoint := &hcsshim.HNSEndpoint{
+		Name:               endpointName,
+		VirtualNetworkName: nb.generateHNSNetworkName(nw),
+		IsRemoteEndpoint:   ep.IsRemoteEndpoint,
+		DisableICC:         ep.DisableICC,
+	}
+
+	// Set the endpoint DNS settings, unless the containers manage their own. Secondary endpoints
+	// of multi-homed containers can leave the DNS settings to the primary endpoint.
+	hnsEndpoint.DNSServerList, hnsEndpoint.DNSSuffix = nb.generateHNSEndpointDNS(nw, ep)
+
+	// Set the endpoint IP address.
+	hnsEndpoint.IPAddress = ep.IPAddresses[0].IP
+	hnsEndpoint.PrefixLength = nb.getEndpointPrefixLength(nw, ep)
+
+	// Policies that fail to build fail the endpoint, unless the network applies policies on a
+	// best-effort basis. Skipped policies are logged and reported in the result.
+	var skippedPolicies []string
+	skipPolicy := func(name string, err error) error {
+		if nw.PolicyMode != PolicyModeBestEffort {
+			return err
+		}
+		log.Warnf("Skipping endpoint %s policy: %v.", name, err)
+		skippedPolicies = append(skippedPolicies, name)
+		return nil
+	}
 
-// attachEndpointV2 attaches an HNS endpoint to a network namespace using HNS V2 APIs.
-func (nb *BridgeBuilder) attachEndpointV2(ep *hcsshim.HNSEndpoint, netNSName string) error {
-	log.Infof("Adding HNS endpoint %s to ns %s.", ep.Id, netNSName)
+	var err error
+	var snatExceptions, routeDestinations []string
+	if nw.TransparentMode {
+		// Containers use their routable IP addresses, with a default route via the gateway.
+		hnsEndpoint.GatewayAddress = nw.GatewayIPAddress.String()
+	} else if !nw.DisableSNAT {
+		// SNAT endpoint traffic to ENI primary IP address. The policy covers the endpoint's
+		// single IPv4 address.
+		snatExceptions, err = nb.addOutboundNATPolicy(hnsEndpoint, nw, ep)
+		if err != nil {
+			if err = skipPolicy(string(hcsshim.OutboundNat), err); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-	// Check if endpoint is already in target namespace.
-	nsEndpoints, err := hcn.GetNamespaceEndpointIds(netNSName)
+	// Route traffic sent to service endpoints to the host. The load balancer running
+	// in the host network namespace then forwards traffic to its final destination.
+	if nb.shouldAddServiceRoute(nw) {
+		// Set route policy for service subnet.
+		// NextHop is implicitly the host.
+		err = nb.addEndpointPolicy(
+			hnsEndpoint,
+			hnsRoutePolicy{
+				Policy:            hcsshim.Policy{Type: hcsshim.Route},
+				DestinationPrefix: nw.ServiceCIDR,
+				NeedEncap:         true,
+			})
+		if err != nil {
+			log.Errorf("Failed to add endpoint route policy for service subnet: %v.", err)
+			if err = skipPolicy("ROUTE "+nw.ServiceCIDR, err); err != nil {
+				return nil, err
+			}
+		} else {
+			routeDestinations = append(routeDestinations, nw.ServiceCIDR)
+		}
+	}
+
+	if nb.shouldAddHostRoute(nw) && !ep.DisableHostRoute {
+		// Set route policy for host primary IP address.
+		hostPrefix := nw.ENIIPAddresses[0].IP.String() + "/32"
+		err = nb.addEndpointPolicy(
+			hnsEndpoint,
+			hnsRoutePolicy{
+				Policy:            hcsshim.Policy{Type: hcsshim.Route},
+				DestinationPrefix: hostPrefix,
+				NeedEncap:         true,
+			})
+		if err != nil {
+			log.Errorf("Failed to add endpoint route policy for host: %v.", err)
+			if err = skipPolicy("ROUTE "+hostPrefix, err); err != nil {
+				return nil, err
+			}
+		} else {
+			routeDestinations = append(routeDestinations, hostPrefix)
+		}
+	}
+
+	// Set route policies for the routes scoped to the endpoint.
+	for _, route := range ep.Routes {
+		policy := hnsRoutePolicy{
+			Policy:            hcsshim.Policy{Type: hcsshim.Route},
+			DestinationPrefix: route.Destination.String(),
+		}
+		if route.NextHop != nil {
+			policy.NextHop = route.NextHop.String()
+		} else {
+			policy.NeedEncap = true
+		}
+
+		err = nb.addEndpointPolicy(hnsEndpoint, policy)
+		if err != nil {
+			log.Errorf("Failed to add endpoint route policy for %s: %v.", route.Destination.String(), err)
+			if err = skipPolicy("ROUTE "+policy.DestinationPrefix, err); err != nil {
+				return nil, err
+			}
+		} else {
+			routeDestinations = append(routeDestinations, policy.DestinationPrefix)
+		}
+	}
+
+	// Associate the endpoint with its VXLAN network identifier.
+	if ep.VNI != 0 {
+		err = nb.addEndpointPolicy(
+			hnsEndpoint,
+			hcsshim.VsidPolicy{
+				Type: hcsshim.VSID,
+				VSID: uint(ep.VNI),
+			})
+		if err != nil {
+			log.Errorf("Failed to add endpoint VSID policy: %v.", err)
+			if err = skipPolicy(string(hcsshim.VSID), err); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Set ACL policies for the network's firewall rules and the endpoint's egress allowlist. The
+	// ACL policies are added or skipped together, as a partial set of firewall rules could allow
+	// traffic meant to be blocked.
+	err = nb.addACLPolicies(hnsEndpoint, nw, ep)
 	if err != nil {
-		log.Errorf("Failed to get endpoints from namespace %s: %v.", netNSName, err)
-		return err
+		if err = skipPolicy(string(hcsshim.ACL), err); err != nil {
+			return nil, err
+		}
 	}
-	for _, endpointID := range nsEndpoints {
-		if ep.Id == endpointID {
-			log.Infof("HNS endpoint %s is already in ns %s.", endpointID, netNSName)
-			return nil
+
+	// Apply the policy templates defined on the network, followed by the endpoint's own policies.
+	// Malformed policies would fail to encode in the HNS endpoint request.
+	var userPolicies []json.RawMessage
+	for i, policy := range nw.EndpointPolicies {
+		err = nb.checkUserPolicy(policy, fmt.Sprintf("Network.EndpointPolicies[%d]", i))
+		if err == nil {
+			userPolicies = append(userPolicies, policy)
+		} else if err = skipPolicy(fmt.Sprintf("EndpointPolicies[%d]", i), err); err != nil {
+			return nil, err
+		}
+	}
+	for i, policy := range ep.Policies {
+		err = nb.checkUserPolicy(policy, fmt.Sprintf("Endpoint.Policies[%d]", i))
+		if err == nil {
+			userPolicies = append(userPolicies, policy)
+		} else if err = skipPolicy(fmt.Sprintf("Policies[%d]", i), err); err != nil {
+			return nil, err
 		}
 	}
+	if nw.PolicyOrder == PolicyOrderUserFirst {
+		hnsEndpoint.Policies = append(userPolicies, hnsEndpoint.Policies...)
+	} else {
+		hnsEndpoint.Policies = append(hnsEndpoint.Policies, userPolicies...)
+	}
 
-	// Add the endpoint to the target namespace.
-	err = hcn.AddNamespaceEndpoint(netNSName, ep.Id)
+	// Report the effective policies, unless the network considers them sensitive.
+	if !nw.RedactEndpointPolicyResult {
+		ep.SNATExceptions = snatExceptions
+		ep.RouteDestinations = routeDestinations
+	}
+	ep.SkippedPolicies = skippedPolicies
+
+	return hnsEndpoint, nil
+}
+
+// getEndpointPrefixLength returns the prefix length of the endpoint's IP address. It is either set
+// explicitly on the endpoint, or taken from the address mask or, without a mask, from the ENI subnet.
+func (nb *BridgeBuilder) getEndpointPrefixLength(nw *Network, ep *Endpoint) uint8 {
+	if ep.PrefixLength != 0 {
+		return ep.PrefixLength
+	}
+
+	ones, bits := ep.IPAddresses[0].Mask.Size()
+	if bits == 0 {
+		ones, _ = nw.ENIIPAddresses[0].Mask.Size()
+	}
+
+	return uint8(ones)
+}
+
+// encodeHNSEndpointRequest encodes an HNS endpoint request with additional fields not modeled by
+// hcsshim. The additional fields cannot override the fields set by the plugin.
+func (nb *BridgeBuilder) encodeHNSEndpointRequest(
+	hnsEndpoint *hnsEndpointRequest, extraFields map[string]interface{}) (string, error) {
+	buf, err := json.Marshal(hnsEndpoint)
 	if err != nil {
-		log.Errorf("Failed to attach HNS endpoint %s: %v.", ep.Id, err)
+		return "", err
 	}
 
-	return err
+	buf, err = nb.addExtraFields(buf, extraFields, "endpoint")
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// addExtraFields adds fields not modeled by hcsshim to an encoded HNS object. The additional
+// fields cannot override the fields already set.
+func (nb *BridgeBuilder) addExtraFields(
+	buf []byte, extraFields map[string]interface{}, kind string) ([]byte, error) {
+	if len(extraFields) == 0 {
+		return buf, nil
+	}
+
+	var object map[string]interface{}
+	err := json.Unmarshal(buf, &object)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range extraFields {
+		// HNS field names are case-insensitive.
+		for field := range object {
+			if strings.EqualFold(name, field) {
+				return nil, fmt.Errorf("extra %s field %s conflicts with field %s", kind, name, field)
+			}
+		}
+		object[name] = value
+	}
+
+	return json.Marshal(object)
+}
+
+// checkUserPolicy returns an error if a user-provided policy is not a JSON object.
+func (nb *BridgeBuilder) checkUserPolicy(policy json.RawMessage, name string) error {
+	var fields map[string]interface{}
+	err := json.Unmarshal(policy, &fields)
+	if err != nil {
+		log.Errorf("Invalid endpoint policy %s: %v.", name, err)
+		return fmt.Errorf("invalid endpoint policy %s: %v", name, err)
+	}
+
+	return nil
 }
 
 // addEndpointPolicy adds a policy to an HNS endpoint.
@@ -384,6 +1960,92 @@ func (nb *BridgeBuilder) addEndpointPolicy(ep *hcsshim.HNSEndpoint, policy inter
 	return nil
 }
 
+// shouldAddServiceRoute returns whether endpoints route the network's service CIDR to the host.
+func (nb *BridgeBuilder) shouldAddServiceRoute(nw *Network) bool {
+	return nw.ServiceCIDR != "" && (nw.AddServiceRoute == nil || *nw.AddServiceRoute)
+}
+
+// shouldAddHostRoute returns whether endpoints route the host's primary IP address to the host.
+func (nb *BridgeBuilder) shouldAddHostRoute(nw *Network) bool {
+	return nw.ServiceCIDR != "" && (nw.AddHostRoute == nil || *nw.AddHostRoute)
+}
+
+// lockNetwork acquires the lock of the network and returns the function to release it.
+func (nb *BridgeBuilder) lockNetwork(nw *Network) func() {
+	lock, _ := nb.networkLocks.LoadOrStore(nb.generateHNSNetworkName(nw), &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+
+	return lock.(*sync.Mutex).Unlock
+}
+
+// acquireEndpointOperation waits until fewer than the maximum number of endpoint operations are
+// running, and returns the function to call when the operation completes.
+func (nb *BridgeBuilder) acquireEndpointOperation() func() {
+	nb.endpointOperationsOnce.Do(func() {
+		nb.endpointOperations = make(chan struct{}, nb.config().MaxConcurrentEndpointOperations)
+	})
+
+	nb.endpointOperations <- struct{}{}
+
+	return func() { <-nb.endpointOperations }
+}
+
+// checkNetworkExists returns ErrNetworkNotFound if the HNS network does not exist.
+func (nb *BridgeBuilder) checkNetworkExists(nw *Network) error {
+	networkName := nb.generateHNSNetworkName(nw)
+	_, err := nb.client().GetHNSNetworkByName(networkName)
+	if hcsshim.IsNotExist(err) {
+		log.Errorf("Failed to find HNS network %s.", networkName)
+		return &ErrNetworkNotFound{NetworkName: networkName}
+	}
+	if err != nil {
+		log.Errorf("Failed to query HNS network %s: %v.", networkName, err)
+	}
+
+	return err
+}
+
+// checkEndpointIPConflict returns an error if the endpoint requests an IP address owned by the
+// host, i.e. one of the shared ENI's IP addresses or the subnet gateway.
+func (nb *BridgeBuilder) checkEndpointIPConflict(nw *Network, ep *Endpoint) error {
+	for _, ipAddress := range ep.IPAddresses {
+		for _, eniIPAddress := range nw.ENIIPAddresses {
+			if ipAddress.IP.Equal(eniIPAddress.IP) {
+				return &ErrEndpointIPConflict{IPAddress: ipAddress.IP, Owner: "shared ENI"}
+			}
+		}
+		if ipAddress.IP.Equal(nw.GatewayIPAddress) {
+			return &ErrEndpointIPConflict{IPAddress: ipAddress.IP, Owner: "subnet gateway"}
+		}
+	}
+
+	return nil
+}
+
+// validateServiceCIDR returns an error if the service CIDR overlaps the VPC or the ENI subnet.
+// Traffic to such service endpoints would be both routed to the host and exempted from SNAT,
+// causing routing loops or dropped traffic.
+func (nb *BridgeBuilder) validateServiceCIDR(nw *Network) error {
+	if nw.ServiceCIDR == "" {
+		return nil
+	}
+
+	_, serviceCIDR, err := net.ParseCIDR(nw.ServiceCIDR)
+	if err != nil {
+		return err
+	}
+
+	prefixes := append([]net.IPNet{*vpc.GetSubnetPrefix(&nw.ENIIPAddresses[0])}, nw.VPCCIDRs...)
+	for _, prefix := range prefixes {
+		if prefix.Contains(serviceCIDR.IP) || serviceCIDR.Contains(prefix.IP) {
+			return fmt.Errorf("service CIDR %s overlaps VPC or subnet CIDR %s",
+				serviceCIDR, prefix.String())
+		}
+	}
+
+	return nil
+}
+
 // getNamespaceIdentifier identifies the namespace type and returns the appropriate identifier.
 func (nb *BridgeBuilder) getNamespaceIdentifier(ep *Endpoint) (nsType, string) {
 	// Orchestrators like Kubernetes and ECS group a set of containers into deployment units called
@@ -398,7 +2060,6 @@ func (nb *BridgeBuilder) getNamespaceIdentifier(ep *Endpoint) (nsType, string) {
 	// to each container. The logic below is necessary to detect infrastructure containers and
 	// maintain compatibility with those older versions.
 
-	const containerPrefix string = "container:"
 	var netNSType nsType
 	var namespaceIdentifier string
 
@@ -407,11 +2068,11 @@ func (nb *BridgeBuilder) getNamespaceIdentifier(ep *Endpoint) (nsType, string) {
 		// The namespace identifier for such containers would be their container ID.
 		netNSType = infraContainerNS
 		namespaceIdentifier = ep.ContainerID
-	} else if strings.HasPrefix(ep.NetNSName, containerPrefix) {
+	} else if strings.HasPrefix(ep.NetNSName, containerNetNSPrefix) {
 		// This is a workload container sharing the netns of a previously created infra container.
 		// The namespace identifier for such containers would be the infra container's ID.
 		netNSType = appContainerNS
-		namespaceIdentifier = strings.TrimPrefix(ep.NetNSName, containerPrefix)
+		namespaceIdentifier = strings.TrimPrefix(ep.NetNSName, containerNetNSPrefix)
 		log.Infof("Container %s shares netns of container %s.", ep.ContainerID, namespaceIdentifier)
 	} else {
 		// This plugin invocation does not need an infra container and uses an existing HCN Namespace.
@@ -426,37 +2087,349 @@ func (nb *BridgeBuilder) getNamespaceIdentifier(ep *Endpoint) (nsType, string) {
 
 // checkHNSVersion returns whether the Windows Host Networking Service version is supported.
 func (nb *BridgeBuilder) checkHNSVersion() error {
-	hnsGlobals, err := hcsshim.GetHNSGlobals()
+	timeout := nb.config().HNSGlobalsTimeout
+
+	// HNS is briefly unreachable while it restarts.
+	var hnsGlobals *hcsshim.HNSGlobals
+	err := retryOperation("HNS globals query", timeout, hnsGlobalsRetryInterval,
+		hnsGlobalsMaxRetryInterval, func() error {
+			var err error
+			hnsGlobals, err = nb.client().GetHNSGlobals()
+			return err
+		})
 	if err != nil {
+		log.Errorf("Failed to query HNS globals: %v.", err)
 		return err
 	}
 
 	hnsVersion := hnsGlobals.Version
 	log.Infof("Running on HNS version: %+v", hnsVersion)
 
-	supported := hnsVersion.Major > hnsMinVersion.Major ||
-		(hnsVersion.Major == hnsMinVersion.Major && hnsVersion.Minor >= hnsMinVersion.Minor)
+	if !isHNSVersionAtLeast(hnsVersion, hnsMinVersion) {
+		return &ErrHNSVersionUnsupported{Version: hnsVersion, MinVersion: hnsMinVersion}
+	}
+
+	return nil
+}
+
+// shouldRecreateHNSNetwork returns whether an existing HNS network must be recreated because it
+// was created by an incompatible version of this plugin. Networks without a version predate
+// network versioning, and are compatible with version 1.
+func (nb *BridgeBuilder) shouldRecreateHNSNetwork(
+	nw *Network, hnsNetwork *hcsshim.HNSNetwork, metadata map[string]string) bool {
+	version, ok := metadata[hnsNetworkVersionKey]
+	if !ok || version == hnsNetworkVersion {
+		return false
+	}
+
+	log.Warnf("HNS network %s has version %q, expected version %q.",
+		hnsNetwork.Name, version, hnsNetworkVersion)
+
+	if nw.VersionMismatchAction != NetworkMismatchRecreate {
+		return false
+	}
+
+	// Deleting a network in use would disconnect its endpoints.
+	hnsEndpoints, err := nb.listHNSEndpoints(hnsNetwork.Name)
+	if err != nil || len(hnsEndpoints) != 0 {
+		log.Warnf("Not recreating HNS network %s because it has endpoints.", hnsNetwork.Name)
+		return false
+	}
+
+	return true
+}
+
+// shouldResubnetHNSNetwork returns whether an existing HNS network must be recreated because its
+// subnet or gateway no longer match the shared ENI, such as after the ENI was reattached with a
+// different primary IP address. The network name is derived from the ENI's MAC address, so it
+// does not change with the IP address.
+func (nb *BridgeBuilder) shouldResubnetHNSNetwork(
+	nw *Network, hnsNetwork *hcsshim.HNSNetwork) bool {
+	if len(hnsNetwork.Subnets) == 0 {
+		return false
+	}
+
+	existing := hnsNetwork.Subnets[0]
+	subnet := vpc.GetSubnetPrefix(&nw.ENIIPAddresses[0]).String()
+	gateway := nw.GatewayIPAddress.String()
+	if existing.AddressPrefix == subnet && existing.GatewayAddress == gateway {
+		return false
+	}
+
+	log.Warnf("HNS network %s has subnet %s gateway %s, expected subnet %s gateway %s.",
+		hnsNetwork.Name, existing.AddressPrefix, existing.GatewayAddress, subnet, gateway)
+
+	if nw.SubnetMismatchAction != NetworkMismatchRecreate {
+		return false
+	}
+
+	// Deleting a network in use would disconnect its endpoints.
+	hnsEndpoints, err := nb.listHNSEndpoints(hnsNetwork.Name)
+	if err != nil || len(hnsEndpoints) != 0 {
+		log.Warnf("Not recreating HNS network %s because it has endpoints.", hnsNetwork.Name)
+		return false
+	}
+
+	return true
+}
+
+// findHNSNetworkResidue returns the descriptions of the state left behind by a deleted HNS
+// network, such as the network itself, its endpoints or a network bound to its adapter.
+func (nb *BridgeBuilder) findHNSNetworkResidue(
+	nw *Network, hnsNetwork *hcsshim.HNSNetwork) ([]string, error) {
+	var residue []string
+
+	adapterName, err := nb.getAdapterName(nw)
+	if err != nil {
+		// Networks can only be bound to existing adapters.
+		adapterName = nw.SharedENI.GetLinkName()
+	}
+
+	hnsNetworks, err := nb.client().HNSListNetworkRequest()
+	if err != nil {
+		return nil, err
+	}
+	for _, network := range hnsNetworks {
+		if network.Id == hnsNetwork.Id || network.Name == hnsNetwork.Name {
+			residue = append(residue, fmt.Sprintf("network %s", network.Id))
+		} else if network.NetworkAdapterName == adapterName {
+			residue = append(residue, fmt.Sprintf("network %s bound to adapter %s",
+				network.Id, network.NetworkAdapterName))
+		}
+	}
+
+	hnsEndpoints, err := nb.listHNSEndpoints(hnsNetwork.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, hnsEndpoint := range hnsEndpoints {
+		residue = append(residue, fmt.Sprintf("endpoint %s", hnsEndpoint.Id))
+	}
+
+	return residue, nil
+}
+
+// generateHNSNetworkMetadata returns the metadata recorded on the HNS network for the network.
+func (nb *BridgeBuilder) generateHNSNetworkMetadata(nw *Network) map[string]string {
+	metadata := map[string]string{hnsNetworkVersionKey: hnsNetworkVersion}
+	if dnsServerList, dnsSuffix := nb.generateHNSNetworkDNS(nw); dnsServerList != "" || dnsSuffix != "" {
+		metadata[hnsNetworkDNSKey] = "true"
+	}
+	if nw.VPCID != "" {
+		metadata[hnsNetworkVPCIDKey] = nw.VPCID
+	}
+	if nw.SubnetID != "" {
+		metadata[hnsNetworkSubnetIDKey] = nw.SubnetID
+	}
+
+	return metadata
+}
+
+// readNetworkTags sets the VPC and subnet IDs of the network from the HNS network metadata.
+// The IDs recorded when the network was created take precedence.
+func (nb *BridgeBuilder) readNetworkTags(nw *Network, metadata map[string]string) {
+	for key, id := range map[string]*string{
+		hnsNetworkVPCIDKey:    &nw.VPCID,
+		hnsNetworkSubnetIDKey: &nw.SubnetID,
+	} {
+		value, ok := metadata[key]
+		if !ok {
+			continue
+		}
+		if *id != "" && *id != value {
+			log.Warnf("HNS network metadata %s is %s, expected %s.", key, value, *id)
+		}
+		*id = value
+	}
+}
+
+// listHNSEndpoints returns the HNS endpoints in the network with the given name.
+func (nb *BridgeBuilder) listHNSEndpoints(networkName string) ([]hcsshim.HNSEndpoint, error) {
+	allEndpoints, err := nb.client().HNSListEndpointRequest()
+	if err != nil {
+		log.Errorf("Failed to list HNS endpoints: %v.", err)
+		return nil, err
+	}
+
+	var hnsEndpoints []hcsshim.HNSEndpoint
+	for _, hnsEndpoint := range allEndpoints {
+		if hnsEndpoint.VirtualNetworkName == networkName {
+			hnsEndpoints = append(hnsEndpoints, hnsEndpoint)
+		}
+	}
+
+	return hnsEndpoints, nil
+}
+
+// generateHNSEndpointMetadata returns the HNS endpoint metadata recording the endpoint's tags
+// and host routes.
+func (nb *BridgeBuilder) generateHNSEndpointMetadata(ep *Endpoint) map[string]string {
+	if ep.CNINetworkName == "" && len(ep.HostRoutes) == 0 {
+		return nil
+	}
+
+	metadata := make(map[string]string)
+	if ep.CNINetworkName != "" {
+		metadata[hnsEndpointCNINetworkKey] = ep.CNINetworkName
+	}
+	if len(ep.HostRoutes) != 0 {
+		var destinations []string
+		for _, destination := range ep.HostRoutes {
+			destinations = append(destinations, destination.String())
+		}
+		metadata[hnsEndpointHostRoutesKey] = strings.Join(destinations, ",")
+	}
+
+	return metadata
+}
+
+// readEndpointTags sets the endpoint's tags from the metadata of an existing HNS endpoint.
+func (nb *BridgeBuilder) readEndpointTags(ep *Endpoint, hnsEndpoint *hcsshim.HNSEndpoint) {
+	metadata, err := nb.client().GetHNSEndpointMetadata(hnsEndpoint.Id)
+	if err != nil {
+		// The endpoint metadata is informational.
+		log.Errorf("Failed to read HNS endpoint metadata, ignoring: %v.", err)
+		return
+	}
+
+	ep.CNINetworkName = metadata[hnsEndpointCNINetworkKey]
+}
+
+// getHNSEndpointIPAddresses returns the IP addresses of an HNS endpoint. HNS V1 endpoints have
+// at most one IP address, and none while HNS has not assigned it yet.
+func (nb *BridgeBuilder) getHNSEndpointIPAddresses(hnsEndpoint *hcsshim.HNSEndpoint) []net.IP {
+	if hnsEndpoint.IPAddress == nil {
+		return nil
+	}
+
+	return []net.IP{hnsEndpoint.IPAddress}
+}
+
+// validateHNSNetworkResponse returns whether an HNS network response describes the network requested.
+func (nb *BridgeBuilder) validateHNSNetworkResponse(hnsResponse *hcsshim.HNSNetwork, networkName string) error {
+	if hnsResponse == nil {
+		return fmt.Errorf("HNS returned an empty response for network %s", networkName)
+	}
+
+	if hnsResponse.Id == "" {
+		return fmt.Errorf("HNS returned no ID for network %s", networkName)
+	}
+
+	if hnsResponse.Name != networkName {
+		return fmt.Errorf("HNS returned network name %q for network %s", hnsResponse.Name, networkName)
+	}
 
-	if !supported {
-		return fmt.Errorf("HNS is older than the minimum supported version %v", hnsMinVersion)
+	return nil
+}
+
+// validateHNSEndpointResponse returns whether an HNS endpoint response has the requested IP
+// address. Responses without an IP address are accepted.
+func (nb *BridgeBuilder) validateHNSEndpointResponse(hnsResponse *hcsshim.HNSEndpoint, ep *Endpoint) error {
+	if hnsResponse.IPAddress != nil && !hnsResponse.IPAddress.Equal(ep.IPAddresses[0].IP) {
+		return fmt.Errorf("HNS endpoint %s has IP address %s, requested %s",
+			hnsResponse.Id, hnsResponse.IPAddress, ep.IPAddresses[0].IP)
 	}
 
 	return nil
 }
 
+// parseHNSEndpointMAC returns the MAC address of an HNS endpoint. An invalid MAC address is an
+// error, unless the network ignores them, in which case a nil MAC address is returned.
+func (nb *BridgeBuilder) parseHNSEndpointMAC(
+	nw *Network, hnsEndpoint *hcsshim.HNSEndpoint) (net.HardwareAddr, error) {
+	macAddress, err := net.ParseMAC(hnsEndpoint.MacAddress)
+	if err == nil {
+		return macAddress, nil
+	}
+
+	macErr := &ErrEndpointMACInvalid{
+		EndpointName: hnsEndpoint.Name,
+		MACAddress:   hnsEndpoint.MacAddress,
+	}
+	if nw.IgnoreInvalidEndpointMAC {
+		log.Warnf("Ignoring invalid MAC address: %v.", macErr)
+		return nil, nil
+	}
+
+	log.Errorf("Received invalid HNS endpoint MAC address: %v.", macErr)
+	return nil, macErr
+}
+
+// getHNSNetworkType returns the type of the HNS network for the network.
+func (nb *BridgeBuilder) getHNSNetworkType(nw *Network) string {
+	if nw.TransparentMode {
+		return hnsTransparent
+	}
+
+	return hnsL2Bridge
+}
+
 // generateHNSNetworkName generates a deterministic unique name for an HNS network.
 func (nb *BridgeBuilder) generateHNSNetworkName(nw *Network) string {
 	// Use the MAC address of the shared ENI as the deterministic unique identifier.
 	id := strings.Replace(nw.SharedENI.GetMACAddress().String(), ":", "", -1)
+	if nw.NetworkNameDiscriminator != "" {
+		return fmt.Sprintf(hnsNetworkNameDiscriminatorFormat, nw.Name, id, nw.NetworkNameDiscriminator)
+	}
+
 	return fmt.Sprintf(hnsNetworkNameFormat, nw.Name, id)
 }
 
+// generateHNSEndpointFriendlyName generates the name displayed for the endpoint's interface on the
+// host, e.g. by ipconfig. Characters other than letters, digits, '-', '_' and '.' are replaced.
+func (nb *BridgeBuilder) generateHNSEndpointFriendlyName(ep *Endpoint) string {
+	name := ep.FriendlyName
+	if name == "" {
+		name = ep.ContainerID
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+			r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '-'
+	}, name)
+
+	if len(name) > hnsFriendlyNameMaxLength {
+		name = name[:hnsFriendlyNameMaxLength]
+	}
+
+	return name
+}
+
 // generateHNSEndpointName generates a deterministic unique name for an HNS endpoint.
 func (nb *BridgeBuilder) generateHNSEndpointName(ep *Endpoint, id string) string {
-	// Use the given optional identifier or the container ID itself as the unique identifier.
-	if id == "" {
+	// Use the endpoint key, the given optional identifier or the container ID itself as the
+	// unique identifier. The endpoint key is stable across container restarts.
+	if ep.Key != "" {
+		id = ep.Key
+	} else if id == "" {
 		id = ep.ContainerID
 	}
 
-	return fmt.Sprintf(hnsEndpointNameFormat, id)
+	return nb.truncateHNSEndpointName(fmt.Sprintf(hnsEndpointNameFormat, id))
+}
+
+// generateEndpointCallKey generates the key identifying duplicate FindOrCreateEndpoint calls.
+// Calls are duplicates if they are for the same network, endpoint key, namespace and container.
+func (nb *BridgeBuilder) generateEndpointCallKey(nw *Network, ep *Endpoint) string {
+	return strings.Join(
+		[]string{nb.generateHNSNetworkName(nw), ep.Key, ep.NetNSName, ep.ContainerID}, "/")
+}
+
+// truncateHNSEndpointName truncates HNS endpoint names longer than the maximum length. The name
+// is cut short and suffixed with the hash of the full name, so that it remains deterministic and
+// unique, and keeps the prefix identifying endpoints created by this plugin.
+func (nb *BridgeBuilder) truncateHNSEndpointName(name string) string {
+	maxLength := nb.config().MaxEndpointNameLength
+	if len(name) <= maxLength {
+		return name
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	suffix := fmt.Sprintf("-%016x", hash.Sum64())
+
+	return name[:maxLength-len(suffix)] + suffix
 }
@@ -0,0 +1,4444 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build !integration_test && !e2e_test
+// +build !integration_test,!e2e_test
+
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
+	"github.com/aws/amazon-vpc-cni-plugins/version"
+
+	"github.com/Microsoft/hcsshim"
+	log "github.com/cihub/seelog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestNetwork returns a network on a shared ENI with a /24 subnet.
+func newTestNetwork(t *testing.T) *Network {
+	mac, _ := net.ParseMAC("12:34:56:78:9a:bc")
+	sharedENI, err := eni.NewENI("Ethernet 2", mac)
+	require.NoError(t, err)
+
+	return &Network{
+		Name:      "vpc",
+		SharedENI: sharedENI,
+		ENIIPAddresses: []net.IPNet{
+			{IP: net.ParseIP("10.0.1.10"), Mask: net.CIDRMask(24, 32)},
+		},
+		GatewayIPAddress: net.ParseIP("10.0.1.1"),
+	}
+}
+
+// newTestEndpoint returns an infra container endpoint with the given IPv4 address.
+func newTestEndpoint(containerID string, ip string) *Endpoint {
+	return &Endpoint{
+		ContainerID: containerID,
+		IPAddresses: []net.IPNet{
+			{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(24, 32)},
+		},
+	}
+}
+
+// newTestIPDiscoverer returns an ENI IP address discoverer with the given secondary IP addresses.
+func newTestIPDiscoverer(ipAddresses ...string) *mockIPDiscoverer {
+	discoverer := &mockIPDiscoverer{}
+	for _, ipAddress := range ipAddresses {
+		discoverer.ipAddresses = append(discoverer.ipAddresses, net.ParseIP(ipAddress))
+	}
+	return discoverer
+}
+
+// getRoutePolicies returns the destination prefixes of the route policies on an HNS endpoint.
+func getRoutePolicies(t *testing.T, hnsEndpoint *hcsshim.HNSEndpoint) []string {
+	var destinations []string
+	for _, buf := range hnsEndpoint.Policies {
+		var policy hnsRoutePolicy
+		require.NoError(t, json.Unmarshal(buf, &policy))
+		if policy.Type == hcsshim.Route {
+			destinations = append(destinations, policy.DestinationPrefix)
+		}
+	}
+	return destinations
+}
+
+// getSNATPolicy returns the outbound NAT policy on an HNS endpoint.
+func getSNATPolicy(t *testing.T, hnsEndpoint *hcsshim.HNSEndpoint) *hcsshim.OutboundNatPolicy {
+	for _, buf := range hnsEndpoint.Policies {
+		var policy hcsshim.OutboundNatPolicy
+		require.NoError(t, json.Unmarshal(buf, &policy))
+		if policy.Type == hcsshim.OutboundNat {
+			return &policy
+		}
+	}
+	require.Fail(t, "endpoint has no outbound NAT policy")
+	return nil
+}
+
+// getSNATExceptions returns the exceptions of the outbound NAT policy on an HNS endpoint.
+func getSNATExceptions(t *testing.T, hnsEndpoint *hcsshim.HNSEndpoint) []string {
+	return getSNATPolicy(t, hnsEndpoint).Exceptions
+}
+
+// hasSNATPolicy returns whether an HNS endpoint has an outbound NAT policy.
+func hasSNATPolicy(t *testing.T, hnsEndpoint *hcsshim.HNSEndpoint) bool {
+	for _, buf := range hnsEndpoint.Policies {
+		var policy hcsshim.Policy
+		require.NoError(t, json.Unmarshal(buf, &policy))
+		if policy.Type == hcsshim.OutboundNat {
+			return true
+		}
+	}
+	return false
+}
+
+// getACLPolicies returns the ACL policies on an HNS endpoint.
+func getACLPolicies(t *testing.T, hnsEndpoint *hcsshim.HNSEndpoint) []hcsshim.ACLPolicy {
+	var policies []hcsshim.ACLPolicy
+	for _, buf := range hnsEndpoint.Policies {
+		var policy hcsshim.ACLPolicy
+		require.NoError(t, json.Unmarshal(buf, &policy))
+		if policy.Type == hcsshim.ACL {
+			policies = append(policies, policy)
+		}
+	}
+	return policies
+}
+
+func TestStatusReady(t *testing.T) {
+	nb := &BridgeBuilder{hns: newMockHNS()}
+
+	assert.NoError(t, nb.Status())
+}
+
+func TestStatusNotReady(t *testing.T) {
+	hns := newMockHNS()
+	hns.version = hcsshim.HNSVersion{Major: 6, Minor: 0}
+	nb := &BridgeBuilder{hns: hns}
+
+	err := nb.Status()
+	var versionErr *ErrHNSVersionUnsupported
+	require.True(t, errors.As(err, &versionErr))
+	assert.Equal(t, hcsshim.HNSVersion{Major: 6, Minor: 0}, versionErr.Version)
+	assert.Equal(t, hcsshim.HNSVersion1803, versionErr.MinVersion)
+	assert.Contains(t, err.Error(), "upgrade Windows")
+
+	hns.globalsErr = errors.New("HNS is not running")
+	nb.HNSGlobalsTimeout = time.Millisecond
+
+	assert.Error(t, nb.Status())
+}
+
+func TestStatusRetriesTransientFailures(t *testing.T) {
+	hns := newMockHNS()
+	hns.globalsFailures = 2
+	nb := &BridgeBuilder{hns: hns}
+
+	assert.NoError(t, nb.Status())
+	assert.Equal(t, 0, hns.globalsFailures)
+
+	// Unsupported versions are reported once HNS responds.
+	hns.globalsFailures = 1
+	hns.version = hcsshim.HNSVersion{Major: 6, Minor: 0}
+	var versionErr *ErrHNSVersionUnsupported
+	assert.True(t, errors.As(nb.Status(), &versionErr))
+}
+
+func TestInfo(t *testing.T) {
+	savedVersion := version.Version
+	defer func() { version.Version = savedVersion }()
+	version.Version = "1.2.3"
+
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+
+	info, err := nb.Info()
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3", info.PluginVersion)
+	assert.Equal(t, hcsshim.HNSVersion1803, info.HNSVersion)
+	assert.Equal(t, hnsNetworkVersion, info.HNSNetworkVersion)
+	assert.Equal(t, []string{FeatureACLPolicies}, info.Capabilities)
+
+	// Newer versions of HNS support more features.
+	hns.version = hcsshim.HNSVersion{Major: 13, Minor: 2}
+	info, err = nb.Info()
+	require.NoError(t, err)
+	assert.Equal(t, hcsshim.HNSVersion{Major: 13, Minor: 2}, info.HNSVersion)
+	assert.Equal(t, []string{FeatureACLPolicies, FeatureHCNNamespaces}, info.Capabilities)
+
+	// Features disabled by the feature gates are not reported.
+	nb.FeatureGates = map[string]bool{FeatureACLPolicies: false, "unknown": true}
+	info, err = nb.Info()
+	require.NoError(t, err)
+	assert.Equal(t, []string{FeatureHCNNamespaces}, info.Capabilities)
+	nb.FeatureGates = map[string]bool{FeatureHCNNamespaces: false}
+	info, err = nb.Info()
+	require.NoError(t, err)
+	assert.Equal(t, []string{FeatureACLPolicies}, info.Capabilities)
+	nb.FeatureGates = nil
+
+	hns.version = hcsshim.HNSVersion{Major: 6, Minor: 0}
+	info, err = nb.Info()
+	require.NoError(t, err)
+	assert.Empty(t, info.Capabilities)
+
+	hns.globalsErr = errors.New("HNS is not running")
+	_, err = nb.Info()
+	assert.Error(t, err)
+}
+
+func TestFindOrCreateEndpointFeatureDisabled(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	nb := &BridgeBuilder{
+		Config: Config{FeatureGates: map[string]bool{
+			FeatureACLPolicies:   false,
+			FeatureHCNNamespaces: false,
+		}},
+		hns: hns,
+	}
+	nw := newTestNetwork(t)
+	nw.DefaultDeny = true
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+	ep.EgressAllowedCIDRs = []string{"10.0.0.0/16"}
+
+	err := nb.FindOrCreateEndpoint(nw, ep)
+
+	assert.Equal(t,
+		[]string{"Endpoint.NetNSName", "Network.DefaultDeny", "Endpoint.EgressAllowedCIDRs"},
+		getValidationErrorFields(t, err))
+	assert.Empty(t, hns.endpoints)
+
+	// The features are enabled by default.
+	nb.FeatureGates = nil
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+}
+
+func TestGCRemovesUnknownEndpoints(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	networkName := nb.generateHNSNetworkName(nw)
+
+	known := hns.addEndpoint("cid-known", networkName)
+	hns.addEndpoint("cid-unknown", networkName)
+	otherNetwork := hns.addEndpoint("cid-other", "othernetwork")
+	otherPlugin := hns.addEndpoint("foreign", networkName)
+
+	err := nb.GC(nw, []string{"known"})
+	assert.NoError(t, err)
+
+	assert.Len(t, hns.endpoints, 3)
+	assert.Contains(t, hns.endpoints, known.Id)
+	assert.Contains(t, hns.endpoints, otherNetwork.Id)
+	assert.Contains(t, hns.endpoints, otherPlugin.Id)
+}
+
+func TestGCDetachesStaleEndpoints(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+
+	// The stale endpoints are still attached to their HCN namespace and infra container.
+	namespaceEp := newTestEndpoint("container1", "10.0.1.11")
+	namespaceEp.NetNSName = "ns1"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, namespaceEp))
+	containerEp := newTestEndpoint("container2", "10.0.1.12")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, containerEp))
+	require.NotEmpty(t, hns.namespaces["ns1"])
+	require.NotEmpty(t, hns.containers["container2"])
+
+	require.NoError(t, nb.GC(nw, nil))
+
+	assert.Empty(t, hns.endpoints)
+	assert.Empty(t, hns.namespaces["ns1"])
+	assert.Empty(t, hns.containers["container2"])
+}
+
+func TestGCDeletesStaleEndpointHostRoutes(t *testing.T) {
+	hns := newMockHNS()
+	routes := newMockHostRouter()
+	nb := &BridgeBuilder{hns: hns, routes: routes}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.HostRoutes = []net.IPNet{{IP: net.ParseIP("10.0.1.11").To4(), Mask: net.CIDRMask(32, 32)}}
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	require.NotEmpty(t, routes.routes)
+
+	// GC knows only the endpoint names, and deletes the host routes recorded on the endpoint.
+	require.NoError(t, nb.GC(nw, nil))
+
+	assert.Empty(t, hns.endpoints)
+	assert.Empty(t, routes.routes)
+}
+
+func TestGCWaitsForNetworkLock(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	hns.addEndpoint("cid-stale", nb.generateHNSNetworkName(nw))
+
+	// Hold the lock taken by endpoint creates in the network.
+	unlock := nb.lockNetwork(nw)
+	done := make(chan error)
+	go func() { done <- nb.GC(nw, nil) }()
+
+	select {
+	case <-done:
+		require.Fail(t, "GC did not wait for the network lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Len(t, hns.endpoints, 1)
+
+	unlock()
+	require.NoError(t, <-done)
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateEndpointAppliesNetworkPolicyTemplates(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	qosPolicy := json.RawMessage(`{"Type":"QOS","MaximumOutgoingBandwidthInBytes":1000}`)
+	aclPolicy := json.RawMessage(`{"Type":"ACL","Action":"Block","Direction":"Out","Priority":100}`)
+	nw.EndpointPolicies = []json.RawMessage{qosPolicy}
+
+	ep1 := newTestEndpoint("container1", "10.0.1.11")
+	ep2 := newTestEndpoint("container2", "10.0.1.12")
+	ep2.Policies = []json.RawMessage{aclPolicy}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep1))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep2))
+
+	hnsEndpoint1, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Contains(t, hnsEndpoint1.Policies, qosPolicy)
+	assert.NotContains(t, hnsEndpoint1.Policies, aclPolicy)
+
+	hnsEndpoint2, err := hns.GetHNSEndpointByName("cid-container2")
+	require.NoError(t, err)
+	assert.Contains(t, hnsEndpoint2.Policies, qosPolicy)
+	assert.Contains(t, hnsEndpoint2.Policies, aclPolicy)
+}
+
+func TestFindOrCreateNetwork(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Equal(t, hnsL2Bridge, hnsNetwork.Type)
+	assert.Equal(t, "Ethernet 2", hnsNetwork.NetworkAdapterName)
+	assert.Equal(t, "10.0.1.0/24", hnsNetwork.Subnets[0].AddressPrefix)
+	assert.Equal(t, "10.0.1.1", hnsNetwork.Subnets[0].GatewayAddress)
+}
+
+func TestFindOrCreateNetworkMissingResponseID(t *testing.T) {
+	hns := newMockHNS()
+	hns.networkResponse = func(nw *hcsshim.HNSNetwork) *hcsshim.HNSNetwork {
+		return &hcsshim.HNSNetwork{}
+	}
+	nb := &BridgeBuilder{hns: hns}
+
+	assert.Error(t, nb.FindOrCreateNetwork(newTestNetwork(t)))
+}
+
+func TestFindOrCreateNetworkMalformedResponseIsCleanedUp(t *testing.T) {
+	hns := newMockHNS()
+	hns.networkResponse = func(nw *hcsshim.HNSNetwork) *hcsshim.HNSNetwork {
+		return &hcsshim.HNSNetwork{Id: nw.Id}
+	}
+	nb := &BridgeBuilder{hns: hns}
+
+	assert.Error(t, nb.FindOrCreateNetwork(newTestNetwork(t)))
+	assert.Empty(t, hns.networks)
+}
+
+func TestFindOrCreateEndpointServiceAndHostRoutes(t *testing.T) {
+	yes, no := true, false
+	testCases := []struct {
+		name            string
+		addServiceRoute *bool
+		addHostRoute    *bool
+		expectedRoutes  []string
+	}{
+		{"default", nil, nil, []string{"172.20.0.0/16", "10.0.1.10/32"}},
+		{"both", &yes, &yes, []string{"172.20.0.0/16", "10.0.1.10/32"}},
+		{"service only", &yes, &no, []string{"172.20.0.0/16"}},
+		{"host only", &no, &yes, []string{"10.0.1.10/32"}},
+		{"none", &no, &no, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hns := newMockHNS()
+			nb := &BridgeBuilder{hns: hns}
+			nw := newTestNetwork(t)
+			nw.ServiceCIDR = "172.20.0.0/16"
+			nw.AddServiceRoute = tc.addServiceRoute
+			nw.AddHostRoute = tc.addHostRoute
+
+			require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+			hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedRoutes, getRoutePolicies(t, hnsEndpoint))
+		})
+	}
+}
+
+func TestFindOrCreateEndpointRouteOptionsRequireServiceCIDR(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	yes := true
+	nw.AddServiceRoute = &yes
+	nw.AddHostRoute = &yes
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Empty(t, getRoutePolicies(t, hnsEndpoint))
+}
+
+func TestFindOrCreateEndpointDisableHostRoute(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.ServiceCIDR = "172.20.0.0/16"
+	ep1 := newTestEndpoint("container1", "10.0.1.11")
+	ep1.DisableHostRoute = true
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep1))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container2", "10.0.1.12")))
+
+	// Only the endpoint suppressing the host route is affected.
+	hnsEndpoint1, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"172.20.0.0/16"}, getRoutePolicies(t, hnsEndpoint1))
+
+	hnsEndpoint2, err := hns.GetHNSEndpointByName("cid-container2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"172.20.0.0/16", "10.0.1.10/32"}, getRoutePolicies(t, hnsEndpoint2))
+}
+
+func TestFindOrCreateEndpointRoutes(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	_, destination1, _ := net.ParseCIDR("192.168.0.0/16")
+	_, destination2, _ := net.ParseCIDR("10.100.0.0/16")
+	ep1 := newTestEndpoint("container1", "10.0.1.11")
+	ep1.Routes = []Route{
+		{Destination: *destination1},
+		{Destination: *destination2, NextHop: net.ParseIP("10.0.1.254")},
+	}
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep1))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container2", "10.0.1.12")))
+
+	hnsEndpoint1, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	var nextHops []string
+	for _, buf := range hnsEndpoint1.Policies {
+		var policy hnsRoutePolicy
+		require.NoError(t, json.Unmarshal(buf, &policy))
+		if policy.Type == hcsshim.Route {
+			nextHops = append(nextHops, policy.NextHop)
+		}
+	}
+	assert.Equal(t, []string{"192.168.0.0/16", "10.100.0.0/16"}, getRoutePolicies(t, hnsEndpoint1))
+	assert.Equal(t, []string{"", "10.0.1.254"}, nextHops)
+
+	// Routes do not leak to the other endpoints in the network.
+	hnsEndpoint2, err := hns.GetHNSEndpointByName("cid-container2")
+	require.NoError(t, err)
+	assert.Empty(t, getRoutePolicies(t, hnsEndpoint2))
+}
+
+func TestFindOrCreateEndpointInvalidRoutes(t *testing.T) {
+	_, destination, _ := net.ParseCIDR("192.168.0.0/16")
+	_, serviceCIDR, _ := net.ParseCIDR("172.20.0.0/16")
+	for _, routes := range [][]Route{
+		{{Destination: net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.CIDRMask(16, 32)}}},
+		{{Destination: net.IPNet{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(64, 128)}}},
+		{{Destination: *destination}, {Destination: *destination}},
+		{{Destination: *serviceCIDR}},
+		{{Destination: *destination, NextHop: net.ParseIP("10.0.2.1")}},
+	} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.ServiceCIDR = "172.20.0.0/16"
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		ep.Routes = routes
+
+		err := nb.FindOrCreateEndpoint(nw, ep)
+
+		assert.Equal(t, []string{"Endpoint.Routes"}, getValidationErrorFields(t, err), routes)
+		assert.Empty(t, hns.endpoints)
+	}
+}
+
+func TestEventSink(t *testing.T) {
+	hns := newMockHNS()
+	sink := &recordingEventSink{}
+	nb := &BridgeBuilder{Config: Config{EventSink: sink}, hns: hns}
+	nw := newTestNetwork(t)
+	ep := newTestEndpoint("container1", "10.0.1.11")
+
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	// Finding existing networks and endpoints does not emit events.
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	require.NoError(t, nb.DeleteEndpoint(nw, ep))
+	require.NoError(t, nb.DeleteNetwork(nw))
+
+	networkName := nb.generateHNSNetworkName(nw)
+	assert.Equal(t, []string{
+		"NetworkCreated " + networkName,
+		"EndpointCreated " + networkName + " cid-container1 container1 10.0.1.11",
+		"EndpointDeleted " + networkName + " cid-container1 container1 10.0.1.11",
+		"NetworkDeleted " + networkName,
+	}, sink.events)
+}
+
+func TestEventSinkFailedCreate(t *testing.T) {
+	hns := newMockHNS()
+	hns.networkCreateErr = errors.New("HNS failure")
+	sink := &recordingEventSink{}
+	nb := &BridgeBuilder{
+		Config:   Config{EventSink: sink},
+		hns:      hns,
+		adapters: mockAdapters{{Name: "Ethernet 2"}},
+	}
+
+	assert.Error(t, nb.FindOrCreateNetwork(newTestNetwork(t)))
+	assert.Empty(t, sink.events)
+}
+
+func TestFindOrCreateNetworkManagementAdapter(t *testing.T) {
+	for _, tc := range []struct {
+		action     ManagementAdapterAction
+		management string
+		expectErr  bool
+		expectWarn bool
+	}{
+		// The shared ENI's adapter is dedicated to the network.
+		{action: ManagementAdapterRefuse, management: "Ethernet"},
+		{management: "Ethernet"},
+		// The shared ENI's adapter is the management interface, or already bound to a network.
+		{action: ManagementAdapterRefuse, management: "Ethernet 2", expectErr: true},
+		{action: ManagementAdapterRefuse, management: "vEthernet (Ethernet 2)", expectErr: true},
+		{management: "Ethernet 2", expectWarn: true},
+		{management: "vEthernet (Ethernet 2)", expectWarn: true},
+		{action: ManagementAdapterAllow, management: "Ethernet 2"},
+	} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{
+			hns: hns,
+			adapters: mockManagedAdapters{
+				mockAdapters: mockAdapters{{Name: "Ethernet"}, {Name: "Ethernet 2"}},
+				management:   tc.management,
+			},
+		}
+		nw := newTestNetwork(t)
+		nw.ManagementAdapterAction = tc.action
+
+		logs := captureLogs(t)
+		err := nb.FindOrCreateNetwork(nw)
+		log.Flush()
+
+		assert.Equal(t, tc.expectWarn, strings.Contains(logs.String(), "management adapter"), tc)
+		if tc.expectErr {
+			var managementErr *ErrManagementAdapter
+			require.True(t, errors.As(err, &managementErr), tc)
+			assert.Equal(t, "Ethernet 2", managementErr.AdapterName, tc)
+			assert.Empty(t, hns.networks, tc)
+		} else {
+			assert.NoError(t, err, tc)
+			assert.Len(t, hns.networks, 1, tc)
+		}
+	}
+}
+
+func TestFindOrCreateNetworkManagementAdapterUnknown(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns, adapters: mockAdapters{{Name: "Ethernet 2"}}}
+	nw := newTestNetwork(t)
+	nw.ManagementAdapterAction = ManagementAdapterRefuse
+
+	// Networks are created if the management interface cannot be found.
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	assert.Len(t, hns.networks, 1)
+}
+
+func TestFindOrCreateEndpointIPMismatch(t *testing.T) {
+	for _, tc := range []struct {
+		action     EndpointMismatchAction
+		expectedIP string
+		expectErr  bool
+	}{
+		{action: EndpointMismatchReuse, expectedIP: "10.0.1.11"},
+		{action: EndpointMismatchError, expectedIP: "10.0.1.11", expectErr: true},
+		{action: EndpointMismatchRecreate, expectedIP: "10.0.1.12"},
+	} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.EndpointIPMismatchAction = tc.action
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+		// The existing endpoint has the same name but a different IP address.
+		err := nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.12"))
+		if tc.expectErr {
+			var mismatchErr *ErrEndpointIPMismatch
+			require.True(t, errors.As(err, &mismatchErr), "unexpected error %v", err)
+			assert.Equal(t, "10.0.1.11", mismatchErr.IPAddress.String())
+			assert.Equal(t, "10.0.1.12", mismatchErr.RequestedIPAddress.String())
+		} else {
+			require.NoError(t, err, tc.action)
+		}
+
+		hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedIP, hnsEndpoint.IPAddress.String(), tc.action)
+		assert.Len(t, hns.endpoints, 1)
+		assert.Equal(t, []string{hnsEndpoint.Id}, hns.containers["container1"], tc.action)
+	}
+}
+
+func TestFindOrCreateEndpointIPMismatchRecreateDeletesHostRoutes(t *testing.T) {
+	hns := newMockHNS()
+	routes := newMockHostRouter()
+	nb := &BridgeBuilder{hns: hns, routes: routes}
+	nw := newTestNetwork(t)
+	nw.EndpointIPMismatchAction = EndpointMismatchRecreate
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	_, staleDestination, _ := net.ParseCIDR("192.168.10.0/24")
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.HostRoutes = []net.IPNet{*staleDestination}
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	// The host routes to the stale endpoint are deleted with it.
+	_, destination, _ := net.ParseCIDR("192.168.20.0/24")
+	ep = newTestEndpoint("container1", "10.0.1.12")
+	ep.HostRoutes = []net.IPNet{*destination}
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	assert.Equal(t, map[string]string{"192.168.20.0/24": "10.0.1.12 vEthernet (Ethernet 2)"},
+		routes.routes)
+	assert.Len(t, hns.endpoints, 1)
+}
+
+func TestFindOrCreateEndpointHostRoutes(t *testing.T) {
+	hns := newMockHNS()
+	routes := newMockHostRouter()
+	nb := &BridgeBuilder{hns: hns, routes: routes}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	_, destination, _ := net.ParseCIDR("192.168.10.0/24")
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.HostRoutes = []net.IPNet{
+		{IP: net.ParseIP("10.0.1.11").To4(), Mask: net.CIDRMask(32, 32)},
+		*destination,
+	}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	assert.Equal(t, map[string]string{
+		"10.0.1.11/32":    "10.0.1.11 vEthernet (Ethernet 2)",
+		"192.168.10.0/24": "10.0.1.11 vEthernet (Ethernet 2)",
+	}, routes.routes)
+
+	// The routes are removed with the endpoint.
+	require.NoError(t, nb.DeleteEndpoint(nw, ep))
+	assert.Empty(t, routes.routes)
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateEndpointHostRouteFailure(t *testing.T) {
+	hns := newMockHNS()
+	routes := newMockHostRouter()
+	routes.addErr = func(destination net.IPNet) error {
+		if destination.String() == "192.168.10.0/24" {
+			return errors.New("route add failed")
+		}
+		return nil
+	}
+	nb := &BridgeBuilder{hns: hns, routes: routes}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	_, destination, _ := net.ParseCIDR("192.168.10.0/24")
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.HostRoutes = []net.IPNet{
+		{IP: net.ParseIP("10.0.1.11").To4(), Mask: net.CIDRMask(32, 32)},
+		*destination,
+	}
+
+	// The routes added and the endpoint are cleaned up.
+	assert.Error(t, nb.FindOrCreateEndpoint(nw, ep))
+	assert.Empty(t, routes.routes)
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateEndpointNoRoutesWithoutServiceCIDR(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), newTestEndpoint("container1", "10.0.1.11")))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Empty(t, getRoutePolicies(t, hnsEndpoint))
+}
+
+func TestFindOrCreateEndpointReusesEndpointByKeyAcrossRestarts(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.Key = "pod-uid"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-pod-uid")
+	require.NoError(t, err)
+
+	// The restarted infra container has a new container ID but the same key.
+	restartedEp := newTestEndpoint("container2", "10.0.1.11")
+	restartedEp.Key = "pod-uid"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, restartedEp))
+
+	assert.Len(t, hns.endpoints, 1)
+	assert.Equal(t, []string{hnsEndpoint.Id}, hns.containers["container1"])
+	assert.Equal(t, []string{hnsEndpoint.Id}, hns.containers["container2"])
+	assert.Equal(t, ep.MACAddress, restartedEp.MACAddress)
+
+	// Deleting through the restarted container finds the same endpoint, and keeps it.
+	require.NoError(t, nb.DeleteEndpoint(nw, restartedEp))
+	assert.Len(t, hns.endpoints, 1)
+	assert.Empty(t, hns.containers["container2"])
+
+	// The endpoint is deleted once its key is no longer in use.
+	require.NoError(t, nb.GC(nw, nil))
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateEndpointKeyedRestart(t *testing.T) {
+	for _, netNSName := range []string{"", "ns2"} {
+		hns := newMockHNS()
+		hns.namespaces["ns1"] = nil
+		hns.namespaces["ns2"] = nil
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		ep.Key = "pod-uid"
+		if netNSName != "" {
+			ep.NetNSName = "ns1"
+		}
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+		hnsEndpoint, err := hns.GetHNSEndpointByName("cid-pod-uid")
+		require.NoError(t, err)
+
+		// Repeated calls for the same container do not attach the endpoint again.
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+		if netNSName == "" {
+			assert.Equal(t, []string{hnsEndpoint.Id}, hns.containers["container1"])
+		}
+
+		// The runtime deletes the old infra container before adding the restarted one.
+		require.NoError(t, nb.DeleteEndpoint(nw, ep))
+		assert.Equal(t, DeleteResultNone, ep.DeleteResult)
+		assert.Empty(t, hns.containers["container1"])
+		assert.Empty(t, hns.namespaces["ns1"])
+
+		restartedEp := newTestEndpoint("container2", "10.0.1.11")
+		restartedEp.Key = "pod-uid"
+		restartedEp.NetNSName = netNSName
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, restartedEp))
+
+		// The restarted container gets the same endpoint and IP address.
+		assert.Len(t, hns.endpoints, 1)
+		assert.Equal(t, ep.MACAddress, restartedEp.MACAddress)
+		if netNSName == "" {
+			assert.Equal(t, []string{hnsEndpoint.Id}, hns.containers["container2"])
+		} else {
+			assert.Equal(t, []string{hnsEndpoint.Id}, hns.namespaces["ns2"])
+		}
+	}
+}
+
+func TestFindOrCreateEndpointStaleNamespace(t *testing.T) {
+	for _, action := range []StaleNamespaceAction{StaleNamespaceRehome, StaleNamespaceError} {
+		hns := newMockHNS()
+		hns.namespaces["ns1"] = nil
+		hns.namespaces["ns2"] = nil
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.StaleNamespaceAction = action
+
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		ep.Key = "task-arn"
+		ep.NetNSName = "ns1"
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+		hnsEndpoint, err := hns.GetHNSEndpointByName("cid-task-arn")
+		require.NoError(t, err)
+
+		// The previous container's namespace was deleted without detaching the endpoint.
+		hns.deleteNamespace("ns1")
+		restartedEp := newTestEndpoint("container2", "10.0.1.11")
+		restartedEp.Key = "task-arn"
+		restartedEp.NetNSName = "ns2"
+		err = nb.FindOrCreateEndpoint(nw, restartedEp)
+
+		if action == StaleNamespaceError {
+			var mismatchErr *ErrEndpointNamespaceMismatch
+			require.True(t, errors.As(err, &mismatchErr), "%v", err)
+			assert.Equal(t, "ns1", mismatchErr.NamespaceID)
+			assert.False(t, mismatchErr.Live)
+			assert.Empty(t, hns.namespaces["ns2"])
+		} else {
+			require.NoError(t, err)
+			assert.Equal(t, []string{hnsEndpoint.Id}, hns.namespaces["ns2"])
+		}
+		assert.Len(t, hns.endpoints, 1, action)
+	}
+}
+
+func TestFindOrCreateEndpointLiveNamespace(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	hns.namespaces["ns2"] = nil
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.StaleNamespaceAction = StaleNamespaceRehome
+
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.Key = "task-arn"
+	ep.NetNSName = "ns1"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-task-arn")
+	require.NoError(t, err)
+
+	// The endpoint is not taken away from a namespace that is still in use.
+	otherEp := newTestEndpoint("container2", "10.0.1.11")
+	otherEp.Key = "task-arn"
+	otherEp.NetNSName = "ns2"
+	err = nb.FindOrCreateEndpoint(nw, otherEp)
+
+	var mismatchErr *ErrEndpointNamespaceMismatch
+	require.True(t, errors.As(err, &mismatchErr), "%v", err)
+	assert.True(t, mismatchErr.Live)
+	assert.Equal(t, []string{hnsEndpoint.Id}, hns.namespaces["ns1"])
+	assert.Empty(t, hns.namespaces["ns2"])
+
+	// Reattaching to the same namespace is not a mismatch.
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	assert.Equal(t, []string{hnsEndpoint.Id}, hns.namespaces["ns1"])
+}
+
+func TestFindOrCreateEndpointLongKey(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	key := "arn:aws:ecs:us-west-2:123456789012:task/cluster/" + strings.Repeat("a", 300)
+
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.Key = key + "1"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	otherEp := newTestEndpoint("container2", "10.0.1.12")
+	otherEp.Key = key + "2"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, otherEp))
+
+	// The names are truncated, and remain unique.
+	require.Len(t, hns.endpoints, 2)
+	names := make(map[string]bool)
+	for _, hnsEndpoint := range hns.endpoints {
+		assert.Len(t, hnsEndpoint.Name, hnsEndpointNameMaxLength)
+		assert.True(t, strings.HasPrefix(hnsEndpoint.Name, "cid-arn:aws:ecs:"))
+		names[hnsEndpoint.Name] = true
+	}
+	assert.Len(t, names, 2)
+
+	// The same names are generated to find and delete the endpoints.
+	restartedEp := newTestEndpoint("container3", "10.0.1.11")
+	restartedEp.Key = key + "1"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, restartedEp))
+	assert.Len(t, hns.endpoints, 2)
+	require.NoError(t, nb.DeleteEndpoint(nw, restartedEp))
+	require.NoError(t, nb.GC(nw, []string{otherEp.Key}))
+	assert.Len(t, hns.endpoints, 1)
+}
+
+func TestGenerateHNSEndpointNameMaxLength(t *testing.T) {
+	for _, tc := range []struct {
+		maxLength int
+		expected  int
+	}{
+		{maxLength: 0, expected: hnsEndpointNameMaxLength},
+		{maxLength: 64, expected: 64},
+		{maxLength: 8, expected: hnsEndpointNameMinLength},
+	} {
+		nb := NewBridgeBuilder(Config{MaxEndpointNameLength: tc.maxLength})
+		ep := &Endpoint{Key: strings.Repeat("k", 500)}
+
+		name := nb.generateHNSEndpointName(ep, "")
+
+		assert.Len(t, name, tc.expected, tc)
+		assert.Equal(t, name, nb.generateHNSEndpointName(ep, ""), tc)
+	}
+
+	// Names within the limit are unchanged.
+	nb := NewBridgeBuilder(Config{MaxEndpointNameLength: 64})
+	assert.Equal(t, "cid-pod-uid", nb.generateHNSEndpointName(&Endpoint{Key: "pod-uid"}, ""))
+}
+
+func TestFindOrCreateEndpointWithoutKeyCreatesNewEndpointOnRestart(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container2", "10.0.1.11")))
+
+	assert.Len(t, hns.endpoints, 2)
+}
+
+func TestFindOrCreateEndpointRemoteEndpoint(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.IsRemoteEndpoint = true
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container2", "10.0.1.12")))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.True(t, hnsEndpoint.IsRemoteEndpoint)
+
+	hnsEndpoint, err = hns.GetHNSEndpointByName("cid-container2")
+	require.NoError(t, err)
+	assert.False(t, hnsEndpoint.IsRemoteEndpoint)
+}
+
+func TestFindOrCreateNetworkWritesVersion(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Equal(t, hnsNetworkVersion, hns.metadata[hnsNetwork.Id][hnsNetworkVersionKey])
+}
+
+func TestFindOrCreateNetworkMatchingVersion(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.VersionMismatchAction = NetworkMismatchRecreate
+	existing := hns.addNetwork(nb.generateHNSNetworkName(nw),
+		map[string]string{hnsNetworkVersionKey: hnsNetworkVersion})
+
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	hnsNetwork, err := hns.GetHNSNetworkByName(existing.Name)
+	require.NoError(t, err)
+	assert.Equal(t, existing.Id, hnsNetwork.Id)
+}
+
+func TestFindOrCreateNetworkMismatchedVersion(t *testing.T) {
+	testCases := []struct {
+		name         string
+		action       NetworkMismatchAction
+		hasEndpoints bool
+		recreated    bool
+	}{
+		{"warn", NetworkMismatchWarn, false, false},
+		{"recreate", NetworkMismatchRecreate, false, true},
+		{"recreate in use", NetworkMismatchRecreate, true, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hns := newMockHNS()
+			nb := &BridgeBuilder{hns: hns}
+			nw := newTestNetwork(t)
+			nw.VersionMismatchAction = tc.action
+			existing := hns.addNetwork(nb.generateHNSNetworkName(nw),
+				map[string]string{hnsNetworkVersionKey: "0"})
+			if tc.hasEndpoints {
+				hns.addEndpoint("cid-container1", existing.Name)
+			}
+
+			require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+			hnsNetwork, err := hns.GetHNSNetworkByName(existing.Name)
+			require.NoError(t, err)
+			assert.Equal(t, tc.recreated, hnsNetwork.Id != existing.Id)
+			if tc.recreated {
+				assert.Equal(t, hnsNetworkVersion, hns.metadata[hnsNetwork.Id][hnsNetworkVersionKey])
+			}
+		})
+	}
+}
+
+func TestFindOrCreateNetworkWithoutVersion(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.VersionMismatchAction = NetworkMismatchRecreate
+	existing := hns.addNetwork(nb.generateHNSNetworkName(nw), nil)
+
+	// Networks created before network versioning are kept, without a warning on every call.
+	logs := captureLogs(t)
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	log.Flush()
+
+	hnsNetwork, err := hns.GetHNSNetworkByName(existing.Name)
+	require.NoError(t, err)
+	assert.Equal(t, existing.Id, hnsNetwork.Id)
+	assert.NotContains(t, logs.String(), "expected version")
+}
+
+func TestFindOrCreateNetworkMismatchedSubnet(t *testing.T) {
+	testCases := []struct {
+		name         string
+		action       NetworkMismatchAction
+		hasEndpoints bool
+		recreated    bool
+	}{
+		{"warn", NetworkMismatchWarn, false, false},
+		{"recreate", NetworkMismatchRecreate, false, true},
+		{"recreate in use", NetworkMismatchRecreate, true, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hns := newMockHNS()
+			nb := &BridgeBuilder{hns: hns}
+			require.NoError(t, nb.FindOrCreateNetwork(newTestNetwork(t)))
+			existing, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(newTestNetwork(t)))
+			require.NoError(t, err)
+			if tc.hasEndpoints {
+				hns.addEndpoint("cid-container1", existing.Name)
+			}
+
+			// The ENI was reattached with an IP address in another subnet.
+			nw := newTestNetwork(t)
+			nw.ENIIPAddresses[0].IP = net.ParseIP("10.0.2.10")
+			nw.GatewayIPAddress = net.ParseIP("10.0.2.1")
+			nw.SubnetMismatchAction = tc.action
+			require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+			hnsNetwork, err := hns.GetHNSNetworkByName(existing.Name)
+			require.NoError(t, err)
+			assert.Equal(t, tc.recreated, hnsNetwork.Id != existing.Id)
+			if tc.recreated {
+				assert.Equal(t, "10.0.2.0/24", hnsNetwork.Subnets[0].AddressPrefix)
+				assert.Equal(t, "10.0.2.1", hnsNetwork.Subnets[0].GatewayAddress)
+			} else {
+				assert.Equal(t, "10.0.1.0/24", hnsNetwork.Subnets[0].AddressPrefix)
+			}
+		})
+	}
+}
+
+func TestFindOrCreateNetworkMetadataUnreadable(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	require.NoError(t, nb.FindOrCreateNetwork(newTestNetwork(t)))
+	existing, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(newTestNetwork(t)))
+	require.NoError(t, err)
+	delete(hns.metadata, existing.Id)
+
+	// The existing network is still checked against the shared ENI.
+	nw := newTestNetwork(t)
+	nw.ENIIPAddresses[0].IP = net.ParseIP("10.0.2.10")
+	nw.GatewayIPAddress = net.ParseIP("10.0.2.1")
+	nw.SubnetMismatchAction = NetworkMismatchRecreate
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	hnsNetwork, err := hns.GetHNSNetworkByName(existing.Name)
+	require.NoError(t, err)
+	assert.NotEqual(t, existing.Id, hnsNetwork.Id)
+	assert.Equal(t, "10.0.2.0/24", hnsNetwork.Subnets[0].AddressPrefix)
+}
+
+func TestFindOrCreateEndpointDefaultDeny(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DNSServers = []string{"10.0.0.2"}
+	nw.DefaultDeny = true
+	nw.ACLAllowRules = []ACLRule{
+		{Direction: ACLDirectionOut, Protocol: 6, RemoteAddresses: "10.1.0.0/16", RemotePorts: "443"},
+		{Direction: ACLDirectionIn, RemoteAddresses: "10.2.0.0/16"},
+	}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	policies := getACLPolicies(t, hnsEndpoint)
+
+	var essential, allow, deny []hcsshim.ACLPolicy
+	for _, policy := range policies {
+		switch {
+		case policy.Action == hcsshim.Block:
+			deny = append(deny, policy)
+		case policy.Priority == hnsACLPriorityAllow:
+			allow = append(allow, policy)
+		default:
+			essential = append(essential, policy)
+		}
+	}
+
+	// Gateway in both directions, and DNS over UDP and TCP.
+	require.Len(t, essential, 4)
+	for _, policy := range essential {
+		assert.Equal(t, uint16(hnsACLPriorityEssential), policy.Priority)
+	}
+	assert.Equal(t, "10.0.1.1", essential[0].RemoteAddresses)
+	assert.Equal(t, "10.0.0.2", essential[2].RemoteAddresses)
+	assert.Equal(t, dnsPort, essential[2].RemotePorts)
+
+	require.Len(t, allow, 2)
+	assert.Equal(t, hcsshim.Out, allow[0].Direction)
+	assert.Equal(t, uint16(6), allow[0].Protocol)
+	assert.Equal(t, "10.1.0.0/16", allow[0].RemoteAddresses)
+	assert.Equal(t, "443", allow[0].RemotePorts)
+	assert.Equal(t, hcsshim.In, allow[1].Direction)
+	assert.Equal(t, uint16(hnsACLPolicyAllProtocols), allow[1].Protocol)
+
+	require.Len(t, deny, 2)
+	for _, policy := range deny {
+		assert.Equal(t, uint16(hnsACLPriorityDefaultDeny), policy.Priority)
+		assert.Empty(t, policy.RemoteAddresses)
+		assert.True(t, policy.Priority > allow[0].Priority)
+	}
+}
+
+func TestFindOrCreateEndpointACLPriorities(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DNSServers = []string{"10.0.0.2"}
+	nw.DefaultDeny = true
+	nw.ACLAllowRules = []ACLRule{
+		{Direction: ACLDirectionOut, RemoteAddresses: "10.3.0.0/16", Priority: 300},
+		{Direction: ACLDirectionOut, RemoteAddresses: "10.2.0.0/16"},
+		{Direction: ACLDirectionOut, RemoteAddresses: "10.1.0.0/16", Priority: 50},
+	}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+
+	// The policies are listed in evaluation order.
+	var priorities []uint16
+	var remoteAddresses []string
+	for _, policy := range getACLPolicies(t, hnsEndpoint) {
+		priorities = append(priorities, policy.Priority)
+		remoteAddresses = append(remoteAddresses, policy.RemoteAddresses)
+	}
+	assert.Equal(t, []uint16{50, 100, 100, 100, 100, 200, 300, 1000, 1000}, priorities)
+	assert.Equal(t, []string{"10.1.0.0/16", "10.0.1.1", "10.0.1.1", "10.0.0.2", "10.0.0.2",
+		"10.2.0.0/16", "10.3.0.0/16", "", ""}, remoteAddresses)
+}
+
+func TestFindOrCreateEndpointEgressAllowedCIDRs(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DNSServers = []string{"10.0.0.2"}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.EgressAllowedCIDRs = []string{"10.1.0.0/16", "192.168.0.0/24"}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+
+	// Only the egress traffic is restricted, with the gateway and DNS servers allowed.
+	var priorities []uint16
+	var remoteAddresses []string
+	for _, policy := range getACLPolicies(t, hnsEndpoint) {
+		assert.Equal(t, hcsshim.Out, policy.Direction)
+		priorities = append(priorities, policy.Priority)
+		remoteAddresses = append(remoteAddresses, policy.RemoteAddresses)
+	}
+	assert.Equal(t, []uint16{100, 100, 100, 200, 200, 1000}, priorities)
+	assert.Equal(t, []string{"10.0.1.1", "10.0.0.2", "10.0.0.2",
+		"10.1.0.0/16", "192.168.0.0/24", ""}, remoteAddresses)
+}
+
+func TestFindOrCreateEndpointEgressAllowedCIDRsDefaultDeny(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DefaultDeny = true
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.EgressAllowedCIDRs = []string{"10.1.0.0/16"}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+
+	// The essential and default-deny rules are not duplicated.
+	var priorities []uint16
+	var remoteAddresses []string
+	for _, policy := range getACLPolicies(t, hnsEndpoint) {
+		priorities = append(priorities, policy.Priority)
+		remoteAddresses = append(remoteAddresses, policy.RemoteAddresses)
+	}
+	assert.Equal(t, []uint16{100, 100, 200, 1000, 1000}, priorities)
+	assert.Equal(t, []string{"10.0.1.1", "10.0.1.1", "10.1.0.0/16", "", ""}, remoteAddresses)
+}
+
+func TestFindOrCreateEndpointInvalidEgressAllowedCIDRs(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.EgressAllowedCIDRs = []string{"10.1.0.0"}
+
+	err := nb.FindOrCreateEndpoint(newTestNetwork(t), ep)
+
+	assert.Equal(t, []string{"Endpoint.EgressAllowedCIDRs"}, getValidationErrorFields(t, err))
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateEndpointACLPriorityAfterDefaultDeny(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DefaultDeny = true
+	nw.ACLAllowRules = []ACLRule{
+		{Direction: ACLDirectionOut, RemoteAddresses: "10.1.0.0/16", Priority: 1000},
+	}
+
+	err := nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11"))
+
+	assert.Equal(t, []string{"Network.ACLAllowRules"}, getValidationErrorFields(t, err))
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateEndpointPolicyOrder(t *testing.T) {
+	qosPolicy := json.RawMessage(`{"Type":"QOS","MaximumOutgoingBandwidthInBytes":1000}`)
+	aclPolicy := json.RawMessage(`{"Type":"ACL","Action":"Block","Direction":"Out","Priority":100}`)
+	for _, order := range []PolicyOrder{PolicyOrderGeneratedFirst, PolicyOrderUserFirst} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.PolicyOrder = order
+		nw.EndpointPolicies = []json.RawMessage{qosPolicy}
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		ep.Policies = []json.RawMessage{aclPolicy}
+
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+		hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+		require.NoError(t, err)
+		policies := hnsEndpoint.Policies
+		require.Len(t, policies, 3, order)
+		// The generated SNAT policy is listed before or after the user policies.
+		if order == PolicyOrderUserFirst {
+			assert.Equal(t, []json.RawMessage{qosPolicy, aclPolicy}, policies[:2])
+			getSNATPolicy(t, &hcsshim.HNSEndpoint{Policies: policies[2:]})
+		} else {
+			getSNATPolicy(t, &hcsshim.HNSEndpoint{Policies: policies[:1]})
+			assert.Equal(t, []json.RawMessage{qosPolicy, aclPolicy}, policies[1:])
+		}
+	}
+}
+
+func TestFindOrCreateEndpointNoACLsByDefault(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), newTestEndpoint("container1", "10.0.1.11")))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Empty(t, getACLPolicies(t, hnsEndpoint))
+}
+
+func TestFindOrCreateEndpointExtraFields(t *testing.T) {
+	hns := newMockHNS()
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: hns, endpointRequest: &request}}
+
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.ExtraEndpointFields = map[string]interface{}{
+		"EncapOverhead": 50,
+		"Flags":         map[string]interface{}{"Enabled": true},
+	}
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), ep))
+
+	assert.Equal(t, float64(50), request["EncapOverhead"])
+	assert.Equal(t, map[string]interface{}{"Enabled": true}, request["Flags"])
+	assert.Equal(t, "cid-container1", request["Name"])
+}
+
+func TestFindOrCreateEndpointExtraFieldsCannotOverrideFields(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.ExtraEndpointFields = map[string]interface{}{"ipaddress": "10.0.1.99"}
+
+	assert.Error(t, nb.FindOrCreateEndpoint(newTestNetwork(t), ep))
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestAttachExistingEndpoint(t *testing.T) {
+	const namespaceID = "5f0b0ed7-a66f-4b4e-9d8c-2a1b3c4d5e6f"
+	hns := newMockHNS()
+	hns.namespaces[namespaceID] = nil
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+
+	// HCN namespace IDs are attached using HNS V2 APIs.
+	require.NoError(t, nb.AttachExistingEndpoint(hnsEndpoint.Id, namespaceID))
+	assert.Equal(t, []string{hnsEndpoint.Id}, hns.namespaces[namespaceID])
+
+	// Attaching again is a no-op.
+	require.NoError(t, nb.AttachExistingEndpoint(hnsEndpoint.Id, namespaceID))
+	assert.Equal(t, []string{hnsEndpoint.Id}, hns.namespaces[namespaceID])
+
+	// Container IDs are attached using HNS V1 APIs.
+	require.NoError(t, nb.AttachExistingEndpoint(hnsEndpoint.Id, "container2"))
+	assert.Equal(t, []string{hnsEndpoint.Id}, hns.containers["container2"])
+
+	// No endpoint is created.
+	assert.Len(t, hns.endpoints, 1)
+}
+
+func TestAttachExistingEndpointNotFound(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+
+	assert.Error(t, nb.AttachExistingEndpoint("id-99", "container1"))
+	assert.Empty(t, hns.containers["container1"])
+}
+
+// newTestNetworkPair returns two networks created on different shared ENIs in the same subnet.
+func newTestNetworkPair(t *testing.T, nb *BridgeBuilder) (*Network, *Network) {
+	fromNw := newTestNetwork(t)
+	toNw := newTestNetwork(t)
+	mac, _ := net.ParseMAC("12:34:56:78:9a:bd")
+	var err error
+	toNw.SharedENI, err = eni.NewENI("Ethernet 3", mac)
+	require.NoError(t, err)
+
+	require.NoError(t, nb.FindOrCreateNetwork(fromNw))
+	require.NoError(t, nb.FindOrCreateNetwork(toNw))
+	return fromNw, toNw
+}
+
+func TestMoveEndpoint(t *testing.T) {
+	hns := newMockHNS()
+	routes := newMockHostRouter()
+	nb := &BridgeBuilder{hns: hns, routes: routes}
+	fromNw, toNw := newTestNetworkPair(t, nb)
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.HostRoutes = []net.IPNet{{IP: net.ParseIP("10.0.1.11").To4(), Mask: net.CIDRMask(32, 32)}}
+	require.NoError(t, nb.FindOrCreateEndpoint(fromNw, ep))
+
+	require.NoError(t, nb.MoveEndpoint(ep, fromNw, toNw))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Equal(t, nb.generateHNSNetworkName(toNw), hnsEndpoint.VirtualNetworkName)
+	assert.Equal(t, "10.0.1.11", hnsEndpoint.IPAddress.String())
+	assert.Len(t, hns.endpoints, 1)
+
+	// The host routes follow the endpoint to the host vNIC of the destination network.
+	assert.Equal(t, map[string]string{"10.0.1.11/32": "10.0.1.11 vEthernet (Ethernet 3)"},
+		routes.routes)
+}
+
+func TestMoveEndpointRollsBackOnFailure(t *testing.T) {
+	hns := newMockHNS()
+	routes := newMockHostRouter()
+	nb := &BridgeBuilder{hns: hns, routes: routes}
+	fromNw, toNw := newTestNetworkPair(t, nb)
+	fromNw.DeleteWithLastEndpoint = true
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.HostRoutes = []net.IPNet{{IP: net.ParseIP("10.0.1.11").To4(), Mask: net.CIDRMask(32, 32)}}
+	require.NoError(t, nb.FindOrCreateEndpoint(fromNw, ep))
+	fromHNSNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(fromNw))
+	require.NoError(t, err)
+
+	toNetworkName := nb.generateHNSNetworkName(toNw)
+	hns.endpointCreateErr = func(hnsEndpoint *hcsshim.HNSEndpoint) error {
+		if hnsEndpoint.VirtualNetworkName == toNetworkName {
+			return errors.New("failed to create endpoint")
+		}
+		return nil
+	}
+
+	assert.Error(t, nb.MoveEndpoint(ep, fromNw, toNw))
+
+	// The source network is kept for the rollback, although the endpoint was its last.
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(fromNw))
+	require.NoError(t, err)
+	assert.Equal(t, fromHNSNetwork.Id, hnsNetwork.Id)
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Equal(t, nb.generateHNSNetworkName(fromNw), hnsEndpoint.VirtualNetworkName)
+	assert.Equal(t, "10.0.1.11", hnsEndpoint.IPAddress.String())
+	assert.Equal(t, map[string]string{"10.0.1.11/32": "10.0.1.11 vEthernet (Ethernet 2)"},
+		routes.routes)
+}
+
+func TestMoveEndpointAppContainer(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	fromNw, toNw := newTestNetworkPair(t, nb)
+	require.NoError(t, nb.FindOrCreateEndpoint(fromNw, newTestEndpoint("container1", "10.0.1.11")))
+	ep := newTestEndpoint("container2", "10.0.1.11")
+	ep.NetNSName = "container:container1"
+
+	assert.Error(t, nb.MoveEndpoint(ep, fromNw, toNw))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Equal(t, nb.generateHNSNetworkName(fromNw), hnsEndpoint.VirtualNetworkName)
+}
+
+func TestMoveEndpointDestinationSubnetMismatch(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	fromNw, toNw := newTestNetworkPair(t, nb)
+	toNw.ENIIPAddresses = []net.IPNet{{IP: net.ParseIP("10.0.2.10"), Mask: net.CIDRMask(24, 32)}}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(fromNw, ep))
+
+	assert.Error(t, nb.MoveEndpoint(ep, fromNw, toNw))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Equal(t, nb.generateHNSNetworkName(fromNw), hnsEndpoint.VirtualNetworkName)
+}
+
+func TestFindOrCreateEndpointMulticastSNATExceptions(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	ep := newTestEndpoint("container1", "10.0.1.11")
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.ElementsMatch(t,
+		[]string{"10.0.1.0/24", "224.0.0.0/4", "10.0.1.255/32"},
+		getSNATExceptions(t, hnsEndpoint))
+}
+
+func TestFindOrCreateEndpointMulticastSNATExceptionsDisabled(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DisableMulticastSNATExceptions = true
+	ep := newTestEndpoint("container1", "10.0.1.11")
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.1.0/24"}, getSNATExceptions(t, hnsEndpoint))
+}
+
+func TestFindOrCreateEndpointPolicyResult(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.ServiceCIDR = "10.100.0.0/16"
+	ep := newTestEndpoint("container1", "10.0.1.11")
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	// The result carries exactly the policies applied to the HNS endpoint.
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Equal(t, getSNATExceptions(t, hnsEndpoint), ep.SNATExceptions)
+	assert.Equal(t, getRoutePolicies(t, hnsEndpoint), ep.RouteDestinations)
+	assert.Contains(t, ep.SNATExceptions, "10.100.0.0/16")
+	assert.Equal(t, []string{"10.100.0.0/16", "10.0.1.10/32"}, ep.RouteDestinations)
+}
+
+func TestFindOrCreateEndpointPolicyResultRedacted(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.ServiceCIDR = "10.100.0.0/16"
+	nw.RedactEndpointPolicyResult = true
+	ep := newTestEndpoint("container1", "10.0.1.11")
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.NotEmpty(t, getSNATExceptions(t, hnsEndpoint))
+	assert.Empty(t, ep.SNATExceptions)
+	assert.Empty(t, ep.RouteDestinations)
+}
+
+func TestGetEndpointNamespaceInfraContainer(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	namespace, err := nb.GetEndpointNamespace(ep)
+	require.NoError(t, err)
+	assert.Equal(t, "container1", namespace)
+
+	// Detached endpoints are not in any namespace.
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	require.NoError(t, hns.HotDetachEndpoint("container1", hnsEndpoint.Id))
+	namespace, err = nb.GetEndpointNamespace(ep)
+	require.NoError(t, err)
+	assert.Empty(t, namespace)
+}
+
+func TestGetEndpointNamespaceHCNNamespace(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	namespace, err := nb.GetEndpointNamespace(ep)
+	require.NoError(t, err)
+	assert.Equal(t, "ns1", namespace)
+
+	// Detached endpoints are not in any namespace.
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-ns1")
+	require.NoError(t, err)
+	require.NoError(t, hns.RemoveNamespaceEndpoint("ns1", hnsEndpoint.Id))
+	namespace, err = nb.GetEndpointNamespace(ep)
+	require.NoError(t, err)
+	assert.Empty(t, namespace)
+}
+
+func TestGetEndpointNamespaceMissingEndpoint(t *testing.T) {
+	nb := &BridgeBuilder{hns: newMockHNS()}
+
+	_, err := nb.GetEndpointNamespace(newTestEndpoint("container1", "10.0.1.11"))
+	assert.Error(t, err)
+}
+
+func TestFindOrCreateNetworkIsolateSwitch(t *testing.T) {
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: newMockHNS(), networkRequest: &request}}
+	nw := newTestNetwork(t)
+	nw.IsolateSwitch = true
+
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	assert.Equal(t, true, request["IsolateSwitch"])
+}
+
+func TestFindOrCreateNetworkSharesSwitchByDefault(t *testing.T) {
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: newMockHNS(), networkRequest: &request}}
+
+	require.NoError(t, nb.FindOrCreateNetwork(newTestNetwork(t)))
+
+	assert.NotContains(t, request, "IsolateSwitch")
+}
+
+func TestFindOrCreateNetworkDisableManagementOS(t *testing.T) {
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: newMockHNS(), networkRequest: &request}}
+	nw := newTestNetwork(t)
+	nw.DisableManagementOS = true
+
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	assert.Equal(t, true, request["DisableManagementOS"])
+}
+
+func TestFindOrCreateNetworkManagementOSByDefault(t *testing.T) {
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: newMockHNS(), networkRequest: &request}}
+
+	require.NoError(t, nb.FindOrCreateNetwork(newTestNetwork(t)))
+
+	assert.NotContains(t, request, "DisableManagementOS")
+}
+
+func TestCheckEndpointIgnoresPolicyOrder(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.ServiceCIDR = "10.100.0.0/16"
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	// HNS reports the policies in a different order, with their fields in a different order.
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	var policies []json.RawMessage
+	for i := len(hnsEndpoint.Policies) - 1; i >= 0; i-- {
+		var policy map[string]interface{}
+		require.NoError(t, json.Unmarshal(hnsEndpoint.Policies[i], &policy))
+		buf, err := json.MarshalIndent(policy, "", "  ")
+		require.NoError(t, err)
+		policies = append(policies, buf)
+	}
+	hnsEndpoint.Policies = policies
+
+	assert.NoError(t, nb.CheckEndpoint(nw, ep))
+}
+
+func TestCheckEndpointPolicyOrder(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.PolicyOrder = PolicyOrderUserFirst
+	nw.EndpointPolicies = []json.RawMessage{
+		json.RawMessage(`{"Type":"QOS","MaximumOutgoingBandwidthInBytes":1000}`),
+	}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	require.NoError(t, nb.CheckEndpoint(nw, ep))
+
+	// The policies are listed in the generated-first order.
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	policies := hnsEndpoint.Policies
+	require.Len(t, policies, 2)
+	hnsEndpoint.Policies = []json.RawMessage{policies[1], policies[0]}
+	assert.Error(t, nb.CheckEndpoint(nw, ep))
+
+	// Reapplying the policies restores their order.
+	require.NoError(t, nb.ReapplyEndpointPolicies(nw, ep))
+	assert.Equal(t, 1, hns.endpointUpdates)
+	assert.Equal(t, policies, hnsEndpoint.Policies)
+	assert.NoError(t, nb.CheckEndpoint(nw, ep))
+}
+
+func TestCheckEndpointReportsMissingPolicy(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.ServiceCIDR = "10.100.0.0/16"
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	hnsEndpoint.Policies = hnsEndpoint.Policies[1:]
+
+	assert.Error(t, nb.CheckEndpoint(nw, ep))
+}
+
+func TestCheckEndpointDNS(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DNSServers = []string{"10.0.0.2", "10.0.0.3"}
+	nw.DNSSuffixSearchList = []string{"a.com", "b.com"}
+	nw.DNSSuffixMode = DNSSuffixSearchList
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+
+	// The order of the DNS servers and suffixes is ignored.
+	hnsEndpoint.DNSServerList = "10.0.0.3,10.0.0.2"
+	hnsEndpoint.DNSSuffix = "b.com,a.com"
+	assert.NoError(t, nb.CheckEndpoint(nw, ep))
+
+	hnsEndpoint.DNSServerList = "10.0.0.4"
+	var mismatchErr *ErrEndpointDNSMismatch
+	require.True(t, errors.As(nb.CheckEndpoint(nw, ep), &mismatchErr))
+	assert.Equal(t, "10.0.0.4", mismatchErr.DNSServerList)
+	assert.Equal(t, "10.0.0.2,10.0.0.3", mismatchErr.ExpectedDNSServerList)
+	assert.Equal(t, "10.0.0.4", hnsEndpoint.DNSServerList)
+}
+
+func TestCheckEndpointUpdatesDNS(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DNSServers = []string{"10.0.0.2"}
+	nw.DNSSuffixSearchList = []string{"a.com"}
+	nw.EndpointDNSMismatchAction = NetworkMismatchUpdate
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	policies := hnsEndpoint.Policies
+
+	// The desired DNS settings changed since the endpoint was created.
+	nw.DNSServers = []string{"10.0.0.3"}
+	nw.DNSSuffixSearchList = []string{"b.com"}
+	require.NoError(t, nb.CheckEndpoint(nw, ep))
+
+	assert.Equal(t, "10.0.0.3", hnsEndpoint.DNSServerList)
+	assert.Equal(t, "b.com", hnsEndpoint.DNSSuffix)
+	assert.Equal(t, policies, hnsEndpoint.Policies)
+	assert.Equal(t, 1, hns.endpointUpdates)
+
+	// Endpoints without drift are not updated.
+	require.NoError(t, nb.UpdateEndpointDNS(nw, ep))
+	assert.Equal(t, 1, hns.endpointUpdates)
+}
+
+func TestCheckEndpointDNSHCNNamespace(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: hns, endpointRequest: &request}}
+	nw := newTestNetwork(t)
+	nw.DNSServers = []string{"10.0.0.2", "10.0.0.3"}
+	nw.DNSSuffixSearchList = []string{"a.com", "b.com"}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	// HNS stores the DNS settings exactly as requested.
+	assert.Equal(t,
+		map[string]interface{}{
+			"Name":               "cid-ns1",
+			"VirtualNetworkName": "vpcbr123456789abc",
+			"IPAddress":          "10.0.1.11",
+			"PrefixLength":       float64(24),
+			"DNSServerList":      "10.0.0.2,10.0.0.3",
+			"DNSSuffix":          "a.com",
+			"PortFriendlyName":   "container1",
+			"Policies": []interface{}{
+				map[string]interface{}{
+					"Type":          "OutBoundNAT",
+					"ExceptionList": []interface{}{"10.0.1.0/24", "224.0.0.0/4", "10.0.1.255/32"},
+				},
+			},
+		},
+		request)
+	assert.NoError(t, nb.CheckEndpoint(nw, ep))
+
+	nw.DNSServers = []string{"10.0.0.4"}
+	var mismatchErr *ErrEndpointDNSMismatch
+	require.True(t, errors.As(nb.CheckEndpoint(nw, ep), &mismatchErr))
+	assert.Equal(t, "10.0.0.2,10.0.0.3", mismatchErr.DNSServerList)
+	assert.Equal(t, "10.0.0.4", mismatchErr.ExpectedDNSServerList)
+}
+
+// changeTestNetworkSubnet moves a test network to the 10.0.2.0/24 subnet.
+func changeTestNetworkSubnet(nw *Network) {
+	nw.ENIIPAddresses = []net.IPNet{{IP: net.ParseIP("10.0.2.10"), Mask: net.CIDRMask(24, 32)}}
+	nw.GatewayIPAddress = net.ParseIP("10.0.2.1")
+}
+
+func TestCheckEndpointReportsSubnetMismatch(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	other := newTestEndpoint("container2", "10.0.2.12")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, other))
+
+	changeTestNetworkSubnet(nw)
+
+	var mismatchErr *ErrEndpointSubnetMismatch
+	require.True(t, errors.As(nb.CheckEndpoint(nw, ep), &mismatchErr))
+	assert.Equal(t, "10.0.1.11", mismatchErr.IPAddress.String())
+	assert.Equal(t, "10.0.2.0/24", mismatchErr.Subnet)
+
+	endpointNames, err := nb.ListEndpointsOutsideSubnet(nw)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cid-container1"}, endpointNames)
+}
+
+func TestFindOrCreateEndpointSubnetMismatch(t *testing.T) {
+	for _, action := range []EndpointMismatchAction{
+		EndpointMismatchReuse, EndpointMismatchError, EndpointMismatchRecreate} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns, eniIPs: newTestIPDiscoverer("10.0.1.4", "10.0.2.4")}
+		nw := newTestNetwork(t)
+		nw.AllocateEndpointIPs = true
+		nw.EndpointSubnetMismatchAction = action
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, &Endpoint{ContainerID: "container1"}))
+
+		// The subnet change orphans the endpoint's IP address.
+		changeTestNetworkSubnet(nw)
+		ep := &Endpoint{ContainerID: "container1"}
+		err := nb.FindOrCreateEndpoint(nw, ep)
+
+		hnsEndpoint, lookupErr := hns.GetHNSEndpointByName("cid-container1")
+		require.NoError(t, lookupErr, action)
+		switch action {
+		case EndpointMismatchError:
+			var mismatchErr *ErrEndpointSubnetMismatch
+			assert.True(t, errors.As(err, &mismatchErr), action)
+			assert.Equal(t, "10.0.1.4", hnsEndpoint.IPAddress.String())
+		case EndpointMismatchRecreate:
+			require.NoError(t, err)
+			assert.Equal(t, "10.0.2.4", hnsEndpoint.IPAddress.String())
+			assert.Equal(t, "10.0.2.4", ep.IPAddresses[0].IP.String())
+		default:
+			require.NoError(t, err)
+			assert.Equal(t, "10.0.1.4", hnsEndpoint.IPAddress.String())
+		}
+		assert.Len(t, hns.endpoints, 1, action)
+	}
+}
+
+func TestFindOrCreateEndpointSubnetMismatchRecreateDeletesHostRoutes(t *testing.T) {
+	hns := newMockHNS()
+	routes := newMockHostRouter()
+	nb := &BridgeBuilder{
+		hns:    hns,
+		eniIPs: newTestIPDiscoverer("10.0.1.4", "10.0.2.4"),
+		routes: routes,
+	}
+	nw := newTestNetwork(t)
+	nw.AllocateEndpointIPs = true
+	nw.EndpointSubnetMismatchAction = EndpointMismatchRecreate
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	_, staleDestination, _ := net.ParseCIDR("192.168.10.0/24")
+	ep := &Endpoint{ContainerID: "container1", HostRoutes: []net.IPNet{*staleDestination}}
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	// The host routes to the stale endpoint are deleted with it.
+	changeTestNetworkSubnet(nw)
+	_, destination, _ := net.ParseCIDR("192.168.20.0/24")
+	ep = &Endpoint{ContainerID: "container1", HostRoutes: []net.IPNet{*destination}}
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	assert.Equal(t, map[string]string{"192.168.20.0/24": "10.0.2.4 vEthernet (Ethernet 2)"},
+		routes.routes)
+	assert.Len(t, hns.endpoints, 1)
+}
+
+func TestFindOrCreateNetworkTransparentMode(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.TransparentMode = true
+
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Equal(t, hnsTransparent, hnsNetwork.Type)
+}
+
+func TestFindOrCreateEndpointTransparentMode(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.TransparentMode = true
+	ep := newTestEndpoint("container1", "10.0.1.11")
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.False(t, hasSNATPolicy(t, hnsEndpoint))
+	assert.Equal(t, "10.0.1.1", hnsEndpoint.GatewayAddress)
+}
+
+func TestFindOrCreateEndpointSNATByDefault(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	ep := newTestEndpoint("container1", "10.0.1.11")
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.True(t, hasSNATPolicy(t, hnsEndpoint))
+	assert.Empty(t, hnsEndpoint.GatewayAddress)
+}
+
+func TestFindOrCreateEndpointDisableSNAT(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DisableSNAT = true
+	nw.ServiceCIDR = "10.100.0.0/16"
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.False(t, hasSNATPolicy(t, hnsEndpoint))
+	// The other policies are still added.
+	assert.Contains(t, getRoutePolicies(t, hnsEndpoint), "10.100.0.0/16")
+}
+
+func TestFindOrCreateEndpointSNATPolicyFields(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.SNATPolicyFields = map[string]interface{}{"MaxPortPoolUsage": 512}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	var policy map[string]interface{}
+	for _, buf := range hnsEndpoint.Policies {
+		require.NoError(t, json.Unmarshal(buf, &policy))
+		if policy["Type"] == string(hcsshim.OutboundNat) {
+			break
+		}
+	}
+	assert.Equal(t, string(hcsshim.OutboundNat), policy["Type"])
+	assert.Equal(t, float64(512), policy["MaxPortPoolUsage"])
+	assert.Contains(t, policy, "ExceptionList")
+}
+
+func TestFindOrCreateEndpointSNATPolicyFieldsCannotOverrideFields(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.SNATPolicyFields = map[string]interface{}{"type": "ROUTE"}
+
+	assert.Error(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateEndpointPolicyModeAtomic(t *testing.T) {
+	for _, setup := range []func(nw *Network, ep *Endpoint){
+		func(nw *Network, ep *Endpoint) { nw.SNATPolicyFields = map[string]interface{}{"type": "ROUTE"} },
+		func(nw *Network, ep *Endpoint) { ep.Policies = []json.RawMessage{json.RawMessage(`{"Type":`)} },
+	} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		setup(nw, ep)
+
+		assert.Error(t, nb.FindOrCreateEndpoint(nw, ep))
+		assert.Empty(t, hns.endpoints)
+	}
+}
+
+func TestFindOrCreateEndpointPolicyModeBestEffort(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.PolicyMode = PolicyModeBestEffort
+	nw.ServiceCIDR = "10.100.0.0/16"
+	nw.SNATPolicyFields = map[string]interface{}{"type": "ROUTE"}
+	qosPolicy := json.RawMessage(`{"Type":"QOS","MaximumOutgoingBandwidthInBytes":1000}`)
+	nw.EndpointPolicies = []json.RawMessage{json.RawMessage(`{"Type":`), qosPolicy}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	// The failing policies are skipped and reported, and the others are applied.
+	assert.Equal(t, []string{"OutBoundNAT", "EndpointPolicies[0]"}, ep.SkippedPolicies)
+	assert.Empty(t, ep.SNATExceptions)
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.100.0.0/16", "10.0.1.10/32"}, getRoutePolicies(t, hnsEndpoint))
+	assert.Contains(t, hnsEndpoint.Policies, qosPolicy)
+	for _, buf := range hnsEndpoint.Policies {
+		var policy hcsshim.Policy
+		require.NoError(t, json.Unmarshal(buf, &policy))
+		assert.NotEqual(t, hcsshim.OutboundNat, policy.Type)
+	}
+}
+
+func TestFindOrCreateEndpointRetriesHCNNamespaceOperations(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	client := &flakyNamespaceClient{hnsClient: hns, failures: 3}
+	nb := &BridgeBuilder{
+		Config: Config{
+			HCNNamespaceTimeout:       time.Second,
+			HCNNamespaceRetryInterval: time.Millisecond,
+		},
+		hns: client,
+	}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), ep))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-ns1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{hnsEndpoint.Id}, hns.namespaces["ns1"])
+	assert.Equal(t, 5, client.calls)
+}
+
+func TestFindOrCreateEndpointHCNNamespaceOperationTimeout(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	client := &flakyNamespaceClient{hnsClient: hns, failures: 1000}
+	nb := &BridgeBuilder{
+		Config: Config{
+			HCNNamespaceTimeout:       20 * time.Millisecond,
+			HCNNamespaceRetryInterval: time.Millisecond,
+		},
+		hns: client,
+	}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+
+	assert.Error(t, nb.FindOrCreateEndpoint(newTestNetwork(t), ep))
+
+	// The failed endpoint is cleaned up.
+	assert.Empty(t, hns.endpoints)
+	assert.True(t, client.calls > 1)
+}
+
+func TestFindOrCreateEndpointReturnsCompartmentID(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	hns.compartments["ns1"] = 7
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	assert.Equal(t, uint32(7), ep.CompartmentID)
+
+	// The compartment ID is also returned for existing endpoints.
+	ep.CompartmentID = 0
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	assert.Equal(t, uint32(7), ep.CompartmentID)
+}
+
+func TestFindOrCreateEndpointWaitsForEndpointReady(t *testing.T) {
+	for _, tc := range []struct {
+		timeout         time.Duration
+		pollsUntilReady int
+		polls           int
+		ready           bool
+	}{
+		// The readiness check is disabled by default.
+		{timeout: 0, pollsUntilReady: 3, polls: 0, ready: true},
+		{timeout: 10 * time.Second, pollsUntilReady: 0, polls: 1, ready: true},
+		{timeout: 10 * time.Second, pollsUntilReady: 3, polls: 4, ready: true},
+		{timeout: time.Millisecond, pollsUntilReady: 3, polls: 1, ready: false},
+	} {
+		hns := newMockHNS()
+		hns.namespaces["ns1"] = nil
+		hns.compartments["ns1"] = 7
+		compartments := &mockCompartments{hns: hns, pollsUntilReady: tc.pollsUntilReady}
+		nb := &BridgeBuilder{
+			Config:       Config{EndpointReadyTimeout: tc.timeout},
+			hns:          hns,
+			compartments: compartments,
+		}
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		ep.NetNSName = "ns1"
+
+		err := nb.FindOrCreateEndpoint(newTestNetwork(t), ep)
+
+		assert.Equal(t, tc.ready, err == nil, tc)
+		assert.Equal(t, tc.polls, compartments.polls, tc)
+		// Endpoints that are not ready are left to the caller to delete.
+		assert.Len(t, hns.endpoints, 1, tc)
+	}
+}
+
+func TestFindOrCreateEndpointRetry(t *testing.T) {
+	hns := newMockHNS()
+	sink := &recordingEventSink{}
+	failures := 1
+	hns.endpointCreateErr = func(ep *hcsshim.HNSEndpoint) error {
+		if failures > 0 {
+			failures--
+			return errors.New("HNS failed with error : The system is busy")
+		}
+		return nil
+	}
+	nb := &BridgeBuilder{
+		Config: Config{
+			EndpointRetryErrors:   []string{"System is busy"},
+			EndpointRetryLimit:    2,
+			EndpointRetryInterval: time.Millisecond,
+			EventSink:             sink,
+		},
+		hns: hns,
+	}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), newTestEndpoint("container1", "10.0.1.11")))
+
+	assert.Zero(t, failures)
+	assert.Len(t, hns.endpoints, 1)
+	assert.Equal(t, []string{"EndpointCreated vpcbr123456789abc cid-container1 container1 10.0.1.11"},
+		sink.events)
+}
+
+func TestFindOrCreateEndpointRetryDeletesPartialEndpoint(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	hns.compartments["ns1"] = 7
+	// The first attempt creates the endpoint, which is not ready in time.
+	compartments := &mockCompartments{hns: hns, pollsUntilReady: 1}
+	nb := &BridgeBuilder{
+		Config: Config{
+			EndpointReadyTimeout:  time.Millisecond,
+			EndpointRetryErrors:   []string{"is not assigned"},
+			EndpointRetryLimit:    1,
+			EndpointRetryInterval: time.Millisecond,
+		},
+		hns:          hns,
+		eniIPs:       newTestIPDiscoverer("10.0.1.4", "10.0.1.5"),
+		compartments: compartments,
+	}
+	nw := newTestNetwork(t)
+	nw.AllocateEndpointIPs = true
+	ep := newTestEndpoint("container1", "")
+	ep.IPAddresses = nil
+	ep.NetNSName = "ns1"
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	assert.Equal(t, 2, compartments.polls)
+	require.Len(t, hns.endpoints, 1)
+	assert.Len(t, hns.namespaces["ns1"], 1)
+	// The IP address allocated by the first attempt was released with its endpoint.
+	assert.Equal(t, "10.0.1.4", ep.IPAddresses[0].IP.String())
+}
+
+func TestFindOrCreateEndpointNoRetry(t *testing.T) {
+	for _, config := range []Config{
+		{EndpointRetryErrors: []string{"busy"}},
+		{EndpointRetryErrors: []string{"timeout"}, EndpointRetryLimit: 2},
+	} {
+		hns := newMockHNS()
+		attempts := 0
+		hns.endpointCreateErr = func(ep *hcsshim.HNSEndpoint) error {
+			attempts++
+			return errors.New("The system is busy")
+		}
+		nb := &BridgeBuilder{Config: config, hns: hns}
+
+		err := nb.FindOrCreateEndpoint(newTestNetwork(t), newTestEndpoint("container1", "10.0.1.11"))
+
+		assert.Error(t, err, config)
+		assert.Equal(t, 1, attempts, config)
+	}
+}
+
+func TestFindOrCreateEndpointReadinessUnknownForContainers(t *testing.T) {
+	hns := newMockHNS()
+	compartments := &mockCompartments{hns: hns, pollsUntilReady: 3}
+	nb := &BridgeBuilder{
+		Config:       Config{EndpointReadyTimeout: time.Millisecond},
+		hns:          hns,
+		compartments: compartments,
+	}
+
+	ep := newTestEndpoint("container1", "10.0.1.11")
+
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), ep))
+	assert.Zero(t, compartments.polls)
+}
+
+func TestFindOrCreateEndpointCompartmentIDUnknownForContainers(t *testing.T) {
+	nb := &BridgeBuilder{hns: newMockHNS()}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), ep))
+	assert.Zero(t, ep.CompartmentID)
+}
+
+func TestFindOrCreateEndpointHCNNamespaceDNS(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: hns, endpointRequest: &request}}
+	nw := newTestNetwork(t)
+	nw.DNSServers = []string{"10.0.0.2", "10.0.0.3"}
+	nw.DNSSuffixSearchList = []string{"us-west-2.compute.internal", "example.com"}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	// The endpoint is created through the HNS V1 API, which ignores HNS V2 DNS settings.
+	assert.Equal(t, "10.0.0.2,10.0.0.3", request["DNSServerList"])
+	assert.Equal(t, "us-west-2.compute.internal", request["DNSSuffix"])
+	assert.NotContains(t, request, "Dns")
+}
+
+func TestFindOrCreateEndpointHCNNamespaceDNSSearchListMode(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: hns, endpointRequest: &request}}
+	nw := newTestNetwork(t)
+	nw.DNSSuffixSearchList = []string{"us-west-2.compute.internal", "example.com"}
+	nw.DNSSuffixMode = DNSSuffixSearchList
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	assert.Equal(t, "us-west-2.compute.internal,example.com", request["DNSSuffix"])
+	assert.NotContains(t, request, "Dns")
+}
+
+func TestFindOrCreateEndpointContainerDNS(t *testing.T) {
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: newMockHNS(), endpointRequest: &request}}
+	nw := newTestNetwork(t)
+	nw.DNSServers = []string{"10.0.0.2", "10.0.0.3"}
+	nw.DNSSuffixSearchList = []string{"us-west-2.compute.internal", "example.com"}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	assert.Equal(t, "10.0.0.2,10.0.0.3", request["DNSServerList"])
+	// The first entry of the search list is the primary DNS suffix.
+	assert.Equal(t, "us-west-2.compute.internal", request["DNSSuffix"])
+	assert.NotContains(t, request, "Dns")
+}
+
+func TestFindOrCreateEndpointContainerDNSSearchListMode(t *testing.T) {
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: newMockHNS(), endpointRequest: &request}}
+	nw := newTestNetwork(t)
+	nw.DNSSuffixSearchList = []string{"us-west-2.compute.internal", "example.com"}
+	nw.DNSSuffixMode = DNSSuffixSearchList
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	assert.Equal(t, "us-west-2.compute.internal,example.com", request["DNSSuffix"])
+}
+
+func TestDeleteNetworkWithoutResidue(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.VerifyDelete = true
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+
+	require.NoError(t, nb.DeleteNetwork(nw))
+
+	residue, err := nb.findHNSNetworkResidue(nw, hnsNetwork)
+	require.NoError(t, err)
+	assert.Empty(t, residue)
+}
+
+func TestDeleteNetworkWithResidue(t *testing.T) {
+	hns := newMockHNS()
+	hns.retainDeletedNetworks = true
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.VerifyDelete = true
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	networkName := nb.generateHNSNetworkName(nw)
+	hnsNetwork, err := hns.GetHNSNetworkByName(networkName)
+	require.NoError(t, err)
+	hnsEndpoint := hns.addEndpoint("cid-container1", networkName)
+
+	// Residue is reported, but does not fail the delete.
+	require.NoError(t, nb.DeleteNetwork(nw))
+
+	residue, err := nb.findHNSNetworkResidue(nw, hnsNetwork)
+	require.NoError(t, err)
+	assert.ElementsMatch(t,
+		[]string{"network " + hnsNetwork.Id, "endpoint " + hnsEndpoint.Id},
+		residue)
+}
+
+func TestDeleteNetworkPreserveAdapterBinding(t *testing.T) {
+	hns := newMockHNS()
+	sink := &recordingEventSink{}
+	nb := &BridgeBuilder{Config: Config{EventSink: sink}, hns: hns}
+	nw := newTestNetwork(t)
+	nw.PreserveAdapterBinding = true
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	networkName := nb.generateHNSNetworkName(nw)
+
+	// The last network bound to the adapter is kept, so that the adapter is not reset.
+	require.NoError(t, nb.DeleteNetwork(nw))
+	_, err := hns.GetHNSNetworkByName(networkName)
+	assert.NoError(t, err)
+	assert.NotContains(t, sink.events, "NetworkDeleted "+networkName)
+
+	// Networks sharing the adapter with other networks are deleted.
+	hnsNetwork, err := hns.GetHNSNetworkByName(networkName)
+	require.NoError(t, err)
+	hns.addNetwork("other", nil).NetworkAdapterName = hnsNetwork.NetworkAdapterName
+	require.NoError(t, nb.DeleteNetwork(nw))
+	_, err = hns.GetHNSNetworkByName(networkName)
+	assert.Error(t, err)
+	assert.Contains(t, sink.events, "NetworkDeleted "+networkName)
+}
+
+func TestDeleteNetworkAbsent(t *testing.T) {
+	hns := newMockHNS()
+	sink := &recordingMetricsSink{}
+	nb := &BridgeBuilder{Config: Config{MetricsSink: sink}, hns: hns}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	require.NoError(t, nb.DeleteNetwork(nw))
+	assert.Equal(t, DeleteResultDeleted, nw.DeleteResult)
+
+	// Deleting the network again fails unless absent networks are ignored.
+	err := nb.DeleteNetwork(nw)
+	assert.True(t, hcsshim.IsNotExist(err))
+	assert.Equal(t, DeleteResultAbsent, nw.DeleteResult)
+
+	nw.IgnoreAbsentOnDelete = true
+	nw.DeleteResult = DeleteResultNone
+	require.NoError(t, nb.DeleteNetwork(nw))
+	assert.Equal(t, DeleteResultAbsent, nw.DeleteResult)
+
+	assert.Equal(t, []string{"network deleted", "network absent", "network absent"}, sink.deletes)
+}
+
+func TestDeleteEndpointAbsent(t *testing.T) {
+	hns := newMockHNS()
+	sink := &recordingMetricsSink{}
+	nb := &BridgeBuilder{Config: Config{MetricsSink: sink}, hns: hns}
+	nw := newTestNetwork(t)
+	nw.IgnoreAbsentOnDelete = true
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	require.NoError(t, nb.DeleteEndpoint(nw, ep))
+	assert.Equal(t, DeleteResultDeleted, ep.DeleteResult)
+
+	ep = newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.DeleteEndpoint(nw, ep))
+	assert.Equal(t, DeleteResultAbsent, ep.DeleteResult)
+
+	assert.Equal(t, []string{"endpoint deleted", "endpoint absent"}, sink.deletes)
+}
+
+func TestGenerateDNSSuffixSearchList(t *testing.T) {
+	nb := &BridgeBuilder{}
+
+	// The flat list is used for both address families.
+	nw := &Network{DNSSuffixSearchList: []string{"a.com", "b.com"}}
+	assert.Equal(t, []string{"a.com", "b.com"}, nb.generateDNSSuffixSearchList(nw))
+
+	// The per-family lists are combined without duplicates.
+	nw = &Network{
+		IPv4DNSSuffixSearchList: []string{"a.com", "v4.com"},
+		IPv6DNSSuffixSearchList: []string{"a.com", "v6.com"},
+	}
+	assert.Equal(t, []string{"a.com", "v4.com", "v6.com"}, nb.generateDNSSuffixSearchList(nw))
+
+	// The flat list is used for the family without its own list.
+	nw = &Network{
+		DNSSuffixSearchList:     []string{"a.com"},
+		IPv6DNSSuffixSearchList: []string{"v6.com"},
+	}
+	assert.Equal(t, []string{"a.com", "v6.com"}, nb.generateDNSSuffixSearchList(nw))
+
+	assert.Empty(t, nb.generateDNSSuffixSearchList(&Network{}))
+}
+
+func TestFindOrCreateEndpointPerFamilyDNSSuffixSearchLists(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.IPv4DNSSuffixSearchList = []string{"us-west-2.compute.internal"}
+	nw.IPv6DNSSuffixSearchList = []string{"ipv6.example.com"}
+	nw.DNSSuffixMode = DNSSuffixSearchList
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Equal(t, "us-west-2.compute.internal,ipv6.example.com", hnsEndpoint.DNSSuffix)
+}
+
+func TestFindOrCreateNetworkDNSMismatch(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DNSServers = []string{"10.0.0.2"}
+	nw.DNSSuffixSearchList = []string{"a.com"}
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	logs := captureLogs(t)
+	nw.DNSServers = []string{"10.0.0.3"}
+	nw.DNSSuffixSearchList = []string{"b.com"}
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	log.Flush()
+
+	// The mismatch is logged, and the network is kept as is.
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", hnsNetwork.DNSServerList)
+	assert.Equal(t, "a.com", hnsNetwork.DNSSuffix)
+	assert.Len(t, hns.networks, 1)
+	assert.Contains(t, logs.String(),
+		`Warn HNS network vpcbr123456789abc has DNS servers "10.0.0.2" and suffixes "a.com"`)
+}
+
+func TestFindOrCreateNetworkDNSMismatchRecreate(t *testing.T) {
+	for _, hasEndpoints := range []bool{false, true} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.DNSMismatchAction = NetworkMismatchRecreate
+		nw.DNSServers = []string{"10.0.0.2"}
+		require.NoError(t, nb.FindOrCreateNetwork(nw))
+		existing, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+		require.NoError(t, err)
+		if hasEndpoints {
+			hns.addEndpoint("cid-container1", existing.Name)
+		}
+
+		nw.DNSServers = []string{"10.0.0.3"}
+		require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+		// Networks in use are kept as is.
+		hnsNetwork, err := hns.GetHNSNetworkByName(existing.Name)
+		require.NoError(t, err)
+		if hasEndpoints {
+			assert.Equal(t, existing.Id, hnsNetwork.Id)
+			assert.Equal(t, "10.0.0.2", hnsNetwork.DNSServerList)
+		} else {
+			assert.NotEqual(t, existing.Id, hnsNetwork.Id)
+			assert.Equal(t, "10.0.0.3", hnsNetwork.DNSServerList)
+		}
+		assert.Len(t, hns.networks, 1)
+	}
+}
+
+func TestFindOrCreateNetworkDNSNotRecorded(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DNSMismatchAction = NetworkMismatchRecreate
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+
+	// Networks created without DNS settings are not checked, like the networks created before
+	// the network's DNS settings were applied.
+	assert.NotContains(t, hns.metadata[hnsNetwork.Id], hnsNetworkDNSKey)
+	logs := captureLogs(t)
+	nw.DNSServers = []string{"10.0.0.2"}
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	log.Flush()
+
+	found, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Equal(t, hnsNetwork.Id, found.Id)
+	assert.NotContains(t, logs.String(), "DNS servers")
+}
+
+func TestFindOrCreateNetworkDNSRecordedOnlyWithDNS(t *testing.T) {
+	for _, tc := range []struct {
+		dnsServers []string
+		disableDNS bool
+		recorded   bool
+	}{
+		{dnsServers: nil, recorded: false},
+		{dnsServers: []string{"10.0.0.2"}, recorded: true},
+		{dnsServers: []string{"10.0.0.2"}, disableDNS: true, recorded: false},
+	} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.DNSServers = tc.dnsServers
+		nw.DisableDNS = tc.disableDNS
+		require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+		hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+		require.NoError(t, err)
+		_, recorded := hns.metadata[hnsNetwork.Id][hnsNetworkDNSKey]
+		assert.Equal(t, tc.recorded, recorded, tc)
+	}
+}
+
+func TestFindOrCreateNetworkDNSMismatchUpdate(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DNSMismatchAction = NetworkMismatchUpdate
+
+	err := nb.FindOrCreateNetwork(nw)
+
+	assert.Equal(t, []string{"Network.DNSMismatchAction"}, getValidationErrorFields(t, err))
+	assert.Empty(t, hns.networks)
+}
+
+func TestFindOrCreateNetworkDNSSuffixMatchesEndpoints(t *testing.T) {
+	for _, mode := range []DNSSuffixMode{DNSSuffixPrimary, DNSSuffixSearchList} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.DNSServers = []string{"10.0.0.2"}
+		nw.DNSSuffixSearchList = []string{"a.com", "b.com"}
+		nw.DNSSuffixMode = mode
+		require.NoError(t, nb.FindOrCreateNetwork(nw))
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+		hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+		require.NoError(t, err)
+		hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+		require.NoError(t, err)
+		assert.Equal(t, hnsNetwork.DNSSuffix, hnsEndpoint.DNSSuffix, mode)
+		assert.Equal(t, hnsNetwork.DNSServerList, hnsEndpoint.DNSServerList, mode)
+	}
+}
+
+func TestDeleteEndpointInfraContainer(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	require.NoError(t, nb.DeleteEndpoint(nw, ep))
+
+	assert.Empty(t, hns.containers["container1"])
+	assert.Empty(t, hns.endpoints)
+	assert.Len(t, hns.networks, 1)
+}
+
+func TestDeleteEndpointAppContainer(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	infraEp := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, infraEp))
+	appEp := newTestEndpoint("container2", "10.0.1.11")
+	appEp.NetNSName = "container:container1"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, appEp))
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+
+	require.NoError(t, nb.DeleteEndpoint(nw, appEp))
+
+	// The app container is detached, but the endpoint is still used by the infra container.
+	assert.Empty(t, hns.containers["container2"])
+	assert.Equal(t, []string{hnsEndpoint.Id}, hns.containers["container1"])
+	assert.Len(t, hns.endpoints, 1)
+}
+
+func TestFindOrCreateEndpointAppContainerWaitsForInfraEndpoint(t *testing.T) {
+	for _, misses := range []int{0, 2} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{Config: Config{InfraEndpointTimeout: 5 * time.Second}, hns: hns}
+		nw := newTestNetwork(t)
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+		// The infra container's endpoint appears after the given number of lookups.
+		client := &delayedEndpointClient{hnsClient: hns, misses: misses}
+		nb.hns = client
+		appEp := newTestEndpoint("container2", "10.0.1.11")
+		appEp.NetNSName = "container:container1"
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, appEp), misses)
+
+		hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{hnsEndpoint.Id}, hns.containers["container2"])
+		assert.Equal(t, misses+2, client.calls)
+	}
+}
+
+func TestFindOrCreateEndpointAppContainerInfraEndpointMissing(t *testing.T) {
+	hns := newMockHNS()
+	client := &delayedEndpointClient{hnsClient: hns}
+	nb := &BridgeBuilder{hns: client}
+	appEp := newTestEndpoint("container2", "10.0.1.11")
+	appEp.NetNSName = "container:container1"
+
+	// Without a timeout, the infra container's endpoint is looked up once.
+	assert.Error(t, nb.FindOrCreateEndpoint(newTestNetwork(t), appEp))
+	assert.Equal(t, 1, client.calls)
+}
+
+func TestDeleteEndpointHCNNamespace(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	require.NoError(t, nb.DeleteEndpoint(nw, ep))
+
+	assert.Empty(t, hns.namespaces["ns1"])
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestDeleteEndpointHCNNamespaceDetachFailureIsIgnored(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+	hnsEndpoint := hns.addEndpoint("cid-ns1", "vpcbr123456789abc")
+
+	// The namespace no longer exists.
+	require.NoError(t, nb.detachEndpoint(newTestNetwork(t), hnsEndpoint, ep, hcnNamespace, "ns1"))
+
+	// Endpoints not in the namespace are already detached, even when detaching is required.
+	nw := newTestNetwork(t)
+	nw.RequireHCNNamespaceDetach = true
+	require.NoError(t, nb.detachEndpoint(nw, hnsEndpoint, ep, hcnNamespace, "ns1"))
+}
+
+func TestDeleteEndpointHCNNamespaceRequireDetach(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		require  bool
+		failures int
+		deleted  bool
+		calls    int
+	}{
+		{name: "tolerant", require: false, failures: 1000, deleted: true, calls: 1},
+		{name: "strict transient failures", require: true, failures: 2, deleted: true, calls: 3},
+		{name: "strict persistent failures", require: true, failures: 1000, deleted: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hns := newMockHNS()
+			hns.namespaces["ns1"] = nil
+			nb := &BridgeBuilder{
+				Config: Config{
+					HCNNamespaceTimeout:       20 * time.Millisecond,
+					HCNNamespaceRetryInterval: time.Millisecond,
+				},
+				hns: hns,
+			}
+			nw := newTestNetwork(t)
+			nw.RequireHCNNamespaceDetach = tc.require
+			// Endpoints still in use are deleted anyway, unless detaching is required.
+			nw.ForceEndpointDelete = true
+			ep := newTestEndpoint("container1", "10.0.1.11")
+			ep.NetNSName = "ns1"
+			require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+			client := &flakyNamespaceClient{hnsClient: hns, failures: tc.failures}
+			nb.hns = client
+			err := nb.DeleteEndpoint(nw, ep)
+
+			assert.Equal(t, tc.deleted, err == nil)
+			if tc.deleted {
+				assert.Empty(t, hns.endpoints)
+				assert.Equal(t, tc.calls, client.calls)
+			} else {
+				// The endpoint is kept in the namespace, for the runtime to retry the delete.
+				assert.Len(t, hns.endpoints, 1)
+				assert.Len(t, hns.namespaces["ns1"], 1)
+				assert.True(t, client.calls > 1)
+			}
+		})
+	}
+}
+
+func TestShouldDeleteEndpoint(t *testing.T) {
+	nb := &BridgeBuilder{}
+
+	assert.True(t, nb.shouldDeleteEndpoint(infraContainerNS))
+	assert.True(t, nb.shouldDeleteEndpoint(hcnNamespace))
+	assert.False(t, nb.shouldDeleteEndpoint(appContainerNS))
+}
+
+func TestDeleteEndpointDeletesNetworkWithLastEndpoint(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DeleteWithLastEndpoint = true
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	ep1 := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep1))
+	ep2 := newTestEndpoint("container2", "10.0.1.12")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep2))
+
+	require.NoError(t, nb.DeleteEndpoint(nw, ep1))
+	assert.Len(t, hns.networks, 1)
+
+	require.NoError(t, nb.DeleteEndpoint(nw, ep2))
+	assert.Empty(t, hns.networks)
+}
+
+func TestFindOrCreateEndpointDiscoversSNATPool(t *testing.T) {
+	hns := newMockHNS()
+	discoverer := &mockIPDiscoverer{
+		ipAddresses: []net.IP{
+			net.ParseIP("10.0.1.20"), net.ParseIP("10.0.1.21"), net.ParseIP("10.0.1.22"),
+		},
+	}
+	nb := &BridgeBuilder{hns: hns, eniIPs: discoverer}
+	nw := newTestNetwork(t)
+	nw.DiscoverSNATPool = true
+
+	vips := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		containerID := fmt.Sprintf("container%d", i)
+		ep := newTestEndpoint(containerID, fmt.Sprintf("10.0.1.%d", 100+i))
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+		hnsEndpoint, err := hns.GetHNSEndpointByName("cid-" + containerID)
+		require.NoError(t, err)
+		vips[getSNATPolicy(t, hnsEndpoint).VIP] = true
+	}
+
+	// Endpoints are spread over the secondary IP addresses.
+	for vip := range vips {
+		assert.Contains(t, []string{"10.0.1.20", "10.0.1.21", "10.0.1.22"}, vip)
+	}
+	assert.True(t, len(vips) > 1)
+}
+
+func TestFindOrCreateEndpointSNATPoolDiscoveryFailure(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns, eniIPs: &mockIPDiscoverer{err: errors.New("timeout")}}
+	nw := newTestNetwork(t)
+	nw.DiscoverSNATPool = true
+
+	assert.Error(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateEndpointConfiguredSNATPool(t *testing.T) {
+	hns := newMockHNS()
+	discoverer := &mockIPDiscoverer{}
+	nb := &BridgeBuilder{hns: hns, eniIPs: discoverer}
+	nw := newTestNetwork(t)
+	nw.SNATPool = []net.IP{net.ParseIP("10.0.1.30")}
+	nw.DiscoverSNATPool = true
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.1.30", getSNATPolicy(t, hnsEndpoint).VIP)
+	assert.Zero(t, discoverer.calls)
+}
+
+func TestFindOrCreateEndpointNoSNATPoolByDefault(t *testing.T) {
+	hns := newMockHNS()
+	discoverer := &mockIPDiscoverer{ipAddresses: []net.IP{net.ParseIP("10.0.1.20")}}
+	nb := &BridgeBuilder{hns: hns, eniIPs: discoverer}
+	nw := newTestNetwork(t)
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Empty(t, getSNATPolicy(t, hnsEndpoint).VIP)
+	assert.Zero(t, discoverer.calls)
+}
+
+func TestFindOrCreateEndpointRefusesHostIPAddress(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+
+	for _, ip := range []string{"10.0.1.10", "10.0.1.1"} {
+		err := nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", ip))
+
+		var conflictErr *ErrEndpointIPConflict
+		require.True(t, errors.As(err, &conflictErr))
+		assert.Equal(t, ip, conflictErr.IPAddress.String())
+	}
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateNetworkTagsRoundTrip(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.VPCID = "vpc-0123456789abcdef0"
+	nw.SubnetID = "subnet-0123456789abcdef0"
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Equal(t, "vpc-0123456789abcdef0", hns.metadata[hnsNetwork.Id][hnsNetworkVPCIDKey])
+	assert.Equal(t, "subnet-0123456789abcdef0", hns.metadata[hnsNetwork.Id][hnsNetworkSubnetIDKey])
+
+	// The tags are read back when finding the existing network.
+	foundNw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateNetwork(foundNw))
+	assert.Equal(t, "vpc-0123456789abcdef0", foundNw.VPCID)
+	assert.Equal(t, "subnet-0123456789abcdef0", foundNw.SubnetID)
+}
+
+func TestFindOrCreateNetworkWithoutTags(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.NotContains(t, hns.metadata[hnsNetwork.Id], hnsNetworkVPCIDKey)
+	assert.NotContains(t, hns.metadata[hnsNetwork.Id], hnsNetworkSubnetIDKey)
+}
+
+func TestFindOrCreateNetworkMetadataStore(t *testing.T) {
+	hns := newMockHNS()
+	hns.dropNetworkMetadata = true
+	dir := t.TempDir()
+	nb := &BridgeBuilder{Config: Config{NetworkMetadataDir: dir}, hns: hns}
+	nw := newTestNetwork(t)
+	nw.VPCID = "vpc-0123456789abcdef0"
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Empty(t, hns.metadata[hnsNetwork.Id])
+
+	// The metadata is read back from the store after a restart, so the network is compatible.
+	nb = &BridgeBuilder{Config: Config{NetworkMetadataDir: dir}, hns: hns}
+	foundNw := newTestNetwork(t)
+	foundNw.VersionMismatchAction = NetworkMismatchRecreate
+	require.NoError(t, nb.FindOrCreateNetwork(foundNw))
+	assert.Equal(t, "vpc-0123456789abcdef0", foundNw.VPCID)
+	foundHNSNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Equal(t, hnsNetwork.Id, foundHNSNetwork.Id)
+
+	// The stored metadata is deleted with the network.
+	require.NoError(t, nb.DeleteNetwork(foundNw))
+	_, err = os.Stat(filepath.Join(dir, hnsNetwork.Id+".json"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Without the store, the network looks like it predates versioning and is kept, but its
+	// tags are lost.
+	nb = &BridgeBuilder{hns: hns}
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	hnsNetwork, err = hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	foundNw = newTestNetwork(t)
+	foundNw.VersionMismatchAction = NetworkMismatchRecreate
+	require.NoError(t, nb.FindOrCreateNetwork(foundNw))
+	foundHNSNetwork, err = hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Equal(t, hnsNetwork.Id, foundHNSNetwork.Id)
+	assert.Empty(t, foundNw.VPCID)
+}
+
+func TestFindOrCreateEndpointDisableDNS(t *testing.T) {
+	for _, netNSName := range []string{"", "ns1"} {
+		hns := newMockHNS()
+		hns.namespaces["ns1"] = nil
+		var request map[string]interface{}
+		nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: hns, endpointRequest: &request}}
+		nw := newTestNetwork(t)
+		nw.DNSServers = []string{"10.0.0.2"}
+		nw.DNSSuffixSearchList = []string{"us-west-2.compute.internal"}
+		nw.DisableDNS = true
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		ep.NetNSName = netNSName
+
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+		assert.NotContains(t, request, "DNSServerList")
+		assert.NotContains(t, request, "DNSSuffix")
+		assert.NotContains(t, request, "Dns")
+	}
+}
+
+func TestFindOrCreateEndpointSecondaryDisableDNS(t *testing.T) {
+	for _, netNSName := range []string{"", "ns1"} {
+		hns := newMockHNS()
+		hns.namespaces["ns1"] = nil
+		var request map[string]interface{}
+		nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: hns, endpointRequest: &request}}
+		primaryNw := newTestNetwork(t)
+		primaryNw.DNSServers = []string{"10.0.0.2"}
+		primaryNw.DNSSuffixSearchList = []string{"us-west-2.compute.internal"}
+		secondaryNw := newTestNetwork(t)
+		secondaryNw.Name = "secondary"
+		secondaryNw.DNSServers = []string{"10.0.0.3"}
+
+		// The primary endpoint sets the container's DNS settings.
+		primary := newTestEndpoint("container1", "10.0.1.11")
+		primary.NetNSName = netNSName
+		require.NoError(t, nb.FindOrCreateEndpoint(primaryNw, primary))
+		assert.Equal(t, "10.0.0.2", request["DNSServerList"])
+
+		// The secondary endpoint does not override them.
+		request = nil
+		secondary := newTestEndpoint("container1", "10.0.1.12")
+		secondary.NetNSName = netNSName
+		secondary.Key = "secondary"
+		secondary.DisableDNS = true
+		require.NoError(t, nb.FindOrCreateEndpoint(secondaryNw, secondary))
+		assert.NotContains(t, request, "DNSServerList")
+		assert.NotContains(t, request, "DNSSuffix")
+		assert.NotContains(t, request, "Dns")
+	}
+}
+
+func TestFindOrCreateEndpointServiceCIDROverlap(t *testing.T) {
+	_, vpcCIDR, _ := net.ParseCIDR("10.0.0.0/16")
+
+	for _, tc := range []struct {
+		serviceCIDR string
+		vpcCIDRs    []net.IPNet
+		valid       bool
+	}{
+		{serviceCIDR: "10.100.0.0/16", valid: true},
+		{serviceCIDR: "10.100.0.0/16", vpcCIDRs: []net.IPNet{*vpcCIDR}, valid: true},
+		{serviceCIDR: "10.0.1.128/25"},
+		{serviceCIDR: "10.0.0.0/8"},
+		{serviceCIDR: "10.0.200.0/24", vpcCIDRs: []net.IPNet{*vpcCIDR}},
+		{serviceCIDR: "invalid"},
+	} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.ServiceCIDR = tc.serviceCIDR
+		nw.VPCCIDRs = tc.vpcCIDRs
+
+		err := nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11"))
+		if tc.valid {
+			assert.NoError(t, err, tc.serviceCIDR)
+			assert.Len(t, hns.endpoints, 1)
+		} else {
+			assert.Error(t, err, tc.serviceCIDR)
+			assert.Empty(t, hns.endpoints)
+		}
+	}
+}
+
+func TestFindOrCreateEndpointEnableLowMetric(t *testing.T) {
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: newMockHNS(), endpointRequest: &request}}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.EnableLowMetric = true
+
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), ep))
+
+	assert.Equal(t, true, request["EnableLowMetric"])
+}
+
+func TestFindOrCreateEndpointLowMetricUnsetByDefault(t *testing.T) {
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: newMockHNS(), endpointRequest: &request}}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), newTestEndpoint("container1", "10.0.1.11")))
+
+	assert.NotContains(t, request, "EnableLowMetric")
+}
+
+func TestFindOrCreateEndpointDisableICC(t *testing.T) {
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: newMockHNS(), endpointRequest: &request}}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), newTestEndpoint("container1", "10.0.1.11")))
+	assert.NotContains(t, request, "DisableICC")
+
+	request = nil
+	ep := newTestEndpoint("container2", "10.0.1.12")
+	ep.DisableICC = true
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), ep))
+	assert.Equal(t, true, request["DisableICC"])
+}
+
+func TestFindOrCreateEndpointMetered(t *testing.T) {
+	for _, metered := range []bool{true, false} {
+		var request map[string]interface{}
+		nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: newMockHNS(), endpointRequest: &request}}
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		ep.Metered = &metered
+
+		require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), ep))
+
+		assert.Equal(t, metered, request["Metered"])
+	}
+}
+
+func TestFindOrCreateEndpointMeteredUnsetByDefault(t *testing.T) {
+	var request map[string]interface{}
+	nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: newMockHNS(), endpointRequest: &request}}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), newTestEndpoint("container1", "10.0.1.11")))
+
+	assert.NotContains(t, request, "Metered")
+}
+
+func TestCreateEndpointAsync(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+
+	results := make(chan error)
+	callback := func(ep *Endpoint, err error) {
+		results <- err
+	}
+
+	// Concurrent creates in the same network are serialized, including duplicate creates.
+	for i := 0; i < 10; i++ {
+		ep := newTestEndpoint(fmt.Sprintf("container%d", i), fmt.Sprintf("10.0.1.%d", 100+i))
+		nb.CreateEndpointAsync(nw, ep, callback)
+		nb.CreateEndpointAsync(nw, ep, callback)
+	}
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, <-results)
+	}
+	assert.Len(t, hns.endpoints, 10)
+}
+
+func TestFindOrCreateEndpointDuplicateCalls(t *testing.T) {
+	hns := newMockHNS()
+	client := &blockingEndpointClient{
+		hnsClient: hns,
+		started:   make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	nb := &BridgeBuilder{hns: client}
+	nw := newTestNetwork(t)
+
+	results := make(chan *Endpoint)
+	create := func() {
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		assert.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+		results <- ep
+	}
+
+	// The duplicate calls start while the first call is creating the endpoint in HNS.
+	go create()
+	<-client.started
+	for i := 0; i < 3; i++ {
+		go create()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(client.release)
+
+	for i := 0; i < 4; i++ {
+		ep := <-results
+		assert.Equal(t, "00:15:5d:00:00:01", ep.MACAddress.String())
+	}
+	assert.Equal(t, 1, client.lookups)
+	assert.Equal(t, 1, client.creates)
+	assert.Len(t, hns.endpoints, 1)
+
+	// Later calls are not duplicates.
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	assert.Equal(t, 2, client.lookups)
+}
+
+func TestFindOrCreateEndpointDuplicateCallResult(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	hns.compartments["ns1"] = 7
+	client := &blockingEndpointClient{
+		hnsClient: hns,
+		started:   make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	nb := &BridgeBuilder{
+		hns:    client,
+		eniIPs: newTestIPDiscoverer("10.0.1.20"),
+		routes: newMockHostRouter(),
+	}
+	nw := newTestNetwork(t)
+	nw.AllocateEndpointIPs = true
+	nw.ServiceCIDR = "10.100.0.0/16"
+	nw.PolicyMode = PolicyModeBestEffort
+	nw.EndpointPolicies = []json.RawMessage{json.RawMessage(`{"Type":`)}
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	newEndpoint := func() *Endpoint {
+		return &Endpoint{
+			ContainerID:    "container1",
+			NetNSName:      "ns1",
+			CNINetworkName: "vpc-cni",
+			HostRoutes:     []net.IPNet{{IP: net.ParseIP("10.0.1.20").To4(), Mask: net.CIDRMask(32, 32)}},
+		}
+	}
+
+	first := newEndpoint()
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, nb.FindOrCreateEndpoint(nw, first))
+		close(done)
+	}()
+	<-client.started
+	waiter := newEndpoint()
+	waiterHostRoutes := waiter.HostRoutes
+	waiterDone := make(chan struct{})
+	go func() {
+		assert.NoError(t, nb.FindOrCreateEndpoint(nw, waiter))
+		close(waiterDone)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(client.release)
+	<-done
+	<-waiterDone
+
+	// The waiter gets every output of the first call, and keeps its own inputs.
+	assert.Equal(t, 1, client.creates)
+	assert.Equal(t, first, waiter)
+	assert.NotEmpty(t, waiter.MACAddress)
+	assert.Equal(t, []net.IPNet{{IP: net.ParseIP("10.0.1.20").To4(), Mask: net.CIDRMask(24, 32)}},
+		waiter.IPAddresses)
+	assert.Equal(t, uint32(7), waiter.CompartmentID)
+	assert.Equal(t, "vpc-cni", waiter.CNINetworkName)
+	assert.NotEmpty(t, waiter.SNATExceptions)
+	assert.Equal(t, []string{"10.100.0.0/16", "10.0.1.10/32"}, waiter.RouteDestinations)
+	assert.Equal(t, []string{"EndpointPolicies[0]"}, waiter.SkippedPolicies)
+	assert.True(t, &waiterHostRoutes[0] == &waiter.HostRoutes[0])
+}
+
+func TestCreateEndpointAsyncFailure(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	ep := newTestEndpoint("container1", "10.0.1.10")
+
+	results := make(chan error)
+	nb.CreateEndpointAsync(newTestNetwork(t), ep, func(resultEp *Endpoint, err error) {
+		assert.Equal(t, ep, resultEp)
+		results <- err
+	})
+
+	assert.Error(t, <-results)
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestGCRetainsNetworkWithoutEndpoints(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	require.NoError(t, nb.GC(nw, nil))
+
+	assert.Empty(t, hns.endpoints)
+	assert.Len(t, hns.networks, 1)
+}
+
+func TestGCDeletesNetworkWithoutEndpoints(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.NetworkGCPolicy = NetworkGCDelete
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container2", "10.0.1.12")))
+
+	// The network is retained while it has endpoints.
+	require.NoError(t, nb.GC(nw, []string{"container2"}))
+	assert.Len(t, hns.endpoints, 1)
+	assert.Len(t, hns.networks, 1)
+
+	require.NoError(t, nb.GC(nw, nil))
+	assert.Empty(t, hns.endpoints)
+	assert.Empty(t, hns.networks)
+
+	// GC of a deleted network is a no-op.
+	require.NoError(t, nb.GC(nw, nil))
+}
+
+// testSNATExceptionProvider is an SNATExceptionProvider returning the current exceptions.
+type testSNATExceptionProvider struct {
+	exceptions []string
+	err        error
+}
+
+func (p *testSNATExceptionProvider) GetSNATExceptions() ([]string, error) {
+	return p.exceptions, p.err
+}
+
+func TestFindOrCreateEndpointSNATExceptionProvider(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	provider := &testSNATExceptionProvider{exceptions: []string{"172.31.0.0/16"}}
+	nw := newTestNetwork(t)
+	nw.DisableMulticastSNATExceptions = true
+	nw.SNATExceptionProvider = provider
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	// New endpoints pick up the updated exceptions.
+	provider.exceptions = []string{"172.31.0.0/16", "192.168.0.0/16"}
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container2", "10.0.1.12")))
+
+	hnsEndpoint1, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.1.0/24", "172.31.0.0/16"}, getSNATExceptions(t, hnsEndpoint1))
+
+	hnsEndpoint2, err := hns.GetHNSEndpointByName("cid-container2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.1.0/24", "172.31.0.0/16", "192.168.0.0/16"},
+		getSNATExceptions(t, hnsEndpoint2))
+}
+
+func TestFindOrCreateEndpointCachesNetworkSNATExceptions(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	base := getCachedSNATExceptions(t, nb, nw)
+	require.NotEmpty(t, base)
+
+	ep1 := newTestEndpoint("container1", "10.0.1.11")
+	ep1.AdditionalSNATExceptions = []string{"192.168.0.0/24"}
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep1))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container2", "10.0.1.12")))
+
+	// The endpoints share the cached base, with the additions of each endpoint on top.
+	assert.True(t, &base[0] == &getCachedSNATExceptions(t, nb, nw)[0])
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Equal(t, append(append([]string{}, base...), "192.168.0.0/24"),
+		getSNATExceptions(t, hnsEndpoint))
+	hnsEndpoint, err = hns.GetHNSEndpointByName("cid-container2")
+	require.NoError(t, err)
+	assert.Equal(t, base, getSNATExceptions(t, hnsEndpoint))
+
+	// Changing the network's settings invalidates the cached base.
+	nw.ServiceCIDR = "10.100.0.0/16"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container3", "10.0.1.13")))
+	hnsEndpoint, err = hns.GetHNSEndpointByName("cid-container3")
+	require.NoError(t, err)
+	assert.Contains(t, getSNATExceptions(t, hnsEndpoint), "10.100.0.0/16")
+	assert.Contains(t, getCachedSNATExceptions(t, nb, nw), "10.100.0.0/16")
+}
+
+func TestGetNetworkSNATExceptionsConcurrentCalls(t *testing.T) {
+	nb := &BridgeBuilder{}
+	nw := newTestNetwork(t)
+	other := newTestNetwork(t)
+	other.ServiceCIDR = "10.100.0.0/16"
+	expected := nb.deriveNetworkSNATExceptions(nw)
+	otherExpected := nb.deriveNetworkSNATExceptions(other)
+
+	// Callers with different settings for the same network each get their own exceptions.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, expected, nb.getNetworkSNATExceptions(nw))
+		}()
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, otherExpected, nb.getNetworkSNATExceptions(other))
+		}()
+	}
+	wg.Wait()
+}
+
+// getCachedSNATExceptions returns the SNAT exceptions cached for a network.
+func getCachedSNATExceptions(t *testing.T, nb *BridgeBuilder, nw *Network) []string {
+	cached, ok := nb.snatExceptions.Load(nb.generateHNSNetworkName(nw))
+	require.True(t, ok)
+	return cached.(*networkSNATExceptions).exceptions
+}
+
+func TestFindOrCreateEndpointInvalidAdditionalSNATExceptions(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.AdditionalSNATExceptions = []string{"192.168.0.1"}
+
+	err := nb.FindOrCreateEndpoint(newTestNetwork(t), ep)
+
+	assert.Equal(t, []string{"Endpoint.AdditionalSNATExceptions"}, getValidationErrorFields(t, err))
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateEndpointSNATExceptionProviderFailure(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.SNATExceptionProvider = &testSNATExceptionProvider{err: errors.New("file not found")}
+
+	assert.Error(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateEndpointMismatchedIPAddress(t *testing.T) {
+	hns := newMockHNS()
+	hns.endpointResponse = func(ep *hcsshim.HNSEndpoint) {
+		ep.IPAddress = net.ParseIP("10.0.1.200")
+	}
+	nb := &BridgeBuilder{hns: hns}
+
+	err := nb.FindOrCreateEndpoint(newTestNetwork(t), newTestEndpoint("container1", "10.0.1.11"))
+	assert.Error(t, err)
+
+	// The endpoint with the wrong IP address is cleaned up.
+	assert.Empty(t, hns.endpoints)
+	assert.Empty(t, hns.containers["container1"])
+}
+
+func TestFindOrCreateEndpointInvalidMACAddress(t *testing.T) {
+	hns := newMockHNS()
+	hns.endpointResponse = func(ep *hcsshim.HNSEndpoint) {
+		ep.MacAddress = "not-a-mac"
+	}
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+
+	err := nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11"))
+	var macErr *ErrEndpointMACInvalid
+	require.True(t, errors.As(err, &macErr))
+	assert.Equal(t, "not-a-mac", macErr.MACAddress)
+
+	// The endpoint with the invalid MAC address is cleaned up.
+	assert.Empty(t, hns.endpoints)
+
+	// Networks can ignore invalid MAC addresses.
+	nw.IgnoreInvalidEndpointMAC = true
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	assert.Nil(t, ep.MACAddress)
+	assert.Len(t, hns.endpoints, 1)
+}
+
+func TestFindOrCreateEndpointInfo(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	hns.compartments["ns1"] = 7
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.DNSServers = []string{"10.0.0.2"}
+	newEndpoint := func() *Endpoint {
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		ep.NetNSName = "ns1"
+		return ep
+	}
+
+	created, err := nb.FindOrCreateEndpointInfo(nw, newEndpoint())
+	require.NoError(t, err)
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-ns1")
+	require.NoError(t, err)
+	assert.Equal(t, hnsEndpoint.Id, created.ID)
+	assert.Equal(t, "cid-ns1", created.Name)
+	assert.Equal(t, "vpcbr123456789abc", created.NetworkName)
+	assert.Equal(t, "10.0.1.11", created.IPAddress.String())
+	assert.Equal(t, uint8(24), created.PrefixLength)
+	assert.Equal(t, "00:15:5d:00:00:01", created.MACAddress.String())
+	assert.Equal(t, "10.0.0.2", created.DNSServerList)
+	assert.Equal(t, getSNATExceptions(t, hnsEndpoint),
+		getSNATExceptions(t, &hcsshim.HNSEndpoint{Policies: created.Policies}))
+	assert.Equal(t, uint32(7), created.CompartmentID)
+
+	// The existing endpoint is described alike.
+	found, err := nb.FindOrCreateEndpointInfo(nw, newEndpoint())
+	require.NoError(t, err)
+	assert.Equal(t, created, found)
+}
+
+// captureLogs replaces the logger with one writing the level and message of each log entry to
+// the returned buffer, until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger, err := log.LoggerFromWriterWithMinLevelAndFormat(&buf, log.TraceLvl, "%Level %Msg%n")
+	require.NoError(t, err)
+	previous := log.Current
+	require.NoError(t, log.ReplaceLogger(logger))
+	t.Cleanup(func() { log.ReplaceLogger(previous) })
+	return &buf
+}
+
+func TestFindOrCreateEndpointDuplicateCreate(t *testing.T) {
+	for _, logDuplicateCreates := range []bool{false, true} {
+		hns := newMockHNS()
+		sink := &recordingMetricsSink{}
+		nb := &BridgeBuilder{
+			Config: Config{MetricsSink: sink, LogDuplicateCreates: logDuplicateCreates},
+			hns:    hns,
+		}
+		nw := newTestNetwork(t)
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+		logs := captureLogs(t)
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+		log.Flush()
+
+		message := "HNS endpoint cid-container1 is already attached to container ID container1."
+		if logDuplicateCreates {
+			assert.Contains(t, logs.String(), "Info "+message)
+		} else {
+			assert.Contains(t, logs.String(), "Debug "+message)
+		}
+		assert.Equal(t, []string{AttachNamespaceInfra}, sink.duplicates)
+		assert.Len(t, hns.endpoints, 1)
+	}
+}
+
+func TestFindOrCreateEndpointExistingInvalidMACAddress(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	for _, hnsEndpoint := range hns.endpoints {
+		hnsEndpoint.MacAddress = ""
+	}
+
+	err := nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11"))
+	var macErr *ErrEndpointMACInvalid
+	assert.True(t, errors.As(err, &macErr))
+
+	// The existing endpoint is not deleted.
+	assert.Len(t, hns.endpoints, 1)
+}
+
+// getVSIDPolicies returns the VSID policies on an HNS endpoint.
+func getVSIDPolicies(t *testing.T, hnsEndpoint *hcsshim.HNSEndpoint) []hcsshim.VsidPolicy {
+	var policies []hcsshim.VsidPolicy
+	for _, buf := range hnsEndpoint.Policies {
+		var policy hcsshim.VsidPolicy
+		require.NoError(t, json.Unmarshal(buf, &policy))
+		if policy.Type == hcsshim.VSID {
+			policies = append(policies, policy)
+		}
+	}
+	return policies
+}
+
+func TestFindOrCreateEndpointVNI(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.VNI = 4097
+
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), ep))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	policies := getVSIDPolicies(t, hnsEndpoint)
+	require.Len(t, policies, 1)
+	assert.Equal(t, uint(4097), policies[0].VSID)
+}
+
+func TestFindOrCreateEndpointNoVNIByDefault(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), newTestEndpoint("container1", "10.0.1.11")))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Empty(t, getVSIDPolicies(t, hnsEndpoint))
+}
+
+func TestFindOrCreateEndpointInvalidVNI(t *testing.T) {
+	for _, vni := range []uint32{1, 4095, 1 << 24} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		ep.VNI = vni
+
+		err := nb.FindOrCreateEndpoint(newTestNetwork(t), ep)
+		assert.Error(t, err, vni)
+		assert.Empty(t, hns.endpoints)
+	}
+}
+
+func TestUsedIPs(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container2", "10.0.1.12")))
+
+	// Addresses used by multiple endpoints are listed once per endpoint.
+	networkName := nb.generateHNSNetworkName(nw)
+	hns.addEndpoint("cid-container3", networkName).IPAddress = net.ParseIP("10.0.1.12")
+	// Endpoints without addresses and endpoints in other networks are ignored.
+	hns.addEndpoint("cid-container4", networkName)
+	hns.addEndpoint("cid-container5", "vpcbr2").IPAddress = net.ParseIP("10.0.2.11")
+
+	ipAddresses, err := nb.UsedIPs(nw)
+	require.NoError(t, err)
+
+	var used []string
+	for _, ipAddress := range ipAddresses {
+		used = append(used, ipAddress.String())
+	}
+	assert.ElementsMatch(t, []string{"10.0.1.11", "10.0.1.12", "10.0.1.12"}, used)
+}
+
+func TestIsIPInUse(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	networkName := nb.generateHNSNetworkName(nw)
+	hns.addEndpoint("cid-container2", networkName).IPAddress = net.ParseIP("10.0.1.12")
+	hns.addEndpoint("cid-container3", networkName)
+	hns.addEndpoint("cid-container4", "vpcbr2").IPAddress = net.ParseIP("10.0.1.13")
+
+	for ipAddress, expected := range map[string]bool{
+		"10.0.1.11": true,
+		"10.0.1.12": true,
+		// Addresses used only in other networks are free in this network.
+		"10.0.1.13": false,
+		"10.0.1.14": false,
+	} {
+		inUse, err := nb.IsIPInUse(nw, net.ParseIP(ipAddress))
+		require.NoError(t, err)
+		assert.Equal(t, expected, inUse, ipAddress)
+	}
+}
+
+func TestEndpointCount(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	count, err := nb.EndpointCount(nw)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container2", "10.0.1.12")))
+	// Endpoints in other networks are not counted.
+	hns.addEndpoint("cid-container3", "vpcbr2")
+
+	count, err = nb.EndpointCount(nw)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestEndpointCountNetworkNotFound(t *testing.T) {
+	nb := &BridgeBuilder{hns: newMockHNS()}
+
+	_, err := nb.EndpointCount(newTestNetwork(t))
+	assert.Error(t, err)
+}
+
+func TestAcquireEndpointOperationLimit(t *testing.T) {
+	nb := NewBridgeBuilder(Config{MaxConcurrentEndpointOperations: 3})
+
+	var lock sync.Mutex
+	var inFlight, maxInFlight int
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := nb.acquireEndpointOperation()
+			defer release()
+
+			lock.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			lock.Unlock()
+
+			// Give the other operations a chance to run.
+			time.Sleep(5 * time.Millisecond)
+
+			lock.Lock()
+			inFlight--
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	assert.True(t, maxInFlight <= 3, "%d operations in flight", maxInFlight)
+	assert.Equal(t, 3, cap(nb.endpointOperations))
+}
+
+func TestAttachDurationMetrics(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	sink := &recordingMetricsSink{}
+	nb := &BridgeBuilder{Config: Config{MetricsSink: sink, AttachDurationSamples: 10}, hns: hns}
+	nw := newTestNetwork(t)
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	appEp := newTestEndpoint("container2", "10.0.1.11")
+	appEp.NetNSName = "container:container1"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, appEp))
+	hcnEp := newTestEndpoint("container3", "10.0.1.12")
+	hcnEp.NetNSName = "ns1"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, hcnEp))
+
+	assert.Equal(t,
+		[]string{AttachNamespaceInfra, AttachNamespaceApp, AttachNamespaceHCN}, sink.attaches)
+	summaries := nb.AttachDurations()
+	assert.Len(t, summaries, 3)
+	for _, label := range sink.attaches {
+		assert.Equal(t, 1, summaries[label].Count, label)
+	}
+}
+
+func TestAttachDurationsSummary(t *testing.T) {
+	nb := NewBridgeBuilder(Config{AttachDurationSamples: 4})
+	assert.Empty(t, nb.AttachDurations())
+
+	for _, duration := range []time.Duration{9, 1, 2, 3, 4} {
+		nb.recordAttachDuration(hcnNamespace, duration*time.Millisecond)
+	}
+	nb.recordAttachDuration(infraContainerNS, time.Second)
+
+	// The oldest duration is overwritten once the samples are full.
+	summaries := nb.AttachDurations()
+	assert.Equal(t, AttachDurationSummary{
+		Count: 4,
+		P50:   2 * time.Millisecond,
+		P99:   4 * time.Millisecond,
+		Max:   4 * time.Millisecond,
+	}, summaries[AttachNamespaceHCN])
+	assert.Equal(t, AttachDurationSummary{
+		Count: 1,
+		P50:   time.Second,
+		P99:   time.Second,
+		Max:   time.Second,
+	}, summaries[AttachNamespaceInfra])
+
+	// No durations are kept by default.
+	nb = NewBridgeBuilder(Config{})
+	nb.recordAttachDuration(hcnNamespace, time.Millisecond)
+	assert.Empty(t, nb.AttachDurations())
+}
+
+func TestConfigDefaults(t *testing.T) {
+	config := (&BridgeBuilder{}).config()
+
+	assert.Equal(t, 10*time.Second, config.HCNNamespaceTimeout)
+	assert.Equal(t, 100*time.Millisecond, config.HCNNamespaceRetryInterval)
+	assert.Equal(t, 5*time.Second, config.HNSGlobalsTimeout)
+	assert.Equal(t, 500*time.Millisecond, config.EndpointRetryInterval)
+	assert.Equal(t, 8, config.MaxConcurrentEndpointOperations)
+	assert.Equal(t, 256, config.MaxEndpointNameLength)
+	assert.Equal(t, &noopEventSink{}, config.EventSink)
+	assert.Equal(t, &noopMetricsSink{}, config.MetricsSink)
+	// The optional waits are disabled by default.
+	assert.Zero(t, config.InfraEndpointTimeout)
+	assert.Zero(t, config.NetworkReadyTimeout)
+	assert.Zero(t, config.EndpointReadyTimeout)
+	assert.Zero(t, config.EndpointRetryLimit)
+	assert.Empty(t, config.NetworkMetadataDir)
+	assert.Empty(t, config.FeatureGates)
+}
+
+func TestConfigOverrides(t *testing.T) {
+	sink := &recordingEventSink{}
+	overrides := Config{
+		HCNNamespaceTimeout:             time.Second,
+		HCNNamespaceRetryInterval:       time.Millisecond,
+		HNSGlobalsTimeout:               2 * time.Second,
+		InfraEndpointTimeout:            3 * time.Second,
+		NetworkReadyTimeout:             4 * time.Second,
+		EndpointReadyTimeout:            5 * time.Second,
+		EndpointRetryErrors:             []string{"busy"},
+		EndpointRetryLimit:              3,
+		EndpointRetryInterval:           time.Millisecond,
+		MaxConcurrentEndpointOperations: 2,
+		NetworkMetadataDir:              "metadata",
+		MaxEndpointNameLength:           64,
+		EventSink:                       sink,
+		MetricsSink:                     &recordingMetricsSink{},
+		AttachDurationSamples:           100,
+		LogDuplicateCreates:             true,
+		FeatureGates:                    map[string]bool{FeatureHCNNamespaces: false},
+	}
+	nb := NewBridgeBuilder(overrides)
+
+	assert.Equal(t, overrides, nb.config())
+	assert.Equal(t, time.Second, nb.HCNNamespaceTimeout)
+
+	// Values below the minimum endpoint name length are raised.
+	nb = NewBridgeBuilder(Config{MaxEndpointNameLength: 8})
+	assert.Equal(t, hnsEndpointNameMinLength, nb.config().MaxEndpointNameLength)
+}
+
+func TestAcquireEndpointOperationDefaultLimit(t *testing.T) {
+	nb := &BridgeBuilder{}
+	release := nb.acquireEndpointOperation()
+	release()
+
+	assert.Equal(t, defaultMaxConcurrentEndpointOperations, cap(nb.endpointOperations))
+}
+
+func TestFindOrCreateEndpointReleasesEndpointOperation(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{Config: Config{MaxConcurrentEndpointOperations: 1}, hns: hns}
+	nw := newTestNetwork(t)
+
+	// Operations release their slot when they complete, including on failure.
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	require.NoError(t, nb.DeleteEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	assert.Error(t, nb.DeleteEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container2", "10.0.1.12")))
+	assert.Empty(t, nb.endpointOperations)
+}
+
+func TestFindOrCreateEndpointSNATExceptionLimit(t *testing.T) {
+	for _, tc := range []struct {
+		limit   int
+		action  SNATExceptionLimitAction
+		created bool
+	}{
+		// The network has 4 SNAT exceptions.
+		{limit: 4, action: SNATExceptionLimitError, created: true},
+		{limit: 3, action: SNATExceptionLimitWarn, created: true},
+		{limit: 3, action: SNATExceptionLimitError, created: false},
+		{limit: 0, action: SNATExceptionLimitError, created: true},
+	} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.SNATExceptionProvider = &testSNATExceptionProvider{exceptions: []string{"172.31.0.0/16"}}
+		nw.SNATExceptionLimit = tc.limit
+		nw.SNATExceptionLimitAction = tc.action
+
+		err := nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11"))
+		if tc.created {
+			assert.NoError(t, err, tc)
+			assert.Len(t, hns.endpoints, 1, tc)
+		} else {
+			assert.Error(t, err, tc)
+			assert.Empty(t, hns.endpoints, tc)
+		}
+	}
+}
+
+func TestFindOrCreateEndpointRequireExistingNetwork(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.RequireExistingNetwork = true
+
+	err := nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11"))
+	var notFoundErr *ErrNetworkNotFound
+	require.True(t, errors.As(err, &notFoundErr), "unexpected error %v", err)
+	assert.Equal(t, nb.generateHNSNetworkName(nw), notFoundErr.NetworkName)
+	assert.Empty(t, hns.endpoints)
+
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+	assert.Len(t, hns.endpoints, 1)
+}
+
+func TestFindOrCreateEndpointHCNNamespaceExists(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	nb := &BridgeBuilder{hns: hns}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+
+	require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), ep))
+
+	assert.Len(t, hns.namespaces["ns1"], 1)
+}
+
+func TestFindOrCreateEndpointHCNNamespaceMissing(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+
+	err := nb.FindOrCreateEndpoint(newTestNetwork(t), ep)
+	var notFoundErr *ErrHCNNamespaceNotFound
+	require.True(t, errors.As(err, &notFoundErr), "unexpected error %v", err)
+	assert.Equal(t, "ns1", notFoundErr.NamespaceID)
+
+	// The endpoint is not created.
+	assert.Empty(t, hns.endpoints)
+	assert.NotContains(t, hns.namespaces, "ns1")
+}
+
+func TestFindOrCreateEndpointCreateMissingHCNNamespace(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.CreateMissingHCNNamespaces = true
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-ns1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{hnsEndpoint.Id}, hns.namespaces["ns1"])
+}
+
+func TestDeleteEndpointHCNNamespaceDeleted(t *testing.T) {
+	hns := newMockHNS()
+	hns.namespaces["ns1"] = nil
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.NetNSName = "ns1"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	// Endpoints of deleted namespaces are not referenced anymore.
+	delete(hns.namespaces, "ns1")
+	require.NoError(t, nb.DeleteEndpoint(nw, ep))
+
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestDeleteEndpointHCNNamespaceStillReferenced(t *testing.T) {
+	for _, force := range []bool{false, true} {
+		hns := newMockHNS()
+		hns.namespaces["ns1"] = nil
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.ForceEndpointDelete = force
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		ep.NetNSName = "ns1"
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+		// The endpoint is also in another namespace.
+		hnsEndpoint, err := hns.GetHNSEndpointByName("cid-ns1")
+		require.NoError(t, err)
+		hns.namespaces["ns2"] = []string{hnsEndpoint.Id}
+
+		err = nb.DeleteEndpoint(nw, ep)
+		if force {
+			assert.NoError(t, err)
+			assert.Empty(t, hns.endpoints)
+		} else {
+			assert.Error(t, err)
+			assert.Contains(t, hns.endpoints, hnsEndpoint.Id)
+		}
+	}
+}
+
+func TestFindOrCreateNetworkAdapterNotFound(t *testing.T) {
+	hns := newMockHNS()
+	hns.networkCreateErr = errors.New("HNS failed with error : The parameter is incorrect.")
+	mac, _ := net.ParseMAC("12:34:56:78:9a:bd")
+	nb := &BridgeBuilder{
+		hns:      hns,
+		adapters: mockAdapters{{Name: "Ethernet 3", HardwareAddr: mac}},
+	}
+	nw := newTestNetwork(t)
+
+	err := nb.FindOrCreateNetwork(nw)
+	var adapterErr *ErrAdapterNotFound
+	require.True(t, errors.As(err, &adapterErr), "unexpected error %v", err)
+	assert.Equal(t, "Ethernet 2", adapterErr.LinkName)
+	assert.Equal(t, nw.SharedENI.GetMACAddress(), adapterErr.MACAddress)
+
+	// Other failures are returned as is.
+	nb.adapters = mockAdapters{{Name: "Ethernet 2", HardwareAddr: nw.SharedENI.GetMACAddress()}}
+	err = nb.FindOrCreateNetwork(nw)
+	assert.Equal(t, hns.networkCreateErr, err)
+}
+
+func TestFindOrCreateNetworkTypeUnsupported(t *testing.T) {
+	hns := newMockHNS()
+	hns.unsupportedNetworkType = hnsL2Bridge
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+
+	err := nb.FindOrCreateNetwork(nw)
+
+	var unsupportedErr *ErrNetworkTypeUnsupported
+	require.True(t, errors.As(err, &unsupportedErr), "unexpected error %v", err)
+	assert.Equal(t, hnsL2Bridge, unsupportedErr.NetworkType)
+	assert.Empty(t, hns.networks)
+
+	// Other failures are not reported as unsupported network types.
+	hns.networkCreateErr = errors.New("HNS failed with error : The parameter is incorrect.")
+	err = nb.FindOrCreateNetwork(nw)
+	assert.False(t, errors.As(err, &unsupportedErr))
+}
+
+func TestIsHNSNetworkTypeUnsupported(t *testing.T) {
+	for _, tc := range []struct {
+		message     string
+		unsupported bool
+	}{
+		{"HNS failed with error : The request is not supported.", true},
+		{"hnsCall failed in Win32: The request is not supported. (0x32)", true},
+		{"HNS failed with error : Network type l2bridge is not supported.", true},
+		{"HNS failed with error : The parameter is incorrect.", false},
+		{"HNS failed with error : Policy type OutBoundNAT is not supported.", false},
+		{"HNS failed with error : Unsupported network adapter.", false},
+		{"hnsCall failed in Win32: The parameter is incorrect. (0x57)", false},
+	} {
+		assert.Equal(t, tc.unsupported,
+			isHNSNetworkTypeUnsupported(errors.New(tc.message), hnsL2Bridge), tc.message)
+	}
+}
+
+func TestFindOrCreateNetworkFallbackNetworkType(t *testing.T) {
+	hns := newMockHNS()
+	hns.unsupportedNetworkType = hnsL2Bridge
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.FallbackNetworkType = hnsNAT
+
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Equal(t, hnsNAT, hnsNetwork.Type)
+
+	// The fallback is used only if the network's type is not supported.
+	hns = newMockHNS()
+	nb = &BridgeBuilder{hns: hns}
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	hnsNetwork, err = hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Equal(t, hnsL2Bridge, hnsNetwork.Type)
+}
+
+func TestFindOrCreateNetworkInvalidFallbackNetworkType(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.FallbackNetworkType = "overlay"
+
+	err := nb.FindOrCreateNetwork(nw)
+
+	assert.Equal(t, []string{"Network.FallbackNetworkType"}, getValidationErrorFields(t, err))
+	assert.Empty(t, hns.networks)
+}
+
+func TestFindOrCreateEndpointRequiresIPAddress(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+
+	err := nb.FindOrCreateEndpoint(newTestNetwork(t), &Endpoint{ContainerID: "container1"})
+	assert.Error(t, err)
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateEndpointAllocatesIPAddress(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{
+		hns:    hns,
+		eniIPs: newTestIPDiscoverer("10.0.1.30", "10.0.1.22", "10.0.1.20", "10.0.1.21"),
+	}
+	nw := newTestNetwork(t)
+	nw.AllocateEndpointIPs = true
+
+	// Allocations skip the secondary IP addresses used by existing endpoints.
+	hns.addEndpoint("cid-container0", nb.generateHNSNetworkName(nw)).IPAddress = net.ParseIP("10.0.1.20")
+
+	ep1 := &Endpoint{ContainerID: "container1"}
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep1))
+	ep2 := &Endpoint{ContainerID: "container2"}
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep2))
+
+	require.Len(t, ep1.IPAddresses, 1)
+	assert.Equal(t, "10.0.1.21/24", ep1.IPAddresses[0].String())
+	require.Len(t, ep2.IPAddresses, 1)
+	assert.Equal(t, "10.0.1.22/24", ep2.IPAddresses[0].String())
+
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.1.21", hnsEndpoint.IPAddress.String())
+	assert.Equal(t, uint8(24), hnsEndpoint.PrefixLength)
+
+	// Repeated calls return the allocated address.
+	ep1 = &Endpoint{ContainerID: "container1"}
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep1))
+	require.Len(t, ep1.IPAddresses, 1)
+	assert.Equal(t, "10.0.1.21/24", ep1.IPAddresses[0].String())
+}
+
+func TestFindOrCreateEndpointAllocatesIPAddressExhausted(t *testing.T) {
+	hns := newMockHNS()
+	// The secondary IP addresses include the gateway's and one outside the ENI subnet, which
+	// cannot be allocated.
+	nb := &BridgeBuilder{
+		hns:    hns,
+		eniIPs: newTestIPDiscoverer("10.0.1.20", "10.0.1.1", "10.0.2.20", "10.0.1.21"),
+	}
+	nw := newTestNetwork(t)
+	nw.AllocateEndpointIPs = true
+
+	for i, expected := range []string{"10.0.1.20", "10.0.1.21"} {
+		ep := &Endpoint{ContainerID: fmt.Sprintf("container%d", i)}
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+		assert.Equal(t, expected, ep.IPAddresses[0].IP.String())
+	}
+
+	// The free addresses of the ENI subnet that are not assigned to the ENI are never allocated.
+	err := nb.FindOrCreateEndpoint(nw, &Endpoint{ContainerID: "container2"})
+	var noFreeErr *ErrNoFreeIPAddress
+	assert.True(t, errors.As(err, &noFreeErr))
+	assert.Len(t, hns.endpoints, 2)
+}
+
+func TestFindOrCreateEndpointAllocatesIPAddressDiscoveryFailure(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns, eniIPs: &mockIPDiscoverer{err: errors.New("timeout")}}
+	nw := newTestNetwork(t)
+	nw.AllocateEndpointIPs = true
+
+	assert.Error(t, nb.FindOrCreateEndpoint(nw, &Endpoint{ContainerID: "container1"}))
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateEndpointPrefixLength(t *testing.T) {
+	for _, tc := range []struct {
+		mask         net.IPMask
+		prefixLength uint8
+		expected     uint8
+	}{
+		{mask: net.CIDRMask(24, 32), expected: 24},
+		{mask: net.CIDRMask(20, 32), expected: 20},
+		// Addresses without a mask are in the ENI subnet.
+		{mask: nil, expected: 24},
+		// Explicit prefix lengths override the mask.
+		{mask: nil, prefixLength: 26, expected: 26},
+		{mask: net.CIDRMask(20, 32), prefixLength: 26, expected: 26},
+	} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		ep.IPAddresses[0].Mask = tc.mask
+		ep.PrefixLength = tc.prefixLength
+
+		require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), ep))
+
+		hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, hnsEndpoint.PrefixLength, tc)
+	}
+}
+
+func TestFindOrCreateEndpointCNINetworkName(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	ep1 := newTestEndpoint("container1", "10.0.1.11")
+	ep1.CNINetworkName = "net1"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep1))
+	ep2 := newTestEndpoint("container2", "10.0.1.12")
+	ep2.CNINetworkName = "net2"
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep2))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container3", "10.0.1.13")))
+
+	// The CNI network name is read back from existing endpoints.
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	assert.Equal(t, "net1", ep.CNINetworkName)
+
+	endpointNames, err := nb.ListEndpointsByCNINetwork(nw, "net2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cid-container2"}, endpointNames)
+
+	endpointNames, err = nb.ListEndpointsByCNINetwork(nw, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cid-container3"}, endpointNames)
+}
+
+func TestGenerateSNATExceptionsServiceCIDR(t *testing.T) {
+	_, vpcCIDR, _ := net.ParseCIDR("10.0.0.0/16")
+	_, otherCIDR, _ := net.ParseCIDR("10.1.0.0/16")
+	for _, tc := range []struct {
+		vpcCIDRs   []net.IPNet
+		routeOnly  bool
+		exceptions []string
+	}{
+		{exceptions: []string{"10.0.1.0/24", "10.100.0.0/16"}},
+		{routeOnly: true, exceptions: []string{"10.0.1.0/24"}},
+		{vpcCIDRs: []net.IPNet{*vpcCIDR}, exceptions: []string{"10.0.0.0/16", "10.100.0.0/16"}},
+		{vpcCIDRs: []net.IPNet{*vpcCIDR}, routeOnly: true, exceptions: []string{"10.0.0.0/16"}},
+		// The ENI subnet is exempted if the VPC CIDRs do not contain it.
+		{
+			vpcCIDRs:   []net.IPNet{*otherCIDR},
+			routeOnly:  true,
+			exceptions: []string{"10.1.0.0/16", "10.0.1.0/24"},
+		},
+		{
+			vpcCIDRs:   []net.IPNet{*otherCIDR, *vpcCIDR},
+			routeOnly:  true,
+			exceptions: []string{"10.1.0.0/16", "10.0.0.0/16"},
+		},
+	} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.VPCCIDRs = tc.vpcCIDRs
+		nw.ServiceCIDR = "10.100.0.0/16"
+		nw.ServiceCIDRRouteOnly = tc.routeOnly
+		nw.DisableMulticastSNATExceptions = true
+
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+		hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+		require.NoError(t, err)
+		assert.Equal(t, tc.exceptions, getSNATExceptions(t, hnsEndpoint), tc)
+		// The service route is added either way.
+		assert.Contains(t, getRoutePolicies(t, hnsEndpoint), "10.100.0.0/16", tc)
+	}
+}
+
+func TestFindOrCreateEndpointFriendlyName(t *testing.T) {
+	for _, tc := range []struct {
+		friendlyName string
+		expected     string
+	}{
+		{friendlyName: "", expected: "container1"},
+		{friendlyName: "my-pod_1.web", expected: "my-pod_1.web"},
+		{friendlyName: "default/my pod", expected: "default-my-pod"},
+		{friendlyName: strings.Repeat("a", 200), expected: strings.Repeat("a", 128)},
+	} {
+		var request map[string]interface{}
+		nb := &BridgeBuilder{hns: &requestRecorder{hnsClient: newMockHNS(), endpointRequest: &request}}
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		ep.FriendlyName = tc.friendlyName
+
+		require.NoError(t, nb.FindOrCreateEndpoint(newTestNetwork(t), ep))
+
+		assert.Equal(t, tc.expected, request["PortFriendlyName"])
+	}
+}
+
+func TestDeleteEndpointReleaseSNATPorts(t *testing.T) {
+	for _, release := range []bool{false, true} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.ReleaseSNATPortsOnDelete = release
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+		hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+		require.NoError(t, err)
+
+		require.NoError(t, nb.DeleteEndpoint(nw, ep))
+
+		assert.Empty(t, hns.endpoints)
+		if release {
+			assert.Equal(t, []string{hnsEndpoint.Id}, hns.natReleases)
+		} else {
+			assert.Empty(t, hns.natReleases)
+		}
+	}
+}
+
+func TestDeleteEndpointReleaseSNATPortsFailureIsIgnored(t *testing.T) {
+	hns := newMockHNS()
+	hns.natReleaseErr = errors.New("not supported")
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.ReleaseSNATPortsOnDelete = true
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	require.NoError(t, nb.DeleteEndpoint(nw, ep))
+
+	assert.Empty(t, hns.endpoints)
+}
+
+func TestFindOrCreateNetworkAdapterIndex(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{
+		hns: hns,
+		adapters: mockAdapters{
+			{Index: 5, Name: "Ethernet 2"},
+			{Index: 7, Name: "Ethernet 4"},
+		},
+	}
+	nw := newTestNetwork(t)
+	nw.AdapterIndex = 7
+
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Equal(t, "Ethernet 4", hnsNetwork.NetworkAdapterName)
+}
+
+func TestFindOrCreateNetworkAdapterIndexNotFound(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns, adapters: mockAdapters{{Index: 5, Name: "Ethernet 2"}}}
+	nw := newTestNetwork(t)
+	nw.AdapterIndex = 7
+
+	err := nb.FindOrCreateNetwork(nw)
+	var adapterErr *ErrAdapterNotFound
+	require.True(t, errors.As(err, &adapterErr), "unexpected error %v", err)
+	assert.Equal(t, 7, adapterErr.Index)
+	assert.Empty(t, hns.networks)
+}
+
+func TestFindOrCreateNetworkWaitsUntilReady(t *testing.T) {
+	hns := newMockHNS()
+	hns.networkPollsUntilReady = 2
+	nb := &BridgeBuilder{Config: Config{NetworkReadyTimeout: 5 * time.Second}, hns: hns}
+
+	require.NoError(t, nb.FindOrCreateNetwork(newTestNetwork(t)))
+	assert.Equal(t, 0, hns.networkPollsUntilReady)
+}
+
+func TestFindOrCreateNetworkNotReady(t *testing.T) {
+	hns := newMockHNS()
+	hns.networkPollsUntilReady = 100
+	nb := &BridgeBuilder{Config: Config{NetworkReadyTimeout: time.Millisecond}, hns: hns}
+
+	assert.Error(t, nb.FindOrCreateNetwork(newTestNetwork(t)))
+}
+
+func TestFindOrCreateNetworkDoesNotWaitByDefault(t *testing.T) {
+	hns := newMockHNS()
+	hns.networkPollsUntilReady = 100
+	nb := &BridgeBuilder{hns: hns}
+
+	require.NoError(t, nb.FindOrCreateNetwork(newTestNetwork(t)))
+	assert.Equal(t, 100, hns.networkPollsUntilReady)
+}
+
+func TestFindOrCreateNetworkFallbackAdapter(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns, adapters: mockAdapters{{Name: "Ethernet 9"}}}
+	nw := newTestNetwork(t)
+	nw.FallbackAdapterName = "Ethernet 9"
+	networkName := nb.generateHNSNetworkName(nw)
+
+	// The network is bound to the fallback adapter while the shared ENI's adapter is absent.
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	hnsNetwork, err := hns.GetHNSNetworkByName(networkName)
+	require.NoError(t, err)
+	assert.Equal(t, "Ethernet 9", hnsNetwork.NetworkAdapterName)
+
+	// The network is rebound once the shared ENI's adapter returns.
+	nb.adapters = mockAdapters{{Name: "Ethernet 2"}, {Name: "Ethernet 9"}}
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	hnsNetwork, err = hns.GetHNSNetworkByName(networkName)
+	require.NoError(t, err)
+	assert.Equal(t, "Ethernet 2", hnsNetwork.NetworkAdapterName)
+	assert.Len(t, hns.networks, 1)
+}
+
+func TestFindOrCreateNetworkFallbackAdapterInUse(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns, adapters: mockAdapters{{Name: "Ethernet 9"}}}
+	nw := newTestNetwork(t)
+	nw.FallbackAdapterName = "Ethernet 9"
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	// Networks with endpoints stay bound to the fallback adapter.
+	nb.adapters = mockAdapters{{Name: "Ethernet 2"}, {Name: "Ethernet 9"}}
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Equal(t, "Ethernet 9", hnsNetwork.NetworkAdapterName)
+	assert.Len(t, hns.endpoints, 1)
+}
+
+// getValidationErrorFields returns the fields of the validation errors in an error.
+func getValidationErrorFields(t *testing.T, err error) []string {
+	var validationErrs ValidationErrors
+	require.True(t, errors.As(err, &validationErrs), "unexpected error %v", err)
+
+	var fields []string
+	for _, validationErr := range validationErrs {
+		fields = append(fields, validationErr.Field)
+	}
+	return fields
+}
+
+func TestFindOrCreateNetworkDNSServers(t *testing.T) {
+	for _, tc := range []struct {
+		dnsServers []string
+		disableDNS bool
+		valid      bool
+	}{
+		{dnsServers: nil, valid: true},
+		{dnsServers: []string{"10.0.0.2", "169.254.169.253"}, valid: true},
+		// Unreachable servers are only logged.
+		{dnsServers: []string{"127.0.0.1"}, valid: true},
+		{dnsServers: []string{"10.0.0.2", "10.0.0.300"}, valid: false},
+		{dnsServers: []string{"10.0.0.2,10.0.0.3"}, valid: false},
+		{dnsServers: []string{"dns.example.com"}, valid: false},
+		// Endpoints do not have IPv6 addresses.
+		{dnsServers: []string{"fd00::2"}, valid: false},
+		// The DNS servers are not used if the containers manage their own.
+		{dnsServers: []string{"dns.example.com"}, disableDNS: true, valid: true},
+	} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.DNSServers = tc.dnsServers
+		nw.DisableDNS = tc.disableDNS
+
+		err := nb.FindOrCreateNetwork(nw)
+
+		if tc.valid {
+			assert.NoError(t, err, tc.dnsServers)
+			assert.Len(t, hns.networks, 1, tc.dnsServers)
+		} else {
+			assert.Equal(t, []string{"Network.DNSServers"}, getValidationErrorFields(t, err),
+				tc.dnsServers)
+			assert.Empty(t, hns.networks, tc.dnsServers)
+		}
+	}
+}
+
+func TestGenerateHNSNetworkNameDiscriminator(t *testing.T) {
+	nb := &BridgeBuilder{}
+	nw1 := newTestNetwork(t)
+	nw2 := newTestNetwork(t)
+
+	// Networks on ENIs with the same MAC address have the same name by default.
+	assert.Equal(t, "vpcbr123456789abc", nb.generateHNSNetworkName(nw1))
+	assert.Equal(t, nb.generateHNSNetworkName(nw1), nb.generateHNSNetworkName(nw2))
+
+	nw1.NetworkNameDiscriminator = "subnet-1"
+	nw2.NetworkNameDiscriminator = "subnet-2"
+	assert.Equal(t, "vpcbr123456789abc-subnet-1", nb.generateHNSNetworkName(nw1))
+	assert.Equal(t, "vpcbr123456789abc-subnet-2", nb.generateHNSNetworkName(nw2))
+}
+
+func TestFindOrCreateNetworkValidationErrors(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.ENIIPAddresses = nil
+	nw.BridgeNetNSPath = "/var/run/netns/ns1"
+
+	err := nb.FindOrCreateNetwork(nw)
+
+	assert.Equal(t, []string{"Network.ENIIPAddresses", "Network.BridgeNetNSPath"},
+		getValidationErrorFields(t, err))
+	assert.Empty(t, hns.networks)
+}
+
+func TestFindOrCreateEndpointValidationErrors(t *testing.T) {
+	for _, tc := range []struct {
+		serviceCIDR string
+		ipAddresses []net.IPNet
+		vni         uint32
+		fields      []string
+	}{
+		{
+			ipAddresses: []net.IPNet{},
+			fields:      []string{"Endpoint.IPAddresses"},
+		},
+		{
+			ipAddresses: []net.IPNet{{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)}},
+			vni:         1,
+			fields:      []string{"Endpoint.IPAddresses", "Endpoint.VNI"},
+		},
+		{
+			serviceCIDR: "10.0.0.0/8",
+			vni:         1 << 24,
+			fields:      []string{"Endpoint.VNI", "Network.ServiceCIDR"},
+		},
+	} {
+		hns := newMockHNS()
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		nw.ServiceCIDR = tc.serviceCIDR
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		if tc.ipAddresses != nil {
+			ep.IPAddresses = tc.ipAddresses
+		}
+		ep.VNI = tc.vni
+
+		err := nb.FindOrCreateEndpoint(nw, ep)
+
+		assert.Equal(t, tc.fields, getValidationErrorFields(t, err))
+		assert.Empty(t, hns.endpoints)
+	}
+}
+
+func TestFindOrCreateEndpointOrchestratorNamespaces(t *testing.T) {
+	for _, tc := range []struct {
+		orchestrator Orchestrator
+		netNSName    string
+		valid        bool
+	}{
+		{orchestrator: OrchestratorUnknown, netNSName: "none", valid: true},
+		{orchestrator: OrchestratorUnknown, netNSName: "container:container0", valid: true},
+		{orchestrator: OrchestratorUnknown, netNSName: "ns1", valid: true},
+		{orchestrator: OrchestratorECS, netNSName: "none", valid: true},
+		{orchestrator: OrchestratorECS, netNSName: "container:container0", valid: true},
+		{orchestrator: OrchestratorECS, netNSName: "ns1", valid: false},
+		{orchestrator: OrchestratorKubernetes, netNSName: "none", valid: true},
+		{orchestrator: OrchestratorKubernetes, netNSName: "container:container0", valid: false},
+		{orchestrator: OrchestratorKubernetes, netNSName: "ns1", valid: true},
+	} {
+		hns := newMockHNS()
+		hns.namespaces["ns1"] = nil
+		nb := &BridgeBuilder{hns: hns}
+		nw := newTestNetwork(t)
+		ep0 := newTestEndpoint("container0", "10.0.1.11")
+		require.NoError(t, nb.FindOrCreateEndpoint(nw, ep0))
+
+		ep := newTestEndpoint("container1", "10.0.1.11")
+		ep.NetNSName = tc.netNSName
+		ep.Orchestrator = tc.orchestrator
+		err := nb.FindOrCreateEndpoint(nw, ep)
+
+		if tc.valid {
+			assert.NoError(t, err, tc)
+		} else {
+			assert.Equal(t, []string{"Endpoint.NetNSName"}, getValidationErrorFields(t, err), tc)
+		}
+	}
+}
+
+func TestReapplyEndpointPolicies(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.ServiceCIDR = "172.20.0.0/16"
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+	hnsEndpoint, err := hns.GetHNSEndpointByName("cid-container1")
+	require.NoError(t, err)
+	policies := hnsEndpoint.Policies
+
+	// Endpoints with the desired policies are not updated.
+	require.NoError(t, nb.ReapplyEndpointPolicies(nw, ep))
+	assert.Equal(t, 0, hns.endpointUpdates)
+
+	// All policies are restored in a single update.
+	hnsEndpoint.Policies = policies[:1]
+	require.NoError(t, nb.ReapplyEndpointPolicies(nw, ep))
+	assert.Equal(t, 1, hns.endpointUpdates)
+	assert.Equal(t, len(policies), len(hnsEndpoint.Policies))
+	assert.NoError(t, nb.CheckEndpoint(nw, ep))
+}
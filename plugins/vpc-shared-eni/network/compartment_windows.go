@@ -0,0 +1,91 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modiphlpapi                       = windows.NewLazySystemDLL("iphlpapi.dll")
+	procGetCurrentThreadCompartmentId = modiphlpapi.NewProc("GetCurrentThreadCompartmentId")
+	procSetCurrentThreadCompartmentId = modiphlpapi.NewProc("SetCurrentThreadCompartmentId")
+)
+
+// iphlpapiAddressLister implements the compartmentAddressLister interface by switching the
+// network compartment of the calling thread.
+type iphlpapiAddressLister struct{}
+
+// ListAddresses returns the IP addresses of the interfaces in a network compartment.
+func (l *iphlpapiAddressLister) ListAddresses(compartmentID uint32) ([]net.IP, error) {
+	err := procSetCurrentThreadCompartmentId.Find()
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		ipAddresses []net.IP
+		err         error
+	}
+	results := make(chan result, 1)
+
+	// The network compartment is a property of the thread. Query it from a goroutine locked to
+	// its thread, so that a thread left in the container's compartment exits with it.
+	go func() {
+		runtime.LockOSThread()
+
+		hostCompartmentID, _, _ := syscall.Syscall(procGetCurrentThreadCompartmentId.Addr(), 0, 0, 0, 0)
+		ret, _, _ := syscall.Syscall(
+			procSetCurrentThreadCompartmentId.Addr(), 1, uintptr(compartmentID), 0, 0)
+		if ret != 0 {
+			results <- result{err: fmt.Errorf("failed to enter compartment %d: %v",
+				compartmentID, syscall.Errno(ret))}
+			return
+		}
+
+		ipAddresses, err := l.listAddresses()
+
+		ret, _, _ = syscall.Syscall(procSetCurrentThreadCompartmentId.Addr(), 1, hostCompartmentID, 0, 0)
+		if ret == 0 {
+			runtime.UnlockOSThread()
+		}
+
+		results <- result{ipAddresses: ipAddresses, err: err}
+	}()
+
+	r := <-results
+	return r.ipAddresses, r.err
+}
+
+// listAddresses returns the IP addresses of the interfaces in the current thread's compartment.
+func (l *iphlpapiAddressLister) listAddresses() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ipAddresses []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ipAddresses = append(ipAddresses, ipNet.IP)
+		}
+	}
+
+	return ipAddresses, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"time"
+)
+
+const (
+	// defaultHCNNamespaceTimeout is the default value of HCNNamespaceTimeout.
+	defaultHCNNamespaceTimeout = 10 * time.Second
+	// defaultHCNNamespaceRetryInterval is the default value of HCNNamespaceRetryInterval.
+	defaultHCNNamespaceRetryInterval = 100 * time.Millisecond
+	// defaultHNSGlobalsTimeout is the default value of HNSGlobalsTimeout.
+	defaultHNSGlobalsTimeout = 5 * time.Second
+	// defaultEndpointRetryInterval is the default value of EndpointRetryInterval.
+	defaultEndpointRetryInterval = 500 * time.Millisecond
+	// defaultMaxConcurrentEndpointOperations is the default value of
+	// MaxConcurrentEndpointOperations.
+	defaultMaxConcurrentEndpointOperations = 8
+)
+
+// Config is the configuration of a BridgeBuilder. Zero values select the defaults documented on
+// each field, so that the zero Config is a working configuration.
+type Config struct {
+	// HCNNamespaceTimeout is the maximum time spent retrying a failed HCN namespace operation.
+	// A zero value selects the default timeout of 10 seconds.
+	HCNNamespaceTimeout time.Duration
+	// HCNNamespaceRetryInterval is the initial interval between retries of a failed HCN
+	// namespace operation, doubled after each retry. A zero value selects the default interval
+	// of 100 milliseconds.
+	HCNNamespaceRetryInterval time.Duration
+	// HNSGlobalsTimeout is the maximum time spent retrying a failed query of the HNS version, such
+	// as while HNS restarts. A zero value selects the default timeout of 5 seconds.
+	HNSGlobalsTimeout time.Duration
+	// InfraEndpointTimeout is the maximum time an app container waits for the endpoint of its
+	// infra container, which can still be being created. A zero value fails immediately.
+	InfraEndpointTimeout time.Duration
+	// NetworkReadyTimeout is the maximum time FindOrCreateNetwork waits for a new network to
+	// become usable, as HNS can return before the network's subnet is ready for endpoints. A
+	// zero value does not wait.
+	NetworkReadyTimeout time.Duration
+	// EndpointReadyTimeout is the maximum time FindOrCreateEndpoint waits for a new endpoint's IP
+	// address to be assigned inside its container, which can lag behind HNS attaching the
+	// endpoint. Only endpoints in HCN namespaces can be queried. A zero value does not wait.
+	EndpointReadyTimeout time.Duration
+	// EndpointRetryErrors are the classes of HNS failures for which FindOrCreateEndpoint retries
+	// the whole operation, such as "system is busy". Each class is matched against the error
+	// messages, ignoring case. The endpoint created by a failed attempt is deleted before the
+	// next attempt.
+	EndpointRetryErrors []string
+	// EndpointRetryLimit is the maximum number of times FindOrCreateEndpoint is retried after an
+	// error in EndpointRetryErrors. A zero value does not retry.
+	EndpointRetryLimit int
+	// EndpointRetryInterval is the interval between the attempts of FindOrCreateEndpoint. A zero
+	// value selects the default interval of 500 milliseconds.
+	EndpointRetryInterval time.Duration
+	// MaxConcurrentEndpointOperations is the maximum number of endpoint creates, deletes and
+	// attaches running in HNS at the same time. Operations beyond the limit wait for their turn.
+	// Network operations and queries are not limited. A zero value selects the default limit of 8.
+	MaxConcurrentEndpointOperations int
+	// NetworkMetadataDir, if set, is the directory storing a copy of the metadata of the HNS
+	// networks created by the builder, read back when HNS does not return the metadata of an
+	// existing network. An empty value relies on HNS alone.
+	NetworkMetadataDir string
+	// MaxEndpointNameLength is the maximum length of the names of HNS endpoints. Longer names,
+	// generated from long endpoint keys such as task ARNs, are truncated and suffixed with a hash
+	// of the full name to keep them unique. A zero value selects the default length of 256, and
+	// values below 32 are raised to 32.
+	MaxEndpointNameLength int
+	// EventSink receives the events of the networks and endpoints created and deleted by the
+	// builder. A nil value discards the events.
+	EventSink EventSink
+	// MetricsSink receives the metrics of the operations run by the builder. A nil value
+	// discards the metrics.
+	MetricsSink MetricsSink
+	// LogDuplicateCreates logs the benign duplicate creates of endpoints already attached at
+	// info level. By default they are logged at debug level, as orchestrators repeat them while
+	// containers crash loop, and counted by the metrics sink.
+	LogDuplicateCreates bool
+	// FeatureGates enables or disables the optional features of the builder by name, such as
+	// FeatureHCNNamespaces. Features not listed keep their default, and unknown names are
+	// ignored. Requests using a disabled feature fail validation.
+	FeatureGates map[string]bool
+	// AttachDurationSamples is the number of recent endpoint attach durations kept for each
+	// namespace type, summarized by AttachDurations. A zero value keeps none.
+	AttachDurationSamples int
+}
+
+// NewBridgeBuilder returns a new BridgeBuilder with the given configuration.
+func NewBridgeBuilder(config Config) *BridgeBuilder {
+	return &BridgeBuilder{Config: config}
+}
+
+// withDefaults returns the configuration with the defaults applied to its zero values.
+func (c Config) withDefaults() Config {
+	if c.HCNNamespaceTimeout == 0 {
+		c.HCNNamespaceTimeout = defaultHCNNamespaceTimeout
+	}
+	if c.HCNNamespaceRetryInterval == 0 {
+		c.HCNNamespaceRetryInterval = defaultHCNNamespaceRetryInterval
+	}
+	if c.HNSGlobalsTimeout == 0 {
+		c.HNSGlobalsTimeout = defaultHNSGlobalsTimeout
+	}
+	if c.EndpointRetryInterval == 0 {
+		c.EndpointRetryInterval = defaultEndpointRetryInterval
+	}
+	if c.MaxConcurrentEndpointOperations <= 0 {
+		c.MaxConcurrentEndpointOperations = defaultMaxConcurrentEndpointOperations
+	}
+	if c.MaxEndpointNameLength == 0 {
+		c.MaxEndpointNameLength = hnsEndpointNameMaxLength
+	} else if c.MaxEndpointNameLength < hnsEndpointNameMinLength {
+		c.MaxEndpointNameLength = hnsEndpointNameMinLength
+	}
+	if c.EventSink == nil {
+		c.EventSink = &noopEventSink{}
+	}
+	if c.MetricsSink == nil {
+		c.MetricsSink = &noopMetricsSink{}
+	}
+
+	return c
+}
+
+// config returns the builder's configuration, with the defaults applied.
+func (nb *BridgeBuilder) config() Config {
+	return nb.Config.withDefaults()
+}
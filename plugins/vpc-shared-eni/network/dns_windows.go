@@ -0,0 +1,204 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/Microsoft/hcsshim"
+	log "github.com/cihub/seelog"
+)
+
+// generateHNSNetworkDNS returns the DNS server list and DNS suffix of the HNS network, which
+// are the defaults of its endpoints.
+func (nb *BridgeBuilder) generateHNSNetworkDNS(nw *Network) (string, string) {
+	if nw.DisableDNS {
+		return "", ""
+	}
+
+	return strings.Join(nw.DNSServers, ","), nb.generateDNSSuffix(nw)
+}
+
+// generateDNSSuffix returns the DNS suffix field of the HNS V1 objects in the network.
+func (nb *BridgeBuilder) generateDNSSuffix(nw *Network) string {
+	dnsSuffixSearchList := nb.generateDNSSuffixSearchList(nw)
+	if nw.DNSSuffixMode == DNSSuffixSearchList {
+		return strings.Join(dnsSuffixSearchList, ",")
+	}
+
+	return nb.getPrimaryDNSSuffix(dnsSuffixSearchList)
+}
+
+// getPrimaryDNSSuffix returns the primary DNS suffix of a search list, which is its first entry.
+func (nb *BridgeBuilder) getPrimaryDNSSuffix(dnsSuffixSearchList []string) string {
+	if len(dnsSuffixSearchList) == 0 {
+		return ""
+	}
+
+	return dnsSuffixSearchList[0]
+}
+
+// shouldRecreateHNSNetworkDNS compares the DNS settings of an existing HNS network with the
+// requested ones, logs the differences, and returns whether the network must be recreated
+// according to the network's DNSMismatchAction. HNS V1 networks cannot be updated in place.
+// Networks created without DNS settings, including those created before the network's DNS
+// settings were applied, are not checked.
+func (nb *BridgeBuilder) shouldRecreateHNSNetworkDNS(
+	nw *Network, hnsNetwork *hcsshim.HNSNetwork, metadata map[string]string) bool {
+	if metadata[hnsNetworkDNSKey] == "" {
+		return false
+	}
+
+	dnsServerList, dnsSuffix := nb.generateHNSNetworkDNS(nw)
+	if hnsNetwork.DNSServerList == dnsServerList && hnsNetwork.DNSSuffix == dnsSuffix {
+		return false
+	}
+
+	log.Warnf("HNS network %s has DNS servers %q and suffixes %q, expected %q and %q.",
+		hnsNetwork.Name, hnsNetwork.DNSServerList, hnsNetwork.DNSSuffix, dnsServerList, dnsSuffix)
+
+	if nw.DNSMismatchAction != NetworkMismatchRecreate {
+		return false
+	}
+
+	// Deleting a network in use would disconnect its endpoints.
+	hnsEndpoints, err := nb.listHNSEndpoints(hnsNetwork.Name)
+	if err != nil || len(hnsEndpoints) != 0 {
+		log.Warnf("Not recreating HNS network %s because it has endpoints.", hnsNetwork.Name)
+		return false
+	}
+
+	return true
+}
+
+// hnsEndpointDNSRequest is an HNS endpoint update request for the endpoint's DNS settings.
+// Empty values are sent to clear the settings.
+type hnsEndpointDNSRequest struct {
+	DNSServerList string
+	DNSSuffix     string
+}
+
+// generateHNSEndpointDNS returns the DNS server list and DNS suffix of an HNS endpoint in the
+// network, unless the containers manage their own DNS settings.
+func (nb *BridgeBuilder) generateHNSEndpointDNS(nw *Network, ep *Endpoint) (string, string) {
+	if nw.DisableDNS || ep.DisableDNS {
+		return "", ""
+	}
+
+	return strings.Join(nw.DNSServers, ","), nb.generateDNSSuffix(nw)
+}
+
+// checkEndpointDNS returns ErrEndpointDNSMismatch if an existing HNS endpoint has other DNS
+// settings than requested. The DNS servers and suffixes are compared regardless of their order.
+func (nb *BridgeBuilder) checkEndpointDNS(
+	nw *Network, ep *Endpoint, hnsEndpoint *hcsshim.HNSEndpoint) error {
+	dnsServerList, dnsSuffix := nb.generateHNSEndpointDNS(nw, ep)
+	if equalDNSLists(hnsEndpoint.DNSServerList, dnsServerList) &&
+		equalDNSLists(hnsEndpoint.DNSSuffix, dnsSuffix) {
+		return nil
+	}
+
+	return &ErrEndpointDNSMismatch{
+		EndpointName:          hnsEndpoint.Name,
+		DNSServerList:         hnsEndpoint.DNSServerList,
+		DNSSuffix:             hnsEndpoint.DNSSuffix,
+		ExpectedDNSServerList: dnsServerList,
+		ExpectedDNSSuffix:     dnsSuffix,
+	}
+}
+
+// equalDNSLists returns whether two comma-separated lists of DNS servers or suffixes have the
+// same entries, in any order.
+func equalDNSLists(a, b string) bool {
+	split := func(list string) []string {
+		var entries []string
+		for _, entry := range strings.Split(list, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, strings.ToLower(entry))
+			}
+		}
+		sort.Strings(entries)
+		return entries
+	}
+
+	return strings.Join(split(a), ",") == strings.Join(split(b), ",")
+}
+
+// UpdateEndpointDNS updates the DNS settings of an existing HNS endpoint in place, if they differ
+// from those that would be applied when creating the endpoint in the network.
+func (nb *BridgeBuilder) UpdateEndpointDNS(nw *Network, ep *Endpoint) error {
+	_, namespaceIdentifier := nb.getNamespaceIdentifier(ep)
+	endpointName := nb.generateHNSEndpointName(ep, namespaceIdentifier)
+
+	hnsEndpoint, err := nb.client().GetHNSEndpointByName(endpointName)
+	if err != nil {
+		log.Errorf("Failed to find HNS endpoint %s: %v.", endpointName, err)
+		return err
+	}
+
+	if nb.checkEndpointDNS(nw, ep, hnsEndpoint) == nil {
+		return nil
+	}
+
+	return nb.updateHNSEndpointDNS(nw, ep, hnsEndpoint)
+}
+
+// updateHNSEndpointDNS replaces the DNS settings of an HNS endpoint with the requested ones.
+func (nb *BridgeBuilder) updateHNSEndpointDNS(
+	nw *Network, ep *Endpoint, hnsEndpoint *hcsshim.HNSEndpoint) error {
+	dnsServerList, dnsSuffix := nb.generateHNSEndpointDNS(nw, ep)
+	buf, err := json.Marshal(hnsEndpointDNSRequest{
+		DNSServerList: dnsServerList,
+		DNSSuffix:     dnsSuffix,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Updating DNS settings of HNS endpoint %s.", hnsEndpoint.Name)
+	_, err = nb.client().HNSEndpointRequest("POST", hnsEndpoint.Id, string(buf))
+	if err != nil {
+		log.Errorf("Failed to update HNS endpoint DNS settings: %v.", err)
+		return err
+	}
+
+	return nil
+}
+
+// generateDNSSuffixSearchList returns the DNS suffix search list of an endpoint in the network.
+// Endpoints have a single list shared by all address families, so the per-family lists are
+// combined in order, IPv4 first, without duplicates.
+func (nb *BridgeBuilder) generateDNSSuffixSearchList(nw *Network) []string {
+	ipv4List := nw.IPv4DNSSuffixSearchList
+	if ipv4List == nil {
+		ipv4List = nw.DNSSuffixSearchList
+	}
+	ipv6List := nw.IPv6DNSSuffixSearchList
+	if ipv6List == nil {
+		ipv6List = nw.DNSSuffixSearchList
+	}
+
+	var dnsSuffixSearchList []string
+	found := make(map[string]bool)
+	for _, suffix := range append(append([]string{}, ipv4List...), ipv6List...) {
+		if !found[suffix] {
+			found[suffix] = true
+			dnsSuffixSearchList = append(dnsSuffixSearchList, suffix)
+		}
+	}
+
+	return dnsSuffixSearchList
+}
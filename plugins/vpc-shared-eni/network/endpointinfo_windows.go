@@ -0,0 +1,76 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"net"
+
+	log "github.com/cihub/seelog"
+)
+
+// EndpointInfo describes an HNS endpoint, as decoded from HNS.
+type EndpointInfo struct {
+	// ID and Name are the ID and name of the HNS endpoint.
+	ID   string
+	Name string
+	// NetworkName is the name of the HNS network of the endpoint.
+	NetworkName string
+	// IPAddress and PrefixLength are the IP address of the endpoint and the prefix length of its
+	// subnet.
+	IPAddress    net.IP
+	PrefixLength uint8
+	// MACAddress is the MAC address of the endpoint, if valid.
+	MACAddress net.HardwareAddr
+	// DNSServerList and DNSSuffix are the comma-separated DNS settings of the endpoint.
+	DNSServerList string
+	DNSSuffix     string
+	// Policies are the policies of the endpoint, as returned by HNS.
+	Policies []json.RawMessage
+	// CompartmentID is the network compartment of the endpoint's namespace. It is zero for
+	// endpoints in container namespaces.
+	CompartmentID uint32
+}
+
+// FindOrCreateEndpointInfo finds or creates the HNS endpoint in the network like
+// FindOrCreateEndpoint, and returns the HNS endpoint. Found and created endpoints are
+// described alike.
+func (nb *BridgeBuilder) FindOrCreateEndpointInfo(
+	nw *Network, ep *Endpoint) (*EndpointInfo, error) {
+	err := nb.FindOrCreateEndpoint(nw, ep)
+	if err != nil {
+		return nil, err
+	}
+
+	_, namespaceIdentifier := nb.getNamespaceIdentifier(ep)
+	endpointName := nb.generateHNSEndpointName(ep, namespaceIdentifier)
+	hnsEndpoint, err := nb.client().GetHNSEndpointByName(endpointName)
+	if err != nil {
+		log.Errorf("Failed to find HNS endpoint %s: %v.", endpointName, err)
+		return nil, err
+	}
+
+	return &EndpointInfo{
+		ID:            hnsEndpoint.Id,
+		Name:          hnsEndpoint.Name,
+		NetworkName:   hnsEndpoint.VirtualNetworkName,
+		IPAddress:     hnsEndpoint.IPAddress,
+		PrefixLength:  hnsEndpoint.PrefixLength,
+		MACAddress:    ep.MACAddress,
+		DNSServerList: hnsEndpoint.DNSServerList,
+		DNSSuffix:     hnsEndpoint.DNSSuffix,
+		Policies:      hnsEndpoint.Policies,
+		CompartmentID: ep.CompartmentID,
+	}, nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/cihub/seelog"
+)
+
+// compartmentAddressLister lists the IP addresses in a network compartment, i.e. as seen from
+// inside a container. It exists so that the queries can be replaced in unit tests.
+type compartmentAddressLister interface {
+	ListAddresses(compartmentID uint32) ([]net.IP, error)
+}
+
+// compartmentAddressLister returns the compartment address lister used by the builder.
+func (nb *BridgeBuilder) compartmentAddressLister() compartmentAddressLister {
+	if nb.compartments == nil {
+		return &iphlpapiAddressLister{}
+	}
+
+	return nb.compartments
+}
+
+// waitForEndpointReady polls the network compartment of an endpoint until its IP address is
+// assigned to an interface in the compartment, or times out. Containers can bind sockets to the
+// address as soon as this returns.
+func (nb *BridgeBuilder) waitForEndpointReady(compartmentID uint32, ipAddress net.IP) error {
+	err := retryOperation("Endpoint readiness check", nb.EndpointReadyTimeout,
+		endpointReadyRetryInterval, endpointReadyMaxRetryInterval, func() error {
+			ipAddresses, err := nb.compartmentAddressLister().ListAddresses(compartmentID)
+			if err != nil {
+				return err
+			}
+			for _, ip := range ipAddresses {
+				if ip.Equal(ipAddress) {
+					return nil
+				}
+			}
+			return fmt.Errorf("IP address %s is not assigned in compartment %d yet",
+				ipAddress, compartmentID)
+		})
+	if err != nil {
+		log.Errorf("Endpoint in compartment %d is not ready: %v.", compartmentID, err)
+	}
+
+	return err
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
+)
+
+const (
+	// imdsEndpoint is the base URL of the EC2 instance metadata service.
+	imdsEndpoint = "http://169.254.169.254/latest"
+	// imdsTokenTTLSeconds is the lifetime of the instance metadata session tokens.
+	imdsTokenTTLSeconds = "60"
+	// imdsTimeout is the timeout of instance metadata requests.
+	imdsTimeout = 2 * time.Second
+)
+
+// eniIPDiscoverer discovers the IP addresses assigned to an ENI.
+// It exists so that the discovery can be replaced in unit tests.
+type eniIPDiscoverer interface {
+	GetSecondaryIPAddresses(sharedENI *eni.ENI) ([]net.IP, error)
+}
+
+// imdsIPDiscoverer implements the eniIPDiscoverer interface using the EC2 instance metadata service.
+type imdsIPDiscoverer struct {
+	endpoint string
+	client   *http.Client
+}
+
+// newIMDSIPDiscoverer returns a new imdsIPDiscoverer for the given metadata service endpoint.
+func newIMDSIPDiscoverer(endpoint string) *imdsIPDiscoverer {
+	return &imdsIPDiscoverer{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: imdsTimeout},
+	}
+}
+
+// GetSecondaryIPAddresses returns the secondary IPv4 addresses assigned to an ENI.
+func (d *imdsIPDiscoverer) GetSecondaryIPAddresses(sharedENI *eni.ENI) ([]net.IP, error) {
+	// Start an IMDSv2 session.
+	token, err := d.request("PUT", "/api/token",
+		"X-aws-ec2-metadata-token-ttl-seconds", imdsTokenTTLSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	path := fmt.Sprintf("/meta-data/network/interfaces/macs/%s/local-ipv4s", sharedENI.GetMACAddress())
+	body, err := d.request("GET", path, "X-aws-ec2-metadata-token", token)
+	if err != nil {
+		return nil, err
+	}
+
+	// The primary IP address is listed first.
+	var ipAddresses []net.IP
+	for i, field := range strings.Fields(body) {
+		ipAddress := net.ParseIP(field)
+		if ipAddress == nil {
+			return nil, fmt.Errorf("invalid IP address %s in instance metadata", field)
+		}
+		if i > 0 {
+			ipAddresses = append(ipAddresses, ipAddress)
+		}
+	}
+
+	return ipAddresses, nil
+}
+
+// request sends a request with a header to the metadata service and returns the response body.
+func (d *imdsIPDiscoverer) request(method, path, header, value string) (string, error) {
+	req, err := http.NewRequest(method, d.endpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(header, value)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata request %s %s failed with status %s",
+			method, path, resp.Status)
+	}
+
+	return string(body), nil
+}
+
+// ipDiscoverer returns the ENI IP address discoverer used by the builder.
+func (nb *BridgeBuilder) ipDiscoverer() eniIPDiscoverer {
+	if nb.eniIPs == nil {
+		return newIMDSIPDiscoverer(imdsEndpoint)
+	}
+
+	return nb.eniIPs
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build !integration_test && !e2e_test
+// +build !integration_test,!e2e_test
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockIPDiscoverer is an eniIPDiscoverer returning fixed secondary IP addresses.
+type mockIPDiscoverer struct {
+	ipAddresses []net.IP
+	err         error
+	calls       int
+}
+
+func (d *mockIPDiscoverer) GetSecondaryIPAddresses(sharedENI *eni.ENI) ([]net.IP, error) {
+	d.calls++
+	return d.ipAddresses, d.err
+}
+
+func TestIMDSIPDiscoverer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/api/token":
+			fmt.Fprint(w, "token")
+		case r.Method == "GET" && r.Header.Get("X-aws-ec2-metadata-token") == "token" &&
+			r.URL.Path == "/meta-data/network/interfaces/macs/12:34:56:78:9a:bc/local-ipv4s":
+			fmt.Fprint(w, "10.0.1.10\n10.0.1.20\n10.0.1.21")
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	mac, _ := net.ParseMAC("12:34:56:78:9a:bc")
+	sharedENI, err := eni.NewENI("Ethernet 2", mac)
+	require.NoError(t, err)
+
+	ipAddresses, err := newIMDSIPDiscoverer(server.URL).GetSecondaryIPAddresses(sharedENI)
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.1.20"), net.ParseIP("10.0.1.21")}, ipAddresses)
+}
+
+func TestIMDSIPDiscovererRequestFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	mac, _ := net.ParseMAC("12:34:56:78:9a:bc")
+	sharedENI, err := eni.NewENI("Ethernet 2", mac)
+	require.NoError(t, err)
+
+	_, err = newIMDSIPDiscoverer(server.URL).GetSecondaryIPAddresses(sharedENI)
+	assert.Error(t, err)
+}
@@ -0,0 +1,268 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Microsoft/hcsshim"
+)
+
+// ErrHNSVersionUnsupported is returned when the HNS version is older than the minimum supported.
+type ErrHNSVersionUnsupported struct {
+	// Version is the version of HNS running on the host.
+	Version hcsshim.HNSVersion
+	// MinVersion is the minimum version of HNS supported by this plugin.
+	MinVersion hcsshim.HNSVersion
+}
+
+// Error returns a message telling the user how to resolve the error.
+func (e *ErrHNSVersionUnsupported) Error() string {
+	return fmt.Sprintf(
+		"HNS version %d.%d is older than the minimum supported version %d.%d, "+
+			"upgrade Windows to build %d or later",
+		e.Version.Major, e.Version.Minor, e.MinVersion.Major, e.MinVersion.Minor, hnsMinWindowsBuild)
+}
+
+// ValidationError describes an invalid network or endpoint setting.
+type ValidationError struct {
+	// Field is the path of the setting, such as "Endpoint.IPAddresses".
+	Field string
+	// Reason describes why the setting is invalid.
+	Reason string
+}
+
+// Error returns a message describing the invalid setting.
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Reason)
+}
+
+// ValidationErrors is returned when one or more network or endpoint settings are invalid.
+type ValidationErrors []*ValidationError
+
+// Error returns a message describing all invalid settings.
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+
+	return "invalid settings: " + strings.Join(messages, "; ")
+}
+
+// add returns the list with an error for the given setting appended.
+func (e ValidationErrors) add(field, reason string) ValidationErrors {
+	return append(e, &ValidationError{Field: field, Reason: reason})
+}
+
+// errorOrNil returns the list as an error, or nil if it is empty.
+func (e ValidationErrors) errorOrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// ErrNetworkNotFound is returned when creating an endpoint in a network that does not exist.
+type ErrNetworkNotFound struct {
+	// NetworkName is the name of the HNS network.
+	NetworkName string
+}
+
+// Error returns a message telling the user how to resolve the error.
+func (e *ErrNetworkNotFound) Error() string {
+	return fmt.Sprintf("HNS network %s does not exist, create the network before its endpoints",
+		e.NetworkName)
+}
+
+// ErrNetworkTypeUnsupported is returned when HNS does not support the type of a network.
+type ErrNetworkTypeUnsupported struct {
+	// NetworkType is the type of the HNS network.
+	NetworkType string
+	// Err is the error returned by HNS.
+	Err error
+}
+
+// Error returns a message telling the user how to resolve the error.
+func (e *ErrNetworkTypeUnsupported) Error() string {
+	return fmt.Sprintf("HNS network type %s is not supported on this host, "+
+		"configure a fallback network type: %v", e.NetworkType, e.Err)
+}
+
+// Unwrap returns the error returned by HNS.
+func (e *ErrNetworkTypeUnsupported) Unwrap() error {
+	return e.Err
+}
+
+// ErrHCNNamespaceNotFound is returned when creating an endpoint in an HCN namespace that does not exist.
+type ErrHCNNamespaceNotFound struct {
+	// NamespaceID is the ID of the HCN namespace.
+	NamespaceID string
+}
+
+// Error returns a message describing the error.
+func (e *ErrHCNNamespaceNotFound) Error() string {
+	return fmt.Sprintf("HCN namespace %s does not exist", e.NamespaceID)
+}
+
+// ErrAdapterNotFound is returned when the network adapter of the shared ENI is not on the host.
+type ErrAdapterNotFound struct {
+	// Index is the interface index of the network adapter, if selected by index.
+	Index int
+	// LinkName is the expected name of the network adapter.
+	LinkName string
+	// MACAddress is the MAC address of the shared ENI.
+	MACAddress net.HardwareAddr
+}
+
+// Error returns a message telling the user how to resolve the error.
+func (e *ErrAdapterNotFound) Error() string {
+	if e.Index != 0 {
+		return fmt.Sprintf("network adapter with interface index %d not found, "+
+			"check that the ENI is attached to the instance", e.Index)
+	}
+	return fmt.Sprintf("network adapter %s with MAC address %s not found, "+
+		"check that the ENI is attached to the instance", e.LinkName, e.MACAddress)
+}
+
+// ErrEndpointIPMismatch is returned when an existing endpoint has a different IP address than
+// requested.
+type ErrEndpointIPMismatch struct {
+	// EndpointName is the name of the existing HNS endpoint.
+	EndpointName string
+	// IPAddress is the IP address of the existing HNS endpoint.
+	IPAddress net.IP
+	// RequestedIPAddress is the IP address requested for the endpoint.
+	RequestedIPAddress net.IP
+}
+
+// Error returns a message describing the mismatch.
+func (e *ErrEndpointIPMismatch) Error() string {
+	return fmt.Sprintf("existing HNS endpoint %s has IP address %s, requested %s",
+		e.EndpointName, e.IPAddress, e.RequestedIPAddress)
+}
+
+// ErrEndpointSubnetMismatch is returned when an existing endpoint has an IP address outside the
+// ENI subnet.
+type ErrEndpointSubnetMismatch struct {
+	// EndpointName is the name of the existing HNS endpoint.
+	EndpointName string
+	// IPAddress is the IP address of the existing HNS endpoint.
+	IPAddress net.IP
+	// Subnet is the ENI subnet.
+	Subnet string
+}
+
+// Error returns a message describing the mismatch.
+func (e *ErrEndpointSubnetMismatch) Error() string {
+	return fmt.Sprintf("existing HNS endpoint %s has IP address %s outside subnet %s",
+		e.EndpointName, e.IPAddress, e.Subnet)
+}
+
+// ErrManagementAdapter is returned when creating a network on the adapter of the host's primary
+// management interface.
+type ErrManagementAdapter struct {
+	// AdapterName is the name of the adapter.
+	AdapterName string
+}
+
+// Error returns a message describing the adapter.
+func (e *ErrManagementAdapter) Error() string {
+	return fmt.Sprintf("adapter %s is the host's management interface", e.AdapterName)
+}
+
+// ErrEndpointDNSMismatch is returned when an existing endpoint has other DNS settings than
+// requested.
+type ErrEndpointDNSMismatch struct {
+	// EndpointName is the name of the existing HNS endpoint.
+	EndpointName string
+	// DNSServerList and DNSSuffix are the DNS settings of the existing HNS endpoint.
+	DNSServerList string
+	DNSSuffix     string
+	// ExpectedDNSServerList and ExpectedDNSSuffix are the requested DNS settings.
+	ExpectedDNSServerList string
+	ExpectedDNSSuffix     string
+}
+
+// Error returns a message describing the mismatch.
+func (e *ErrEndpointDNSMismatch) Error() string {
+	return fmt.Sprintf(
+		"existing HNS endpoint %s has DNS servers %q and suffixes %q, expected %q and %q",
+		e.EndpointName, e.DNSServerList, e.DNSSuffix, e.ExpectedDNSServerList, e.ExpectedDNSSuffix)
+}
+
+// ErrEndpointNamespaceMismatch is returned when an existing endpoint is attached to another HCN
+// namespace than requested.
+type ErrEndpointNamespaceMismatch struct {
+	// EndpointName is the name of the existing HNS endpoint.
+	EndpointName string
+	// NamespaceID is the ID of the HCN namespace the endpoint is attached to.
+	NamespaceID string
+	// RequestedNamespaceID is the ID of the HCN namespace requested for the endpoint.
+	RequestedNamespaceID string
+	// Live is whether the namespace the endpoint is attached to still exists.
+	Live bool
+}
+
+// Error returns a message describing the mismatch.
+func (e *ErrEndpointNamespaceMismatch) Error() string {
+	state := "stale"
+	if e.Live {
+		state = "live"
+	}
+	return fmt.Sprintf("existing HNS endpoint %s is attached to %s ns %s, requested %s",
+		e.EndpointName, state, e.NamespaceID, e.RequestedNamespaceID)
+}
+
+// ErrEndpointMACInvalid is returned when HNS reports an endpoint MAC address that fails to parse.
+type ErrEndpointMACInvalid struct {
+	// EndpointName is the name of the HNS endpoint.
+	EndpointName string
+	// MACAddress is the MAC address reported by HNS.
+	MACAddress string
+}
+
+// Error returns a message describing the invalid MAC address.
+func (e *ErrEndpointMACInvalid) Error() string {
+	return fmt.Sprintf("HNS endpoint %s has invalid MAC address %q", e.EndpointName, e.MACAddress)
+}
+
+// ErrEndpointIPConflict is returned when an endpoint requests an IP address owned by the host.
+type ErrEndpointIPConflict struct {
+	// IPAddress is the IP address requested by the endpoint.
+	IPAddress net.IP
+	// Owner describes the host interface that owns the IP address.
+	Owner string
+}
+
+// Error returns a message describing the conflict.
+func (e *ErrEndpointIPConflict) Error() string {
+	return fmt.Sprintf("endpoint IP address %s is already owned by the %s", e.IPAddress, e.Owner)
+}
+
+// ErrNoFreeIPAddress is returned when allocating an endpoint IP address while all secondary IP
+// addresses of the shared ENI are in use.
+type ErrNoFreeIPAddress struct {
+	// SecondaryIPCount is the number of secondary IP addresses assigned to the ENI.
+	SecondaryIPCount int
+}
+
+// Error returns a message telling the user how to resolve the error.
+func (e *ErrNoFreeIPAddress) Error() string {
+	return fmt.Sprintf("all %d secondary IP addresses of the ENI are in use, "+
+		"assign more secondary IP addresses to the ENI", e.SecondaryIPCount)
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"net"
+
+	"github.com/Microsoft/hcsshim"
+)
+
+// EventSink receives structured events for the HNS networks and endpoints created and deleted
+// by BridgeBuilder, e.g. to drive dashboards and audit trails. The methods are called
+// synchronously, after the operation succeeds in HNS.
+type EventSink interface {
+	NetworkCreated(event *NetworkEvent)
+	NetworkDeleted(event *NetworkEvent)
+	EndpointCreated(event *EndpointEvent)
+	EndpointDeleted(event *EndpointEvent)
+}
+
+// NetworkEvent describes an HNS network.
+type NetworkEvent struct {
+	NetworkName string
+	NetworkID   string
+	AdapterName string
+}
+
+// EndpointEvent describes an HNS endpoint.
+type EndpointEvent struct {
+	NetworkName  string
+	EndpointName string
+	EndpointID   string
+	// ContainerID is the ID of the container the endpoint was created for, if known.
+	ContainerID string
+	IPAddress   net.IP
+	MACAddress  string
+}
+
+// noopEventSink implements the EventSink interface by discarding the events.
+type noopEventSink struct{}
+
+func (s *noopEventSink) NetworkCreated(event *NetworkEvent)   {}
+func (s *noopEventSink) NetworkDeleted(event *NetworkEvent)   {}
+func (s *noopEventSink) EndpointCreated(event *EndpointEvent) {}
+func (s *noopEventSink) EndpointDeleted(event *EndpointEvent) {}
+
+// eventSink returns the event sink used by the builder.
+func (nb *BridgeBuilder) eventSink() EventSink {
+	return nb.config().EventSink
+}
+
+// newNetworkEvent returns the event describing an HNS network.
+func newNetworkEvent(hnsNetwork *hcsshim.HNSNetwork) *NetworkEvent {
+	return &NetworkEvent{
+		NetworkName: hnsNetwork.Name,
+		NetworkID:   hnsNetwork.Id,
+		AdapterName: hnsNetwork.NetworkAdapterName,
+	}
+}
+
+// newEndpointEvent returns the event describing an HNS endpoint.
+func newEndpointEvent(hnsEndpoint *hcsshim.HNSEndpoint, containerID string) *EndpointEvent {
+	return &EndpointEvent{
+		NetworkName:  hnsEndpoint.VirtualNetworkName,
+		EndpointName: hnsEndpoint.Name,
+		EndpointID:   hnsEndpoint.Id,
+		ContainerID:  containerID,
+		IPAddress:    hnsEndpoint.IPAddress,
+		MACAddress:   hnsEndpoint.MacAddress,
+	}
+}
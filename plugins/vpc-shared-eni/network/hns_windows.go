@@ -0,0 +1,262 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Microsoft/hcsshim"
+	"github.com/Microsoft/hcsshim/hcn"
+)
+
+// hnsClient is the set of Windows Host Networking Service (HNS) operations used by BridgeBuilder.
+// It exists so that the calls into HNS can be replaced in unit tests.
+type hnsClient interface {
+	GetHNSGlobals() (*hcsshim.HNSGlobals, error)
+	GetHNSNetworkByName(networkName string) (*hcsshim.HNSNetwork, error)
+	HNSNetworkRequest(method, path, request string) (*hcsshim.HNSNetwork, error)
+	HNSListNetworkRequest() ([]hcsshim.HNSNetwork, error)
+	GetHNSNetworkMetadata(networkID string) (map[string]string, error)
+	GetHNSEndpointByName(endpointName string) (*hcsshim.HNSEndpoint, error)
+	GetHNSEndpointMetadata(endpointID string) (map[string]string, error)
+	HNSEndpointRequest(method, path, request string) (*hcsshim.HNSEndpoint, error)
+	HNSListEndpointRequest() ([]hcsshim.HNSEndpoint, error)
+	CountHNSNetworkEndpoints(networkID string) (int, error)
+	GetHNSEndpointContainers(endpointID string) ([]string, error)
+	GetHCNEndpointNamespace(endpointID string) (string, error)
+	HotAttachEndpoint(containerID string, endpointID string) error
+	HotDetachEndpoint(containerID string, endpointID string) error
+	GetNamespaceEndpointIds(namespaceID string) ([]string, error)
+	AddNamespaceEndpoint(namespaceID string, endpointID string) error
+	RemoveNamespaceEndpoint(namespaceID string, endpointID string) error
+	GetHCNNamespaceCompartmentID(namespaceID string) (uint32, error)
+	HCNNamespaceExists(namespaceID string) (bool, error)
+	CreateHCNNamespace(namespaceID string) error
+	RemoveHCNEndpointNATPolicy(endpointID string) error
+}
+
+// hnsNetworkWithMetadata is an HNS network with the free-form metadata and the other fields
+// not modeled by hcsshim.
+type hnsNetworkWithMetadata struct {
+	hcsshim.HNSNetwork
+	AdditionalParams    map[string]string `json:",omitempty"`
+	IsolateSwitch       bool              `json:",omitempty"`
+	DisableManagementOS bool              `json:",omitempty"`
+}
+
+// hnsEndpointRequest is an HNS endpoint request with the free-form metadata and the other fields
+// not modeled by hcsshim. Endpoints are created through the HNS V1 API, including those in HCN
+// namespaces, so their DNS settings are the comma-separated HNS V1 fields: HNS ignores the HNS V2
+// DNS object on V1 requests, and HCN endpoints cannot modify their DNS settings once created.
+type hnsEndpointRequest struct {
+	hcsshim.HNSEndpoint
+	AdditionalParams map[string]string `json:",omitempty"`
+	EnableLowMetric  bool              `json:",omitempty"`
+	PortFriendlyName string            `json:",omitempty"`
+	Metered          *bool             `json:",omitempty"`
+}
+
+// hnsEndpointWithContainers is an HNS endpoint with the list of containers it is attached to.
+type hnsEndpointWithContainers struct {
+	hcsshim.HNSEndpoint
+	SharedContainers []string `json:",omitempty"`
+}
+
+// hcsshimClient implements the hnsClient interface using Microsoft's hcsshim package.
+type hcsshimClient struct{}
+
+// GetHNSGlobals returns the HNS global settings, including its version.
+func (c *hcsshimClient) GetHNSGlobals() (*hcsshim.HNSGlobals, error) {
+	return hcsshim.GetHNSGlobals()
+}
+
+// GetHNSNetworkByName returns the HNS network with the given name.
+func (c *hcsshimClient) GetHNSNetworkByName(networkName string) (*hcsshim.HNSNetwork, error) {
+	return hcsshim.GetHNSNetworkByName(networkName)
+}
+
+// HNSNetworkRequest sends a request to modify or query an HNS network.
+func (c *hcsshimClient) HNSNetworkRequest(method, path, request string) (*hcsshim.HNSNetwork, error) {
+	return hcsshim.HNSNetworkRequest(method, path, request)
+}
+
+// HNSListNetworkRequest returns all HNS networks on the host.
+func (c *hcsshimClient) HNSListNetworkRequest() ([]hcsshim.HNSNetwork, error) {
+	return hcsshim.HNSListNetworkRequest("GET", "", "")
+}
+
+// GetHNSNetworkMetadata returns the free-form metadata of an HNS network.
+func (c *hcsshimClient) GetHNSNetworkMetadata(networkID string) (map[string]string, error) {
+	var hnsNetwork hnsNetworkWithMetadata
+	err := hnsCall("GET", fmt.Sprintf("/networks/%s", networkID), "", &hnsNetwork)
+	if err != nil {
+		return nil, err
+	}
+
+	return hnsNetwork.AdditionalParams, nil
+}
+
+// GetHNSEndpointByName returns the HNS endpoint with the given name.
+func (c *hcsshimClient) GetHNSEndpointByName(endpointName string) (*hcsshim.HNSEndpoint, error) {
+	return hcsshim.GetHNSEndpointByName(endpointName)
+}
+
+// GetHNSEndpointMetadata returns the free-form metadata of an HNS endpoint.
+func (c *hcsshimClient) GetHNSEndpointMetadata(endpointID string) (map[string]string, error) {
+	var hnsEndpoint hnsEndpointRequest
+	err := hnsCall("GET", fmt.Sprintf("/endpoints/%s", endpointID), "", &hnsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return hnsEndpoint.AdditionalParams, nil
+}
+
+// HNSEndpointRequest sends a request to modify or query an HNS endpoint.
+func (c *hcsshimClient) HNSEndpointRequest(method, path, request string) (*hcsshim.HNSEndpoint, error) {
+	return hcsshim.HNSEndpointRequest(method, path, request)
+}
+
+// HNSListEndpointRequest returns all HNS endpoints on the host.
+func (c *hcsshimClient) HNSListEndpointRequest() ([]hcsshim.HNSEndpoint, error) {
+	return hcsshim.HNSListEndpointRequest()
+}
+
+// CountHNSNetworkEndpoints returns the number of endpoints in an HNS network. The endpoints are
+// filtered by HNS rather than listing all endpoints on the host.
+func (c *hcsshimClient) CountHNSNetworkEndpoints(networkID string) (int, error) {
+	hcnEndpoints, err := hcn.ListEndpointsOfNetwork(networkID)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(hcnEndpoints), nil
+}
+
+// GetHNSEndpointContainers returns the IDs of the containers an HNS endpoint is attached to.
+func (c *hcsshimClient) GetHNSEndpointContainers(endpointID string) ([]string, error) {
+	var hnsEndpoint hnsEndpointWithContainers
+	err := hnsCall("GET", fmt.Sprintf("/endpoints/%s", endpointID), "", &hnsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return hnsEndpoint.SharedContainers, nil
+}
+
+// GetHCNEndpointNamespace returns the ID of the HCN namespace an endpoint is attached to.
+func (c *hcsshimClient) GetHCNEndpointNamespace(endpointID string) (string, error) {
+	hcnEndpoint, err := hcn.GetEndpointByID(endpointID)
+	if err != nil {
+		return "", err
+	}
+
+	return hcnEndpoint.HostComputeNamespace, nil
+}
+
+// HotAttachEndpoint attaches an HNS endpoint to a running container.
+func (c *hcsshimClient) HotAttachEndpoint(containerID string, endpointID string) error {
+	return hcsshim.HotAttachEndpoint(containerID, endpointID)
+}
+
+// HotDetachEndpoint detaches an HNS endpoint from a running container.
+func (c *hcsshimClient) HotDetachEndpoint(containerID string, endpointID string) error {
+	return hcsshim.HotDetachEndpoint(containerID, endpointID)
+}
+
+// GetNamespaceEndpointIds returns the IDs of the endpoints in an HCN namespace.
+func (c *hcsshimClient) GetNamespaceEndpointIds(namespaceID string) ([]string, error) {
+	return hcn.GetNamespaceEndpointIds(namespaceID)
+}
+
+// AddNamespaceEndpoint adds an endpoint to an HCN namespace.
+func (c *hcsshimClient) AddNamespaceEndpoint(namespaceID string, endpointID string) error {
+	return hcn.AddNamespaceEndpoint(namespaceID, endpointID)
+}
+
+// RemoveNamespaceEndpoint removes an endpoint from an HCN namespace.
+func (c *hcsshimClient) RemoveNamespaceEndpoint(namespaceID string, endpointID string) error {
+	return hcn.RemoveNamespaceEndpoint(namespaceID, endpointID)
+}
+
+// GetHCNNamespaceCompartmentID returns the ID of the network compartment of an HCN namespace.
+func (c *hcsshimClient) GetHCNNamespaceCompartmentID(namespaceID string) (uint32, error) {
+	namespace, err := hcn.GetNamespaceByID(namespaceID)
+	if err != nil {
+		return 0, err
+	}
+
+	return namespace.NamespaceId, nil
+}
+
+// HCNNamespaceExists returns whether the HCN namespace with the given ID exists.
+func (c *hcsshimClient) HCNNamespaceExists(namespaceID string) (bool, error) {
+	_, err := hcn.GetNamespaceByID(namespaceID)
+	if hcn.IsNotFoundError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// CreateHCNNamespace creates a host HCN namespace with the given ID.
+func (c *hcsshimClient) CreateHCNNamespace(namespaceID string) error {
+	namespace := hcn.NewNamespace(hcn.NamespaceTypeHost)
+	namespace.Id = namespaceID
+	namespace, err := namespace.Create()
+	if err != nil {
+		return err
+	}
+
+	// Older versions of HNS ignore the requested ID.
+	if namespace.Id != namespaceID {
+		_, err = namespace.Delete()
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("HNS created namespace %s instead of %s", namespace.Id, namespaceID)
+	}
+
+	return nil
+}
+
+// RemoveHCNEndpointNATPolicy removes the outbound NAT policy from an endpoint, releasing the
+// ports reserved for it.
+func (c *hcsshimClient) RemoveHCNEndpointNATPolicy(endpointID string) error {
+	settings, err := json.Marshal(hcn.PolicyEndpointRequest{
+		Policies: []hcn.EndpointPolicy{{Type: hcn.OutBoundNAT}},
+	})
+	if err != nil {
+		return err
+	}
+
+	return hcn.ModifyEndpointSettings(endpointID, &hcn.ModifyEndpointSettingRequest{
+		ResourceType: hcn.EndpointResourceTypePolicy,
+		RequestType:  hcn.RequestTypeRemove,
+		Settings:     settings,
+	})
+}
+
+// client returns the HNS client used by the builder.
+func (nb *BridgeBuilder) client() hnsClient {
+	if nb.hns == nil {
+		return &hcsshimClient{}
+	}
+
+	return nb.hns
+}
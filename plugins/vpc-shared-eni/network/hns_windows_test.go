@@ -0,0 +1,648 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build !integration_test && !e2e_test
+// +build !integration_test,!e2e_test
+
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/hcsshim"
+)
+
+// mockHNS is an in-memory implementation of the hnsClient interface.
+type mockHNS struct {
+	version      hcsshim.HNSVersion
+	globalsErr   error
+	networks     map[string]*hcsshim.HNSNetwork
+	metadata     map[string]map[string]string
+	endpoints    map[string]*hcsshim.HNSEndpoint
+	namespaces   map[string][]string
+	containers   map[string][]string
+	compartments map[string]uint32
+	nextID       int
+
+	// globalsFailures is the number of HNS globals queries to fail before succeeding.
+	globalsFailures int
+	// networkCreateErr, if set, is returned for network create requests.
+	networkCreateErr error
+	// unsupportedNetworkType, if set, is the network type that fails to be created, as on
+	// Windows SKUs without the type.
+	unsupportedNetworkType string
+	// networkResponse, if set, replaces the response returned for network create requests.
+	networkResponse func(nw *hcsshim.HNSNetwork) *hcsshim.HNSNetwork
+	// endpointCreateErr, if set, returns the error for an endpoint create request.
+	endpointCreateErr func(ep *hcsshim.HNSEndpoint) error
+	// endpointResponse, if set, modifies the endpoints created by endpoint create requests.
+	endpointResponse func(ep *hcsshim.HNSEndpoint)
+	// natReleases is the list of endpoints whose NAT policy was removed.
+	natReleases []string
+	// natReleaseErr, if set, is returned for NAT policy removals.
+	natReleaseErr error
+	// networkPollsUntilReady is the number of network queries reporting the network without
+	// subnets, as if it was not ready yet.
+	networkPollsUntilReady int
+	// endpointUpdates is the number of endpoint update requests.
+	endpointUpdates int
+	// dropNetworkMetadata, if set, discards the metadata of created networks, like the HNS builds
+	// that do not persist it.
+	dropNetworkMetadata bool
+	// retainDeletedNetworks, if set, reports success for network deletes without deleting them.
+	retainDeletedNetworks bool
+	// deletedNamespaces are the endpoints still attached to deleted HCN namespaces.
+	deletedNamespaces map[string][]string
+}
+
+// newMockHNS returns a new mockHNS running a supported HNS version.
+func newMockHNS() *mockHNS {
+	return &mockHNS{
+		version:      hcsshim.HNSVersion1803,
+		networks:     make(map[string]*hcsshim.HNSNetwork),
+		metadata:     make(map[string]map[string]string),
+		endpoints:    make(map[string]*hcsshim.HNSEndpoint),
+		namespaces:   make(map[string][]string),
+		containers:   make(map[string][]string),
+		compartments: make(map[string]uint32),
+	}
+}
+
+func (m *mockHNS) newID() string {
+	m.nextID++
+	return fmt.Sprintf("id-%d", m.nextID)
+}
+
+// addNetwork adds an existing network with the given metadata to the mock and returns it.
+func (m *mockHNS) addNetwork(name string, metadata map[string]string) *hcsshim.HNSNetwork {
+	nw := &hcsshim.HNSNetwork{
+		Id:   m.newID(),
+		Name: name,
+		Type: hnsL2Bridge,
+	}
+	m.networks[name] = nw
+	m.metadata[nw.Id] = metadata
+	return nw
+}
+
+// deleteNamespace deletes an HCN namespace, leaving its endpoints attached to it like HNS does
+// for endpoints that are not detached first.
+func (m *mockHNS) deleteNamespace(namespaceID string) {
+	if m.deletedNamespaces == nil {
+		m.deletedNamespaces = make(map[string][]string)
+	}
+	m.deletedNamespaces[namespaceID] = m.namespaces[namespaceID]
+	delete(m.namespaces, namespaceID)
+}
+
+// addEndpoint adds an existing endpoint to the mock and returns it.
+func (m *mockHNS) addEndpoint(name string, networkName string) *hcsshim.HNSEndpoint {
+	ep := &hcsshim.HNSEndpoint{
+		Id:                 m.newID(),
+		Name:               name,
+		VirtualNetworkName: networkName,
+		MacAddress:         "00-15-5d-00-00-01",
+	}
+	m.endpoints[ep.Id] = ep
+	return ep
+}
+
+func (m *mockHNS) GetHNSGlobals() (*hcsshim.HNSGlobals, error) {
+	if m.globalsErr != nil {
+		return nil, m.globalsErr
+	}
+	if m.globalsFailures > 0 {
+		m.globalsFailures--
+		return nil, errors.New("HNS is restarting")
+	}
+	return &hcsshim.HNSGlobals{Version: m.version}, nil
+}
+
+func (m *mockHNS) GetHNSNetworkByName(networkName string) (*hcsshim.HNSNetwork, error) {
+	nw, ok := m.networks[networkName]
+	if !ok {
+		return nil, hcsshim.NetworkNotFoundError{NetworkName: networkName}
+	}
+	return nw, nil
+}
+
+func (m *mockHNS) HNSNetworkRequest(method, path, request string) (*hcsshim.HNSNetwork, error) {
+	switch method {
+	case "POST":
+		if m.networkCreateErr != nil {
+			return nil, m.networkCreateErr
+		}
+		var req hnsNetworkWithMetadata
+		err := json.Unmarshal([]byte(request), &req)
+		if err != nil {
+			return nil, err
+		}
+		if req.Type == m.unsupportedNetworkType {
+			return nil, errors.New("HNS failed with error : The request is not supported.")
+		}
+		nw := req.HNSNetwork
+		nw.Id = m.newID()
+		m.networks[nw.Name] = &nw
+		m.metadata[nw.Id] = req.AdditionalParams
+		if m.dropNetworkMetadata {
+			m.metadata[nw.Id] = map[string]string{}
+		}
+		if m.networkResponse != nil {
+			return m.networkResponse(&nw), nil
+		}
+		return &nw, nil
+	case "GET":
+		for _, nw := range m.networks {
+			if nw.Id == path {
+				if m.networkPollsUntilReady > 0 {
+					// The network is not ready yet.
+					m.networkPollsUntilReady--
+					return &hcsshim.HNSNetwork{Id: nw.Id, Name: nw.Name}, nil
+				}
+				return nw, nil
+			}
+		}
+		return nil, fmt.Errorf("network %s not found", path)
+	case "DELETE":
+		for name, nw := range m.networks {
+			if nw.Id == path {
+				if !m.retainDeletedNetworks {
+					delete(m.networks, name)
+				}
+				return nw, nil
+			}
+		}
+		return nil, fmt.Errorf("network %s not found", path)
+	}
+	return nil, fmt.Errorf("unsupported method %s", method)
+}
+
+func (m *mockHNS) HNSListNetworkRequest() ([]hcsshim.HNSNetwork, error) {
+	var networks []hcsshim.HNSNetwork
+	for _, nw := range m.networks {
+		networks = append(networks, *nw)
+	}
+	return networks, nil
+}
+
+func (m *mockHNS) GetHNSNetworkMetadata(networkID string) (map[string]string, error) {
+	metadata, ok := m.metadata[networkID]
+	if !ok {
+		return nil, fmt.Errorf("network %s not found", networkID)
+	}
+	return metadata, nil
+}
+
+func (m *mockHNS) GetHNSEndpointByName(endpointName string) (*hcsshim.HNSEndpoint, error) {
+	for _, ep := range m.endpoints {
+		if ep.Name == endpointName {
+			return ep, nil
+		}
+	}
+	return nil, hcsshim.EndpointNotFoundError{EndpointName: endpointName}
+}
+
+func (m *mockHNS) GetHNSEndpointMetadata(endpointID string) (map[string]string, error) {
+	if _, ok := m.endpoints[endpointID]; !ok {
+		return nil, fmt.Errorf("endpoint %s not found", endpointID)
+	}
+	return m.metadata[endpointID], nil
+}
+
+func (m *mockHNS) HNSEndpointRequest(method, path, request string) (*hcsshim.HNSEndpoint, error) {
+	switch method {
+	case "POST":
+		var req hnsEndpointRequest
+		err := json.Unmarshal([]byte(request), &req)
+		if err != nil {
+			return nil, err
+		}
+		if path != "" {
+			// Update the DNS settings or the policies of an existing endpoint.
+			ep, ok := m.endpoints[path]
+			if !ok {
+				return nil, fmt.Errorf("endpoint %s not found", path)
+			}
+			m.endpointUpdates++
+			if strings.Contains(request, `"DNSServerList"`) {
+				ep.DNSServerList = req.DNSServerList
+				ep.DNSSuffix = req.DNSSuffix
+			} else {
+				ep.Policies = req.Policies
+			}
+			return ep, nil
+		}
+		ep := req.HNSEndpoint
+		if m.endpointCreateErr != nil {
+			err = m.endpointCreateErr(&ep)
+			if err != nil {
+				return nil, err
+			}
+		}
+		ep.Id = m.newID()
+		ep.MacAddress = "00-15-5d-00-00-01"
+		if m.endpointResponse != nil {
+			m.endpointResponse(&ep)
+		}
+		m.endpoints[ep.Id] = &ep
+		m.metadata[ep.Id] = req.AdditionalParams
+		// HNS responds with a new object, which later updates to the endpoint do not change.
+		response := ep
+		return &response, nil
+	case "GET":
+		ep, ok := m.endpoints[path]
+		if !ok {
+			return nil, fmt.Errorf("endpoint %s not found", path)
+		}
+		return ep, nil
+	case "DELETE":
+		ep, ok := m.endpoints[path]
+		if !ok {
+			return nil, fmt.Errorf("endpoint %s not found", path)
+		}
+		delete(m.endpoints, path)
+		delete(m.metadata, path)
+		return ep, nil
+	}
+	return nil, fmt.Errorf("unsupported method %s", method)
+}
+
+func (m *mockHNS) HNSListEndpointRequest() ([]hcsshim.HNSEndpoint, error) {
+	var endpoints []hcsshim.HNSEndpoint
+	for _, ep := range m.endpoints {
+		endpoints = append(endpoints, *ep)
+	}
+	return endpoints, nil
+}
+
+func (m *mockHNS) CountHNSNetworkEndpoints(networkID string) (int, error) {
+	for _, nw := range m.networks {
+		if nw.Id != networkID {
+			continue
+		}
+		count := 0
+		for _, ep := range m.endpoints {
+			if ep.VirtualNetworkName == nw.Name {
+				count++
+			}
+		}
+		return count, nil
+	}
+	return 0, fmt.Errorf("network %s not found", networkID)
+}
+
+func (m *mockHNS) GetHNSEndpointContainers(endpointID string) ([]string, error) {
+	if _, ok := m.endpoints[endpointID]; !ok {
+		return nil, fmt.Errorf("endpoint %s not found", endpointID)
+	}
+	var containerIDs []string
+	for containerID, endpointIDs := range m.containers {
+		for _, id := range endpointIDs {
+			if id == endpointID {
+				containerIDs = append(containerIDs, containerID)
+			}
+		}
+	}
+	sort.Strings(containerIDs)
+	return containerIDs, nil
+}
+
+func (m *mockHNS) GetHCNEndpointNamespace(endpointID string) (string, error) {
+	if _, ok := m.endpoints[endpointID]; !ok {
+		return "", fmt.Errorf("endpoint %s not found", endpointID)
+	}
+	for _, namespaces := range []map[string][]string{m.namespaces, m.deletedNamespaces} {
+		for namespaceID, endpointIDs := range namespaces {
+			for _, id := range endpointIDs {
+				if id == endpointID {
+					return namespaceID, nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+func (m *mockHNS) HotAttachEndpoint(containerID string, endpointID string) error {
+	m.containers[containerID] = append(m.containers[containerID], endpointID)
+	return nil
+}
+
+func (m *mockHNS) HotDetachEndpoint(containerID string, endpointID string) error {
+	m.containers[containerID] = removeString(m.containers[containerID], endpointID)
+	return nil
+}
+
+func (m *mockHNS) GetNamespaceEndpointIds(namespaceID string) ([]string, error) {
+	ids, ok := m.namespaces[namespaceID]
+	if !ok {
+		return nil, fmt.Errorf("namespace %s not found", namespaceID)
+	}
+	return ids, nil
+}
+
+func (m *mockHNS) AddNamespaceEndpoint(namespaceID string, endpointID string) error {
+	ids, ok := m.namespaces[namespaceID]
+	if !ok {
+		return fmt.Errorf("namespace %s not found", namespaceID)
+	}
+	m.namespaces[namespaceID] = append(ids, endpointID)
+	return nil
+}
+
+func (m *mockHNS) RemoveNamespaceEndpoint(namespaceID string, endpointID string) error {
+	ids, ok := m.namespaces[namespaceID]
+	if !ok {
+		return fmt.Errorf("namespace %s not found", namespaceID)
+	}
+	m.namespaces[namespaceID] = removeString(ids, endpointID)
+	return nil
+}
+
+func (m *mockHNS) GetHCNNamespaceCompartmentID(namespaceID string) (uint32, error) {
+	if _, ok := m.namespaces[namespaceID]; !ok {
+		return 0, fmt.Errorf("namespace %s not found", namespaceID)
+	}
+	return m.compartments[namespaceID], nil
+}
+
+func (m *mockHNS) HCNNamespaceExists(namespaceID string) (bool, error) {
+	_, ok := m.namespaces[namespaceID]
+	return ok, nil
+}
+
+func (m *mockHNS) CreateHCNNamespace(namespaceID string) error {
+	if _, ok := m.namespaces[namespaceID]; ok {
+		return fmt.Errorf("namespace %s already exists", namespaceID)
+	}
+	m.namespaces[namespaceID] = nil
+	return nil
+}
+
+func (m *mockHNS) RemoveHCNEndpointNATPolicy(endpointID string) error {
+	if m.natReleaseErr != nil {
+		return m.natReleaseErr
+	}
+	if _, ok := m.endpoints[endpointID]; !ok {
+		return fmt.Errorf("endpoint %s not found", endpointID)
+	}
+	m.natReleases = append(m.natReleases, endpointID)
+	return nil
+}
+
+// removeString returns the given slice without the given value.
+func removeString(values []string, value string) []string {
+	var result []string
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// requestRecorder wraps an hnsClient and decodes the last network and endpoint create requests.
+type requestRecorder struct {
+	hnsClient
+	networkRequest  *map[string]interface{}
+	endpointRequest *map[string]interface{}
+}
+
+func (r *requestRecorder) HNSNetworkRequest(method, path, request string) (*hcsshim.HNSNetwork, error) {
+	if method == "POST" && r.networkRequest != nil {
+		err := json.Unmarshal([]byte(request), r.networkRequest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r.hnsClient.HNSNetworkRequest(method, path, request)
+}
+
+func (r *requestRecorder) HNSEndpointRequest(method, path, request string) (*hcsshim.HNSEndpoint, error) {
+	if method == "POST" && r.endpointRequest != nil {
+		err := json.Unmarshal([]byte(request), r.endpointRequest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r.hnsClient.HNSEndpointRequest(method, path, request)
+}
+
+// flakyNamespaceClient wraps an hnsClient and fails the given number of HCN namespace calls.
+type flakyNamespaceClient struct {
+	hnsClient
+	failures int
+	calls    int
+}
+
+func (c *flakyNamespaceClient) fail() error {
+	c.calls++
+	if c.failures > 0 {
+		c.failures--
+		return errors.New("namespace not ready")
+	}
+	return nil
+}
+
+func (c *flakyNamespaceClient) GetNamespaceEndpointIds(namespaceID string) ([]string, error) {
+	if err := c.fail(); err != nil {
+		return nil, err
+	}
+	return c.hnsClient.GetNamespaceEndpointIds(namespaceID)
+}
+
+func (c *flakyNamespaceClient) AddNamespaceEndpoint(namespaceID string, endpointID string) error {
+	if err := c.fail(); err != nil {
+		return err
+	}
+	return c.hnsClient.AddNamespaceEndpoint(namespaceID, endpointID)
+}
+
+func (c *flakyNamespaceClient) RemoveNamespaceEndpoint(
+	namespaceID string, endpointID string) error {
+	if err := c.fail(); err != nil {
+		return err
+	}
+	return c.hnsClient.RemoveNamespaceEndpoint(namespaceID, endpointID)
+}
+
+// delayedEndpointClient wraps an hnsClient and fails the given number of endpoint lookups, as
+// if the endpoints were still being created.
+type delayedEndpointClient struct {
+	hnsClient
+	misses int
+	calls  int
+}
+
+func (c *delayedEndpointClient) GetHNSEndpointByName(endpointName string) (*hcsshim.HNSEndpoint, error) {
+	c.calls++
+	if c.misses > 0 {
+		c.misses--
+		return nil, fmt.Errorf("endpoint %s not found", endpointName)
+	}
+	return c.hnsClient.GetHNSEndpointByName(endpointName)
+}
+
+// blockingEndpointClient wraps an hnsClient and blocks endpoint creates until released, counting
+// the endpoint lookups and creates.
+type blockingEndpointClient struct {
+	hnsClient
+	started chan struct{}
+	release chan struct{}
+	lookups int
+	creates int
+}
+
+func (c *blockingEndpointClient) GetHNSEndpointByName(
+	endpointName string) (*hcsshim.HNSEndpoint, error) {
+	c.lookups++
+	return c.hnsClient.GetHNSEndpointByName(endpointName)
+}
+
+func (c *blockingEndpointClient) HNSEndpointRequest(
+	method, path, request string) (*hcsshim.HNSEndpoint, error) {
+	if method == "POST" && path == "" {
+		c.creates++
+		close(c.started)
+		<-c.release
+	}
+	return c.hnsClient.HNSEndpointRequest(method, path, request)
+}
+
+// mockHostRouter is a hostRouter recording the routes in the host's routing table.
+type mockHostRouter struct {
+	routes map[string]string
+	// addErr, if set, returns the error for a route add.
+	addErr func(destination net.IPNet) error
+}
+
+func newMockHostRouter() *mockHostRouter {
+	return &mockHostRouter{routes: make(map[string]string)}
+}
+
+func (r *mockHostRouter) AddRoute(destination net.IPNet, nextHop net.IP, interfaceName string) error {
+	if r.addErr != nil {
+		if err := r.addErr(destination); err != nil {
+			return err
+		}
+	}
+	r.routes[destination.String()] = fmt.Sprintf("%s %s", nextHop, interfaceName)
+	return nil
+}
+
+func (r *mockHostRouter) DeleteRoute(destination net.IPNet, nextHop net.IP, interfaceName string) error {
+	delete(r.routes, destination.String())
+	return nil
+}
+
+// recordingEventSink is an EventSink recording the events it receives.
+type recordingEventSink struct {
+	events []string
+}
+
+func (s *recordingEventSink) NetworkCreated(event *NetworkEvent) {
+	s.events = append(s.events, "NetworkCreated "+event.NetworkName)
+}
+
+func (s *recordingEventSink) NetworkDeleted(event *NetworkEvent) {
+	s.events = append(s.events, "NetworkDeleted "+event.NetworkName)
+}
+
+func (s *recordingEventSink) EndpointCreated(event *EndpointEvent) {
+	s.events = append(s.events, fmt.Sprintf("EndpointCreated %s %s %s %s",
+		event.NetworkName, event.EndpointName, event.ContainerID, event.IPAddress))
+}
+
+func (s *recordingEventSink) EndpointDeleted(event *EndpointEvent) {
+	s.events = append(s.events, fmt.Sprintf("EndpointDeleted %s %s %s %s",
+		event.NetworkName, event.EndpointName, event.ContainerID, event.IPAddress))
+}
+
+// recordingMetricsSink is a MetricsSink recording the labels of the attach durations, the
+// delete results and the duplicate creates received.
+type recordingMetricsSink struct {
+	attaches   []string
+	deletes    []string
+	duplicates []string
+}
+
+func (s *recordingMetricsSink) EndpointAttached(namespaceType string, duration time.Duration) {
+	s.attaches = append(s.attaches, namespaceType)
+}
+
+func (s *recordingMetricsSink) DeleteCompleted(objectType string, result DeleteResult) {
+	s.deletes = append(s.deletes, objectType+" "+string(result))
+}
+
+func (s *recordingMetricsSink) DuplicateEndpointCreate(namespaceType string) {
+	s.duplicates = append(s.duplicates, namespaceType)
+}
+
+// mockCompartments is a compartmentAddressLister returning the IP addresses of the endpoints
+// in HCN namespaces, after a number of polls.
+type mockCompartments struct {
+	hns *mockHNS
+	// pollsUntilReady is the number of queries reporting no addresses, as if the interfaces in
+	// the compartment were not configured yet.
+	pollsUntilReady int
+	// polls is the number of queries.
+	polls int
+}
+
+func (m *mockCompartments) ListAddresses(compartmentID uint32) ([]net.IP, error) {
+	m.polls++
+	if m.pollsUntilReady > 0 {
+		m.pollsUntilReady--
+		return nil, nil
+	}
+
+	var ipAddresses []net.IP
+	for namespaceID, endpointIDs := range m.hns.namespaces {
+		if m.hns.compartments[namespaceID] != compartmentID {
+			continue
+		}
+		for _, endpointID := range endpointIDs {
+			ipAddresses = append(ipAddresses, m.hns.endpoints[endpointID].IPAddress)
+		}
+	}
+	return ipAddresses, nil
+}
+
+// mockAdapters is an adapterLister returning a fixed list of network adapters, without a known
+// management interface.
+type mockAdapters []net.Interface
+
+func (m mockAdapters) Interfaces() ([]net.Interface, error) {
+	return m, nil
+}
+
+func (m mockAdapters) ManagementAdapterName() (string, error) {
+	return "", errors.New("management interface unknown")
+}
+
+// mockManagedAdapters is an adapterLister returning a fixed list of network adapters, one of
+// which is the host's management interface.
+type mockManagedAdapters struct {
+	mockAdapters
+	management string
+}
+
+func (m mockManagedAdapters) ManagementAdapterName() (string, error) {
+	return m.management, nil
+}
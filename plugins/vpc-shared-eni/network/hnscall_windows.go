@@ -0,0 +1,98 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modvmcompute = windows.NewLazySystemDLL("vmcompute.dll")
+	procHNSCall  = modvmcompute.NewProc("HNSCall")
+)
+
+// hnsResponse is the envelope of HNS responses.
+type hnsResponse struct {
+	Success bool
+	Error   string
+	Output  json.RawMessage
+}
+
+// hnsCall sends a request to HNS and decodes the output of the response into result. It mirrors
+// the unexported hnsCall of the vendored hcsshim v0.7.12, in internal/hns/hnsfuncs.go, including
+// its error messages. hcsshim and its hcn package decode responses into types without the
+// AdditionalParams and SharedContainers fields read by this plugin, and export no raw HNS call.
+// Keep it in sync when upgrading hcsshim, and replace it once hcsshim returns these fields.
+func hnsCall(method, path, request string, result interface{}) error {
+	methodPtr, err := syscall.UTF16PtrFromString(method)
+	if err != nil {
+		return err
+	}
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	requestPtr, err := syscall.UTF16PtrFromString(request)
+	if err != nil {
+		return err
+	}
+
+	err = procHNSCall.Find()
+	if err != nil {
+		return err
+	}
+
+	var responseBuffer *uint16
+	hr, _, _ := syscall.Syscall6(
+		procHNSCall.Addr(),
+		4,
+		uintptr(unsafe.Pointer(methodPtr)),
+		uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(unsafe.Pointer(requestPtr)),
+		uintptr(unsafe.Pointer(&responseBuffer)),
+		0,
+		0)
+	if int32(hr) < 0 {
+		// HRESULTs wrapping Win32 errors are reported as the Win32 error.
+		errno := syscall.Errno(hr)
+		if hr&0x1fff0000 == 0x00070000 {
+			errno = syscall.Errno(hr & 0xffff)
+		}
+		return fmt.Errorf("hnsCall failed in Win32: %s (%#x)", errno, uint32(errno))
+	}
+
+	responseString := windows.UTF16PtrToString(responseBuffer)
+	windows.CoTaskMemFree(unsafe.Pointer(responseBuffer))
+
+	var response hnsResponse
+	err = json.Unmarshal([]byte(responseString), &response)
+	if err != nil {
+		return err
+	}
+
+	if !response.Success {
+		return fmt.Errorf("HNS failed with error : %s", response.Error)
+	}
+
+	if len(response.Output) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(response.Output, result)
+}
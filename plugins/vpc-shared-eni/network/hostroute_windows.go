@@ -0,0 +1,165 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/Microsoft/hcsshim"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// hostVNICNameFormat is the format of the name of the host vNIC of an HNS network.
+	hostVNICNameFormat = "vEthernet (%s)"
+)
+
+// hostRouter installs routes in the host's routing table.
+// It exists so that the route installation can be replaced in unit tests.
+type hostRouter interface {
+	AddRoute(destination net.IPNet, nextHop net.IP, interfaceName string) error
+	DeleteRoute(destination net.IPNet, nextHop net.IP, interfaceName string) error
+}
+
+// netshHostRouter implements the hostRouter interface using netsh.
+type netshHostRouter struct{}
+
+// AddRoute adds a route to the host's active routing table.
+func (r *netshHostRouter) AddRoute(destination net.IPNet, nextHop net.IP, interfaceName string) error {
+	return r.run("add", destination, nextHop, interfaceName)
+}
+
+// DeleteRoute deletes a route from the host's active routing table.
+func (r *netshHostRouter) DeleteRoute(destination net.IPNet, nextHop net.IP, interfaceName string) error {
+	return r.run("delete", destination, nextHop, interfaceName)
+}
+
+// run runs a netsh route command.
+func (r *netshHostRouter) run(
+	command string, destination net.IPNet, nextHop net.IP, interfaceName string) error {
+	output, err := exec.Command("netsh", "interface", "ipv4", command, "route",
+		"prefix="+destination.String(),
+		"interface="+interfaceName,
+		"nexthop="+nextHop.String(),
+		"store=active").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("netsh failed to %s route to %s: %v: %s",
+			command, destination.String(), err, output)
+	}
+
+	return nil
+}
+
+// hostRouter returns the host router used by the builder.
+func (nb *BridgeBuilder) hostRouter() hostRouter {
+	if nb.routes == nil {
+		return &netshHostRouter{}
+	}
+
+	return nb.routes
+}
+
+// addHostRoutes adds the endpoint's host routes, via the host vNIC of its network. The routes
+// added are removed if any route fails.
+func (nb *BridgeBuilder) addHostRoutes(ep *Endpoint, hnsEndpoint *hcsshim.HNSEndpoint) error {
+	if len(ep.HostRoutes) == 0 {
+		return nil
+	}
+
+	interfaceName, err := nb.getHostVNICName(hnsEndpoint)
+	if err != nil {
+		return err
+	}
+
+	for i, destination := range ep.HostRoutes {
+		log.Infof("Adding host route to %s via %s.", destination.String(), hnsEndpoint.IPAddress)
+		err = nb.hostRouter().AddRoute(destination, hnsEndpoint.IPAddress, interfaceName)
+		if err != nil {
+			log.Errorf("Failed to add host route to %s: %v.", destination.String(), err)
+			nb.deleteRoutes(ep.HostRoutes[:i], hnsEndpoint.IPAddress, interfaceName)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteHostRoutes deletes the host routes recorded in the HNS endpoint's metadata, or the
+// endpoint's host routes if none are recorded. Failures are logged and ignored, so that the
+// endpoint is still deleted.
+func (nb *BridgeBuilder) deleteHostRoutes(ep *Endpoint, hnsEndpoint *hcsshim.HNSEndpoint) {
+	hostRoutes := nb.readHostRoutes(hnsEndpoint)
+	if len(hostRoutes) == 0 {
+		hostRoutes = ep.HostRoutes
+	}
+	if len(hostRoutes) == 0 {
+		return
+	}
+
+	interfaceName, err := nb.getHostVNICName(hnsEndpoint)
+	if err != nil {
+		log.Warnf("Failed to find host vNIC to delete host routes: %v.", err)
+		return
+	}
+
+	nb.deleteRoutes(hostRoutes, hnsEndpoint.IPAddress, interfaceName)
+}
+
+// readHostRoutes returns the host route destinations recorded in the HNS endpoint's metadata.
+func (nb *BridgeBuilder) readHostRoutes(hnsEndpoint *hcsshim.HNSEndpoint) []net.IPNet {
+	metadata, err := nb.client().GetHNSEndpointMetadata(hnsEndpoint.Id)
+	if err != nil {
+		log.Warnf("Failed to read HNS endpoint metadata, ignoring: %v.", err)
+		return nil
+	}
+	if metadata[hnsEndpointHostRoutesKey] == "" {
+		return nil
+	}
+
+	var hostRoutes []net.IPNet
+	for _, destination := range strings.Split(metadata[hnsEndpointHostRoutesKey], ",") {
+		_, ipNet, err := net.ParseCIDR(destination)
+		if err != nil {
+			log.Warnf("Ignoring invalid host route %s in HNS endpoint metadata.", destination)
+			continue
+		}
+		hostRoutes = append(hostRoutes, *ipNet)
+	}
+
+	return hostRoutes
+}
+
+// deleteRoutes deletes the host routes to the given destinations.
+func (nb *BridgeBuilder) deleteRoutes(destinations []net.IPNet, nextHop net.IP, interfaceName string) {
+	for _, destination := range destinations {
+		log.Infof("Deleting host route to %s via %s.", destination.String(), nextHop)
+		err := nb.hostRouter().DeleteRoute(destination, nextHop, interfaceName)
+		if err != nil {
+			log.Warnf("Failed to delete host route to %s: %v.", destination.String(), err)
+		}
+	}
+}
+
+// getHostVNICName returns the name of the host vNIC of the HNS network of an endpoint.
+func (nb *BridgeBuilder) getHostVNICName(hnsEndpoint *hcsshim.HNSEndpoint) (string, error) {
+	hnsNetwork, err := nb.client().GetHNSNetworkByName(hnsEndpoint.VirtualNetworkName)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(hostVNICNameFormat, hnsNetwork.NetworkAdapterName), nil
+}
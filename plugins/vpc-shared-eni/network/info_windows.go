@@ -0,0 +1,108 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"sort"
+
+	"github.com/aws/amazon-vpc-cni-plugins/version"
+
+	"github.com/Microsoft/hcsshim"
+)
+
+const (
+	// FeatureACLPolicies is the feature gate of the ACL policies of endpoints, used by
+	// default-deny networks, ACL allow rules and egress allowlists.
+	FeatureACLPolicies = "acl-policies"
+	// FeatureHCNNamespaces is the feature gate of endpoints in HCN namespaces, used to network
+	// containers that do not have an infra container.
+	FeatureHCNNamespaces = "hcn-namespaces"
+)
+
+// featureGate describes an optional feature of this plugin.
+type featureGate struct {
+	// enabledByDefault is whether the feature is enabled unless Config.FeatureGates disables it.
+	enabledByDefault bool
+	// minHNSVersion is the minimum HNS version that supports the feature.
+	minHNSVersion hcsshim.HNSVersion
+}
+
+// featureGates are the optional features of this plugin, by name.
+var featureGates = map[string]featureGate{
+	FeatureACLPolicies: {
+		enabledByDefault: true,
+		minHNSVersion:    hcsshim.HNSVersion1803,
+	},
+	FeatureHCNNamespaces: {
+		enabledByDefault: true,
+		minHNSVersion:    hcsshim.HNSVersion{Major: 9, Minor: 1},
+	},
+}
+
+// Info describes the plugin and the HNS it runs on, for diagnostics.
+type Info struct {
+	// PluginVersion, GitShortHash and BuildTime identify the plugin build.
+	PluginVersion string
+	GitShortHash  string
+	BuildTime     string
+	// HNSVersion is the version of HNS running on the host.
+	HNSVersion hcsshim.HNSVersion
+	// HNSNetworkVersion is the version of the HNS networks created by this plugin.
+	HNSNetworkVersion string
+	// Capabilities is the sorted list of features enabled by the feature gates and supported by
+	// the host's HNS version.
+	Capabilities []string
+}
+
+// Info returns the plugin version, the HNS version and the features enabled on this host.
+func (nb *BridgeBuilder) Info() (*Info, error) {
+	hnsGlobals, err := nb.client().GetHNSGlobals()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		PluginVersion:     version.Version,
+		GitShortHash:      version.GitShortHash,
+		BuildTime:         version.BuildTime,
+		HNSVersion:        hnsGlobals.Version,
+		HNSNetworkVersion: hnsNetworkVersion,
+		Capabilities:      []string{},
+	}
+
+	for feature, gate := range featureGates {
+		if nb.isFeatureEnabled(feature) && isHNSVersionAtLeast(hnsGlobals.Version, gate.minHNSVersion) {
+			info.Capabilities = append(info.Capabilities, feature)
+		}
+	}
+	sort.Strings(info.Capabilities)
+
+	return info, nil
+}
+
+// isFeatureEnabled returns whether an optional feature is enabled by the builder's feature gates.
+func (nb *BridgeBuilder) isFeatureEnabled(feature string) bool {
+	enabled, ok := nb.FeatureGates[feature]
+	if !ok {
+		return featureGates[feature].enabledByDefault
+	}
+
+	return enabled
+}
+
+// isHNSVersionAtLeast returns whether an HNS version is the same as or newer than another.
+func isHNSVersionAtLeast(hnsVersion hcsshim.HNSVersion, minVersion hcsshim.HNSVersion) bool {
+	return hnsVersion.Major > minVersion.Major ||
+		(hnsVersion.Major == minVersion.Major && hnsVersion.Minor >= minVersion.Minor)
+}
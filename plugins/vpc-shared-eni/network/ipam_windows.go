@@ -0,0 +1,72 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"net"
+	"sort"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/vpc"
+
+	log "github.com/cihub/seelog"
+)
+
+// allocateEndpointIP returns the lowest secondary IPv4 address of the shared ENI that is neither
+// used by the host nor by an existing endpoint. The VPC only delivers traffic for the addresses
+// assigned to the ENI, so other addresses in the ENI subnet cannot be allocated. Allocations are
+// serialized by the network lock.
+func (nb *BridgeBuilder) allocateEndpointIP(nw *Network) (net.IPNet, error) {
+	subnet := vpc.GetSubnetPrefix(&nw.ENIIPAddresses[0])
+
+	secondaryIPs, err := nb.ipDiscoverer().GetSecondaryIPAddresses(nw.SharedENI)
+	if err != nil {
+		log.Errorf("Failed to discover secondary IP addresses of ENI: %v.", err)
+		return net.IPNet{}, err
+	}
+
+	usedIPs, err := nb.UsedIPs(nw)
+	if err != nil {
+		return net.IPNet{}, err
+	}
+	usedIPs = append(usedIPs, nw.GatewayIPAddress)
+	for _, eniIPAddress := range nw.ENIIPAddresses {
+		usedIPs = append(usedIPs, eniIPAddress.IP)
+	}
+
+	used := make(map[string]bool)
+	for _, ipAddress := range usedIPs {
+		if ipAddress.To4() != nil {
+			used[ipAddress.To4().String()] = true
+		}
+	}
+
+	var candidates []net.IP
+	for _, ipAddress := range secondaryIPs {
+		ipAddress = ipAddress.To4()
+		if ipAddress != nil && subnet.Contains(ipAddress) && !used[ipAddress.String()] {
+			candidates = append(candidates, ipAddress)
+		}
+	}
+	if len(candidates) == 0 {
+		return net.IPNet{}, &ErrNoFreeIPAddress{SecondaryIPCount: len(secondaryIPs)}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return bytes.Compare(candidates[i], candidates[j]) < 0
+	})
+	log.Infof("Allocated secondary IP address %s of the ENI.", candidates[0])
+
+	return net.IPNet{IP: candidates[0], Mask: subnet.Mask}, nil
+}
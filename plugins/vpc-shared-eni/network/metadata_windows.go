@@ -0,0 +1,165 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/cihub/seelog"
+)
+
+// fileMetadataStore stores the metadata of HNS networks in files, one per network ID, for the
+// HNS builds that do not return the free-form metadata they were given.
+type fileMetadataStore struct {
+	dir string
+}
+
+// networkMetadataStore returns the store for HNS network metadata, or nil if none is configured.
+func (nb *BridgeBuilder) networkMetadataStore() *fileMetadataStore {
+	if nb.NetworkMetadataDir == "" {
+		return nil
+	}
+
+	return &fileMetadataStore{dir: nb.NetworkMetadataDir}
+}
+
+// read returns the stored metadata of an HNS network, or nil if none is stored.
+func (s *fileMetadataStore) read(networkID string) (map[string]string, error) {
+	buf, err := ioutil.ReadFile(s.path(networkID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata map[string]string
+	err = json.Unmarshal(buf, &metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// write stores the metadata of an HNS network. The file is replaced atomically, so that readers
+// in other plugin processes never see a partial write.
+func (s *fileMetadataStore) write(networkID string, metadata map[string]string) error {
+	buf, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(s.dir, networkID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buf)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.path(networkID))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+
+	return err
+}
+
+// delete deletes the stored metadata of an HNS network.
+func (s *fileMetadataStore) delete(networkID string) error {
+	err := os.Remove(s.path(networkID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// path returns the path of the file storing the metadata of an HNS network.
+func (s *fileMetadataStore) path(networkID string) string {
+	return filepath.Join(s.dir, networkID+".json")
+}
+
+// getHNSNetworkMetadata returns the metadata of an HNS network. Keys missing from the metadata
+// returned by HNS are read from the network metadata store, if configured.
+func (nb *BridgeBuilder) getHNSNetworkMetadata(networkID string) (map[string]string, error) {
+	metadata, err := nb.client().GetHNSNetworkMetadata(networkID)
+	if err != nil {
+		return nil, err
+	}
+
+	store := nb.networkMetadataStore()
+	if store == nil {
+		return metadata, nil
+	}
+
+	storedMetadata, err := store.read(networkID)
+	if err != nil {
+		// The metadata returned by HNS is still usable.
+		log.Warnf("Failed to read stored metadata of HNS network %s: %v.", networkID, err)
+		return metadata, nil
+	}
+	if len(storedMetadata) == 0 {
+		return metadata, nil
+	}
+
+	merged := make(map[string]string)
+	for key, value := range storedMetadata {
+		merged[key] = value
+	}
+	for key, value := range metadata {
+		merged[key] = value
+	}
+
+	return merged, nil
+}
+
+// storeHNSNetworkMetadata records the metadata of a new HNS network in the network metadata store,
+// if configured. Failures are logged and ignored, as the metadata may still round-trip in HNS.
+func (nb *BridgeBuilder) storeHNSNetworkMetadata(networkID string, metadata map[string]string) {
+	store := nb.networkMetadataStore()
+	if store == nil {
+		return
+	}
+
+	err := store.write(networkID, metadata)
+	if err != nil {
+		log.Warnf("Failed to store metadata of HNS network %s: %v.", networkID, err)
+	}
+}
+
+// deleteStoredHNSNetworkMetadata deletes the metadata of a deleted HNS network from the network
+// metadata store, if configured.
+func (nb *BridgeBuilder) deleteStoredHNSNetworkMetadata(networkID string) {
+	store := nb.networkMetadataStore()
+	if store == nil {
+		return
+	}
+
+	err := store.delete(networkID)
+	if err != nil {
+		log.Warnf("Failed to delete stored metadata of HNS network %s: %v.", networkID, err)
+	}
+}
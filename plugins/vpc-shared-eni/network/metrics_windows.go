@@ -0,0 +1,148 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// AttachNamespaceInfra, AttachNamespaceApp and AttachNamespaceHCN label the durations of
+	// endpoint attaches to infra containers, app containers and HCN namespaces.
+	AttachNamespaceInfra = "infra"
+	AttachNamespaceApp   = "app"
+	AttachNamespaceHCN   = "hcn"
+
+	// DeleteObjectNetwork and DeleteObjectEndpoint label the results of network and endpoint
+	// deletes.
+	DeleteObjectNetwork  = "network"
+	DeleteObjectEndpoint = "endpoint"
+)
+
+// MetricsSink receives the metrics of the operations run by BridgeBuilder, e.g. to build
+// histograms in a metrics exporter. The methods are called synchronously.
+type MetricsSink interface {
+	// EndpointAttached receives the duration of a successful endpoint attach, labeled with the
+	// type of namespace the endpoint was attached to.
+	EndpointAttached(namespaceType string, duration time.Duration)
+	// DeleteCompleted receives the result of a network or endpoint delete that deleted the
+	// object or found it already absent, labeled with the type of object.
+	DeleteCompleted(objectType string, result DeleteResult)
+	// DuplicateEndpointCreate receives each benign duplicate create of an endpoint already
+	// attached, labeled with the type of namespace the endpoint is attached to.
+	DuplicateEndpointCreate(namespaceType string)
+}
+
+// AttachDurationSummary summarizes the recent endpoint attach durations of a namespace type.
+type AttachDurationSummary struct {
+	Count int
+	P50   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// noopMetricsSink implements the MetricsSink interface by discarding the metrics.
+type noopMetricsSink struct{}
+
+func (s *noopMetricsSink) EndpointAttached(namespaceType string, duration time.Duration) {}
+func (s *noopMetricsSink) DeleteCompleted(objectType string, result DeleteResult)        {}
+func (s *noopMetricsSink) DuplicateEndpointCreate(namespaceType string)                  {}
+
+// attachDurations holds the most recent endpoint attach durations of each namespace type.
+type attachDurations struct {
+	lock    sync.Mutex
+	samples map[string][]time.Duration
+	next    map[string]int
+}
+
+// label returns the label of a namespace type in the attach duration metrics.
+func (t nsType) label() string {
+	switch t {
+	case appContainerNS:
+		return AttachNamespaceApp
+	case hcnNamespace:
+		return AttachNamespaceHCN
+	default:
+		return AttachNamespaceInfra
+	}
+}
+
+// metricsSink returns the metrics sink used by the builder.
+func (nb *BridgeBuilder) metricsSink() MetricsSink {
+	return nb.config().MetricsSink
+}
+
+// recordAttachDuration reports the duration of an endpoint attach to the metrics sink, and keeps
+// it for AttachDurations if enabled. The oldest durations are overwritten once the configured
+// number of samples is reached.
+func (nb *BridgeBuilder) recordAttachDuration(netNSType nsType, duration time.Duration) {
+	label := netNSType.label()
+	nb.metricsSink().EndpointAttached(label, duration)
+
+	maxSamples := nb.config().AttachDurationSamples
+	if maxSamples == 0 {
+		return
+	}
+
+	nb.attachDurations.lock.Lock()
+	defer nb.attachDurations.lock.Unlock()
+
+	if nb.attachDurations.samples == nil {
+		nb.attachDurations.samples = make(map[string][]time.Duration)
+		nb.attachDurations.next = make(map[string]int)
+	}
+	samples := nb.attachDurations.samples[label]
+	if len(samples) < maxSamples {
+		nb.attachDurations.samples[label] = append(samples, duration)
+		return
+	}
+
+	next := nb.attachDurations.next[label] % len(samples)
+	samples[next] = duration
+	nb.attachDurations.next[label] = next + 1
+}
+
+// AttachDurations returns the summary of the recent endpoint attach durations, by namespace
+// type label. It is empty unless AttachDurationSamples is set.
+func (nb *BridgeBuilder) AttachDurations() map[string]AttachDurationSummary {
+	nb.attachDurations.lock.Lock()
+	defer nb.attachDurations.lock.Unlock()
+
+	summaries := make(map[string]AttachDurationSummary)
+	for label, samples := range nb.attachDurations.samples {
+		sorted := append([]time.Duration{}, samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		summaries[label] = AttachDurationSummary{
+			Count: len(sorted),
+			P50:   percentile(sorted, 50),
+			P99:   percentile(sorted, 99),
+			Max:   sorted[len(sorted)-1],
+		}
+	}
+
+	return summaries
+}
+
+// percentile returns the nearest-rank percentile of a sorted non-empty list of durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
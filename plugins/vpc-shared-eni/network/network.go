@@ -14,6 +14,7 @@
 package network
 
 import (
+	"encoding/json"
 	"net"
 
 	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
@@ -34,21 +35,368 @@ type Network struct {
 	BridgeNetNSPath     string
 	BridgeIndex         int
 	SharedENI           *eni.ENI
+	AdapterIndex        int
 	ENIIPAddresses      []net.IPNet
 	GatewayIPAddress    net.IP
 	VPCCIDRs            []net.IPNet
+	VPCID               string
+	SubnetID            string
 	DNSServers          []string
 	DNSSuffixSearchList []string
 	ServiceCIDR         string
+	DisableDNS          bool
+	EndpointPolicies    []json.RawMessage
+	DefaultDeny         bool
+	ACLAllowRules       []ACLRule
+
+	VersionMismatchAction          NetworkMismatchAction
+	DNSMismatchAction              NetworkMismatchAction
+	EndpointDNSMismatchAction      NetworkMismatchAction
+	SubnetMismatchAction           NetworkMismatchAction
+	DNSSuffixMode                  DNSSuffixMode
+	EndpointIPMismatchAction       EndpointMismatchAction
+	EndpointSubnetMismatchAction   EndpointMismatchAction
+	StaleNamespaceAction           StaleNamespaceAction
+	DisableMulticastSNATExceptions bool
+	IsolateSwitch                  bool
+	DisableManagementOS            bool
+	TransparentMode                bool
+	VerifyDelete                   bool
+	DeleteWithLastEndpoint         bool
+	NetworkGCPolicy                NetworkGCPolicy
+	RequireExistingNetwork         bool
+	CreateMissingHCNNamespaces     bool
+	ForceEndpointDelete            bool
+	AllocateEndpointIPs            bool
+	ServiceCIDRRouteOnly           bool
+	ReleaseSNATPortsOnDelete       bool
+	RequireHCNNamespaceDetach      bool
+	IgnoreInvalidEndpointMAC       bool
+	RedactEndpointPolicyResult     bool
+	PreserveAdapterBinding         bool
+	PolicyOrder                    PolicyOrder
+	PolicyMode                     PolicyMode
+	IgnoreAbsentOnDelete           bool
+	ManagementAdapterAction        ManagementAdapterAction
+
+	// AddServiceRoute and AddHostRoute are whether endpoints route the service CIDR and the
+	// host's primary IP address to the host, when the network has a service CIDR. Nil adds
+	// the route.
+	AddServiceRoute *bool
+	AddHostRoute    *bool
+
+	// FallbackAdapterName is the name of the network adapter the network is bound to while the
+	// shared ENI's adapter is absent, such as during an ENI hot swap. The network is rebound to
+	// the shared ENI's adapter once it returns and the network has no endpoints. Empty leaves
+	// the network creation to fail while the adapter is absent.
+	FallbackAdapterName string
+
+	// NetworkNameDiscriminator is appended to the name of the HNS network, which is otherwise
+	// unique only by the shared ENI's MAC address. It keeps the names unique in the virtualized
+	// environments where ENI MAC addresses can collide, e.g. by using the subnet ID. Empty
+	// leaves the name unchanged.
+	NetworkNameDiscriminator string
+
+	// FallbackNetworkType is the type of the HNS network created when HNS does not support the
+	// network's type, such as l2bridge on minimal Windows SKUs. Only "nat" and "transparent"
+	// are supported. Empty fails the network creation.
+	FallbackNetworkType string
+
+	// IPv4DNSSuffixSearchList and IPv6DNSSuffixSearchList are the DNS suffix search lists of
+	// each address family. DNSSuffixSearchList is used for the families without their own list.
+	IPv4DNSSuffixSearchList []string
+	IPv6DNSSuffixSearchList []string
+
+	// SNATPool is the list of source IP addresses for SNATing endpoint traffic. If empty, the
+	// ENI primary IP address is used, unless DiscoverSNATPool populates the pool with the ENI's
+	// secondary IP addresses.
+	SNATPool         []net.IP
+	DiscoverSNATPool bool
+
+	// SNATExceptionProvider provides additional destination prefixes exempted from SNAT. It is
+	// queried for each new endpoint, so that endpoints pick up updated exceptions. Nil adds no
+	// exceptions.
+	SNATExceptionProvider SNATExceptionProvider
+
+	// SNATExceptionLimit is the number of SNAT exceptions above which HNS may reject endpoints or
+	// slow down, and SNATExceptionLimitAction is the action taken when an endpoint exceeds it.
+	// Zero selects the default limit.
+	SNATExceptionLimit       int
+	SNATExceptionLimitAction SNATExceptionLimitAction
+
+	// SNATPolicyFields are additional fields of the outbound NAT policy, for the tuning options of
+	// HNS versions newer than hcsshim models, such as port reservation hints. They cannot override
+	// the fields set by the plugin. Empty leaves the HNS defaults.
+	SNATPolicyFields map[string]interface{}
+
+	// DisableSNAT disables the SNAT of endpoint traffic, e.g. when the endpoint IP addresses are
+	// routable. It applies to IPv4, the only address family of endpoints on Windows: endpoints
+	// with IPv6 addresses are rejected, so there is no IPv6 SNAT to control separately.
+	DisableSNAT bool
+
+	// DeleteResult is set by the builder when deleting the network, to tell apart the networks
+	// deleted from those already absent.
+	DeleteResult DeleteResult
+}
+
+// SNATExceptionProvider provides destination prefixes exempted from SNAT, such as the CIDR
+// blocks of peered networks. Implementations can reload the prefixes from an external source.
+type SNATExceptionProvider interface {
+	GetSNATExceptions() ([]string, error)
 }
 
+// NetworkMismatchAction is the action taken when an existing network does not match the requested one.
+type NetworkMismatchAction string
+
+const (
+	// NetworkMismatchWarn logs a warning and keeps using the existing network.
+	NetworkMismatchWarn NetworkMismatchAction = ""
+	// NetworkMismatchRecreate deletes and recreates the existing network, unless it is in use.
+	NetworkMismatchRecreate NetworkMismatchAction = "recreate"
+	// NetworkMismatchUpdate updates the existing endpoint in place. Only the DNS settings of
+	// endpoints can be updated, HNS V1 networks cannot be updated.
+	NetworkMismatchUpdate NetworkMismatchAction = "update"
+)
+
+// DNSSuffixMode is how the DNS suffix search list is mapped to the DNS suffix of HNS objects.
+type DNSSuffixMode string
+
+const (
+	// DNSSuffixPrimary sets the first entry of the search list as the primary DNS suffix. HNS V1
+	// objects have no search list, so the other entries are not applied.
+	DNSSuffixPrimary DNSSuffixMode = ""
+	// DNSSuffixSearchList sets the whole comma-separated search list as the DNS suffix, which
+	// HNS builds interpret inconsistently.
+	DNSSuffixSearchList DNSSuffixMode = "searchlist"
+)
+
+// EndpointMismatchAction is the action taken when an existing endpoint has a different IP
+// address than requested, e.g. because the IPAM plugin's state drifted from HNS, or an IP
+// address outside the ENI subnet, e.g. because the network's subnet changed.
+type EndpointMismatchAction string
+
+const (
+	// EndpointMismatchReuse logs a warning and keeps using the existing endpoint.
+	EndpointMismatchReuse EndpointMismatchAction = ""
+	// EndpointMismatchError fails the endpoint creation.
+	EndpointMismatchError EndpointMismatchAction = "error"
+	// EndpointMismatchRecreate deletes the existing endpoint and creates it with the requested
+	// IP address.
+	EndpointMismatchRecreate EndpointMismatchAction = "recreate"
+)
+
+// StaleNamespaceAction is the action taken when an existing endpoint found by its key is still
+// attached to another HCN namespace, e.g. the namespace of a previous container.
+type StaleNamespaceAction string
+
+const (
+	// StaleNamespaceAttach attaches the endpoint to the requested namespace without checking
+	// its current namespace, which HNS can reject.
+	StaleNamespaceAttach StaleNamespaceAction = ""
+	// StaleNamespaceRehome detaches the endpoint from its current namespace if the namespace no
+	// longer exists, and fails if the namespace is still live.
+	StaleNamespaceRehome StaleNamespaceAction = "rehome"
+	// StaleNamespaceError fails the endpoint creation.
+	StaleNamespaceError StaleNamespaceAction = "error"
+)
+
+// PolicyOrder is the order of the policies of an HNS endpoint. The policies generated by the
+// plugin, such as the SNAT, route and ACL policies, are listed in a fixed order. The user
+// policies are the network's EndpointPolicies followed by the endpoint's own Policies.
+type PolicyOrder string
+
+const (
+	// PolicyOrderGeneratedFirst lists the generated policies before the user policies.
+	PolicyOrderGeneratedFirst PolicyOrder = ""
+	// PolicyOrderUserFirst lists the user policies before the generated policies.
+	PolicyOrderUserFirst PolicyOrder = "user-first"
+)
+
+// PolicyMode is how endpoint policies that fail to build are handled.
+type PolicyMode string
+
+const (
+	// PolicyModeAtomic fails the endpoint creation if any policy fails to build.
+	PolicyModeAtomic PolicyMode = ""
+	// PolicyModeBestEffort creates the endpoint with the policies that built successfully, and
+	// skips the others. The ACL policies are skipped together.
+	PolicyModeBestEffort PolicyMode = "best-effort"
+)
+
+// ManagementAdapterAction is the action taken when creating a network on the adapter of the
+// host's primary management interface, where binding the network can disrupt the host's
+// connectivity.
+type ManagementAdapterAction string
+
+const (
+	// ManagementAdapterWarn logs a warning and creates the network.
+	ManagementAdapterWarn ManagementAdapterAction = ""
+	// ManagementAdapterAllow creates the network without checking the adapter.
+	ManagementAdapterAllow ManagementAdapterAction = "allow"
+	// ManagementAdapterRefuse fails the network creation.
+	ManagementAdapterRefuse ManagementAdapterAction = "refuse"
+)
+
+// DeleteResult is the outcome of deleting a network or an endpoint.
+type DeleteResult string
+
+const (
+	// DeleteResultNone is the result of an object not deleted, such as an endpoint of an app
+	// container or a network kept to preserve its adapter binding.
+	DeleteResultNone DeleteResult = ""
+	// DeleteResultDeleted is the result of an object deleted from HNS.
+	DeleteResultDeleted DeleteResult = "deleted"
+	// DeleteResultAbsent is the result of an object already absent from HNS. The delete fails
+	// unless the network ignores absent objects on delete.
+	DeleteResultAbsent DeleteResult = "absent"
+)
+
+// NetworkGCPolicy is the action taken on networks without endpoints during garbage collection.
+type NetworkGCPolicy string
+
+const (
+	// NetworkGCRetain keeps the network, to avoid recreating it for the next endpoint.
+	NetworkGCRetain NetworkGCPolicy = ""
+	// NetworkGCDelete deletes the network, to free its resources.
+	NetworkGCDelete NetworkGCPolicy = "delete"
+)
+
+// Orchestrator is a container orchestrator.
+type Orchestrator string
+
+const (
+	// OrchestratorUnknown accepts the namespaces created by any orchestrator.
+	OrchestratorUnknown Orchestrator = ""
+	// OrchestratorECS runs task containers in the network namespace of an infra container.
+	OrchestratorECS Orchestrator = "ecs"
+	// OrchestratorKubernetes calls the plugin only once per pod, for its infra container or
+	// HCN namespace.
+	OrchestratorKubernetes Orchestrator = "kubernetes"
+)
+
+// SNATExceptionLimitAction is the action taken when an endpoint has more SNAT exceptions than the limit.
+type SNATExceptionLimitAction string
+
+const (
+	// SNATExceptionLimitWarn logs a warning and creates the endpoint.
+	SNATExceptionLimitWarn SNATExceptionLimitAction = ""
+	// SNATExceptionLimitError fails the endpoint creation.
+	SNATExceptionLimitError SNATExceptionLimitAction = "error"
+)
+
+// ACLRule is a firewall rule allowing traffic to or from container network interfaces.
+type ACLRule struct {
+	// Direction is the direction of the traffic relative to the container.
+	Direction ACLDirection
+	// Protocol is the IANA protocol number of the traffic. Zero matches all protocols.
+	Protocol uint16
+	// RemoteAddresses is a comma-separated list of remote CIDR blocks. Empty matches all addresses.
+	RemoteAddresses string
+	// RemotePorts is a comma-separated list of remote ports. Empty matches all ports.
+	RemotePorts string
+	// Priority is the HNS priority of the rule. HNS evaluates ACL rules in increasing priority
+	// number order: the rules allowing traffic essential to the endpoint have priority 100, and
+	// the default-deny rules have priority 1000. Zero selects 200, after the essential rules.
+	Priority uint16
+}
+
+// ACLDirection is the direction of the traffic matched by an ACL rule.
+type ACLDirection string
+
+const (
+	// ACLDirectionIn matches traffic received by the container.
+	ACLDirectionIn ACLDirection = "In"
+	// ACLDirectionOut matches traffic sent by the container.
+	ACLDirectionOut ACLDirection = "Out"
+)
+
 // Endpoint represents a container network interface.
 type Endpoint struct {
 	ContainerID string
+	Key         string
 	NetNSName   string
 	IfName      string
 	IfType      string
 	TapUserID   int
 	MACAddress  net.HardwareAddr
 	IPAddresses []net.IPNet
+	Policies    []json.RawMessage
+
+	IsRemoteEndpoint    bool
+	ExtraEndpointFields map[string]interface{}
+	CompartmentID       uint32
+	EnableLowMetric     bool
+	DisableHostRoute    bool
+	DisableDNS          bool
+
+	// DisableICC isolates the endpoint from the other endpoints on the host, by disabling the
+	// inter-container communication in HNS. The traffic to the gateway and outside the host is
+	// unaffected.
+	DisableICC bool
+
+	// Metered is whether the endpoint's interface is flagged as metered, so that the containers
+	// can limit their traffic on metered interfaces. Nil leaves the HNS default.
+	Metered *bool
+
+	// Orchestrator is the container orchestrator managing the endpoint. Known orchestrators
+	// restrict the namespaces the endpoint may use to those the orchestrator creates.
+	Orchestrator Orchestrator
+
+	// FriendlyName is the name displayed for the endpoint's interface on the host, such as the
+	// pod name. Empty selects the container ID.
+	FriendlyName string
+
+	// CNINetworkName is the name of the CNI network the endpoint belongs to, recorded on the HNS
+	// endpoint to tell apart the interfaces of pods attached to multiple networks.
+	CNINetworkName string
+
+	// PrefixLength is the prefix length of the endpoint's IP address. Zero selects the length of
+	// the address mask or, without a mask, of the ENI subnet.
+	PrefixLength uint8
+
+	// VNI is the VXLAN network identifier associated with the endpoint, for coexistence with
+	// overlay networks on the same host. Zero leaves the endpoint without a VNI.
+	VNI uint32
+
+	// HostRoutes are destinations routed from the host to the endpoint's IP address via the
+	// host vNIC, installed in the host's routing table while the endpoint exists.
+	HostRoutes []net.IPNet
+
+	// Routes are installed only on this endpoint, so that the interfaces of multi-homed
+	// containers can route the same destinations differently.
+	Routes []Route
+
+	// EgressAllowedCIDRs are the IPv4 CIDR blocks that the endpoint may send traffic to, besides
+	// the gateway and the DNS servers. Empty leaves the egress traffic unrestricted, unless the
+	// network is default-deny.
+	EgressAllowedCIDRs []string
+
+	// AdditionalSNATExceptions are destination IPv4 CIDR blocks exempted from SNAT for this
+	// endpoint only, in addition to the network's SNAT exceptions. HNS outbound NAT policies
+	// only match destination prefixes, so all traffic to these blocks is exempted, regardless of
+	// its protocol and ports.
+	AdditionalSNATExceptions []string
+
+	// SNATExceptions and RouteDestinations are set by the builder to the destination prefixes
+	// exempted from SNAT and routed by the policies of the HNS endpoint, for debugging
+	// connectivity. They are left empty if the network redacts the endpoint policy result.
+	SNATExceptions    []string
+	RouteDestinations []string
+
+	// SkippedPolicies is set by the builder to the names of the policies that failed to build
+	// and were left out of the HNS endpoint, if the network applies policies on a best-effort
+	// basis.
+	SkippedPolicies []string
+
+	// DeleteResult is set by the builder when deleting the endpoint, to tell apart the endpoints
+	// deleted from those already absent.
+	DeleteResult DeleteResult
+}
+
+// Route is a route scoped to a container network interface.
+type Route struct {
+	// Destination is the destination CIDR block of the route.
+	Destination net.IPNet
+	// NextHop is the gateway of the route. Nil routes the traffic via the host.
+	NextHop net.IP
 }
@@ -0,0 +1,139 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// canonicalizePolicy returns the canonical encoding of an HNS policy. Policies that differ only
+// in the order of their fields or of the elements of their nested lists, such as the exception
+// list of an OutBoundNAT policy, have the same canonical encoding. The order of the endpoint's
+// policy list itself is compared by samePolicyOrder.
+func canonicalizePolicy(policy json.RawMessage) (string, error) {
+	var value interface{}
+	err := json.Unmarshal(policy, &value)
+	if err != nil {
+		return "", err
+	}
+
+	value, err = canonicalizeValue(value)
+	if err != nil {
+		return "", err
+	}
+
+	// Maps are encoded with their keys sorted.
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// canonicalizeValue returns a decoded JSON value with the elements of all its lists sorted.
+func canonicalizeValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, elem := range v {
+			elem, err := canonicalizeValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = elem
+		}
+	case []interface{}:
+		// Sort the elements by their canonical encoding.
+		encodings := make([]string, len(v))
+		for i, elem := range v {
+			buf, err := json.Marshal(elem)
+			if err != nil {
+				return nil, err
+			}
+			encodings[i], err = canonicalizePolicy(buf)
+			if err != nil {
+				return nil, err
+			}
+		}
+		sort.Strings(encodings)
+
+		elems := make([]interface{}, len(encodings))
+		for i, encoding := range encodings {
+			elems[i] = json.RawMessage(encoding)
+		}
+		return elems, nil
+	}
+
+	return value, nil
+}
+
+// diffPolicies compares two lists of HNS policies regardless of their order and encoding. It
+// returns the canonical encodings of the policies that are only in the desired list, and of
+// those that are only in the actual list.
+func diffPolicies(desired, actual []json.RawMessage) ([]string, []string, error) {
+	counts := make(map[string]int)
+	for _, policy := range desired {
+		encoding, err := canonicalizePolicy(policy)
+		if err != nil {
+			return nil, nil, err
+		}
+		counts[encoding]++
+	}
+	for _, policy := range actual {
+		encoding, err := canonicalizePolicy(policy)
+		if err != nil {
+			return nil, nil, err
+		}
+		counts[encoding]--
+	}
+
+	var missing, unexpected []string
+	for encoding, count := range counts {
+		for ; count > 0; count-- {
+			missing = append(missing, encoding)
+		}
+		for ; count < 0; count++ {
+			unexpected = append(unexpected, encoding)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+
+	return missing, unexpected, nil
+}
+
+// samePolicyOrder returns whether two lists of the same HNS policies list them in the same order,
+// regardless of their encoding.
+func samePolicyOrder(desired, actual []json.RawMessage) (bool, error) {
+	if len(desired) != len(actual) {
+		return false, nil
+	}
+
+	for i := range desired {
+		desiredEncoding, err := canonicalizePolicy(desired[i])
+		if err != nil {
+			return false, err
+		}
+		actualEncoding, err := canonicalizePolicy(actual[i])
+		if err != nil {
+			return false, err
+		}
+		if desiredEncoding != actualEncoding {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build !integration_test && !e2e_test
+// +build !integration_test,!e2e_test
+
+package network
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffPoliciesIgnoresOrder(t *testing.T) {
+	desired := []json.RawMessage{
+		json.RawMessage(`{"Type":"OutBoundNAT","ExceptionList":["10.0.0.0/16","224.0.0.0/4"]}`),
+		json.RawMessage(`{"Type":"ROUTE","DestinationPrefix":"10.100.0.0/16","NeedEncap":true}`),
+	}
+	actual := []json.RawMessage{
+		json.RawMessage(`{"NeedEncap":true, "DestinationPrefix":"10.100.0.0/16", "Type":"ROUTE"}`),
+		json.RawMessage(`{"ExceptionList":["224.0.0.0/4","10.0.0.0/16"],"Type":"OutBoundNAT"}`),
+	}
+
+	missing, unexpected, err := diffPolicies(desired, actual)
+	require.NoError(t, err)
+	assert.Empty(t, missing)
+	assert.Empty(t, unexpected)
+}
+
+func TestDiffPoliciesReportsDifferences(t *testing.T) {
+	desired := []json.RawMessage{
+		json.RawMessage(`{"Type":"ROUTE","DestinationPrefix":"10.100.0.0/16"}`),
+		json.RawMessage(`{"Type":"ROUTE","DestinationPrefix":"10.100.0.0/16"}`),
+	}
+	actual := []json.RawMessage{
+		json.RawMessage(`{"Type":"ROUTE","DestinationPrefix":"10.100.0.0/16"}`),
+		json.RawMessage(`{"Type":"ROUTE","DestinationPrefix":"10.200.0.0/16"}`),
+	}
+
+	missing, unexpected, err := diffPolicies(desired, actual)
+	require.NoError(t, err)
+	assert.Equal(t, []string{`{"DestinationPrefix":"10.100.0.0/16","Type":"ROUTE"}`}, missing)
+	assert.Equal(t, []string{`{"DestinationPrefix":"10.200.0.0/16","Type":"ROUTE"}`}, unexpected)
+}
+
+func TestDiffPoliciesMalformedPolicy(t *testing.T) {
+	_, _, err := diffPolicies([]json.RawMessage{json.RawMessage(`{`)}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,233 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/vpc"
+
+	"github.com/Microsoft/hcsshim"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// multicastPrefix is the IPv4 multicast address range.
+	multicastPrefix = "224.0.0.0/4"
+	// defaultSNATExceptionLimit is the default value of the network's SNATExceptionLimit.
+	defaultSNATExceptionLimit = 1000
+)
+
+// addOutboundNATPolicy adds the policy to SNAT endpoint traffic to the ENI primary IP address
+// to an HNS endpoint. It returns the SNAT exceptions of the policy.
+func (nb *BridgeBuilder) addOutboundNATPolicy(
+	hnsEndpoint *hcsshim.HNSEndpoint, nw *Network, ep *Endpoint) ([]string, error) {
+	vip, err := nb.selectSNATVIP(hnsEndpoint, nw)
+	if err != nil {
+		return nil, err
+	}
+
+	snatExceptions, err := nb.generateSNATExceptions(nw, ep)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := hcsshim.OutboundNatPolicy{
+		Policy: hcsshim.Policy{Type: hcsshim.OutboundNat},
+		// Implicit VIP: nw.ENIIPAddresses[0].IP.String(), unless the network has a SNAT pool.
+		VIP:        vip,
+		Exceptions: snatExceptions,
+	}
+
+	buf, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	buf, err = nb.addExtraFields(buf, nw.SNATPolicyFields, "SNAT policy")
+	if err != nil {
+		log.Errorf("Invalid SNAT policy fields: %v.", err)
+		return nil, err
+	}
+
+	err = nb.addEndpointPolicy(hnsEndpoint, json.RawMessage(buf))
+	if err != nil {
+		log.Errorf("Failed to add endpoint SNAT policy: %v.", err)
+		return nil, err
+	}
+
+	return snatExceptions, nil
+}
+
+// selectSNATVIP returns the source IP address for SNATing the endpoint's traffic, or an empty
+// string for the ENI primary IP address. Endpoints are spread evenly over the SNAT pool.
+func (nb *BridgeBuilder) selectSNATVIP(hnsEndpoint *hcsshim.HNSEndpoint, nw *Network) (string, error) {
+	snatPool, err := nb.getSNATPool(nw)
+	if err != nil {
+		return "", err
+	}
+	if len(snatPool) == 0 {
+		return "", nil
+	}
+
+	// Select the same address each time for the same endpoint.
+	hash := fnv.New32a()
+	hash.Write([]byte(hnsEndpoint.Name))
+
+	return snatPool[hash.Sum32()%uint32(len(snatPool))].String(), nil
+}
+
+// getSNATPool returns the source IP addresses for SNATing endpoint traffic. The pool is either
+// configured on the network, or discovered from the secondary IP addresses of the shared ENI.
+func (nb *BridgeBuilder) getSNATPool(nw *Network) ([]net.IP, error) {
+	if len(nw.SNATPool) != 0 || !nw.DiscoverSNATPool {
+		return nw.SNATPool, nil
+	}
+
+	snatPool, err := nb.ipDiscoverer().GetSecondaryIPAddresses(nw.SharedENI)
+	if err != nil {
+		log.Errorf("Failed to discover secondary IP addresses of ENI %s: %v.", nw.SharedENI, err)
+		return nil, err
+	}
+
+	log.Infof("Discovered SNAT pool %v for ENI %s.", snatPool, nw.SharedENI)
+
+	return snatPool, nil
+}
+
+// generateSNATExceptions returns the destination prefixes of the endpoint traffic that is not
+// SNATed. The network's SNAT exceptions are merged with those provided for each new endpoint and
+// with the endpoint's own.
+func (nb *BridgeBuilder) generateSNATExceptions(nw *Network, ep *Endpoint) ([]string, error) {
+	snatExceptions := append([]string{}, nb.getNetworkSNATExceptions(nw)...)
+	if nw.SNATExceptionProvider != nil {
+		// ...or the destination is exempted by the provider.
+		providedExceptions, err := nw.SNATExceptionProvider.GetSNATExceptions()
+		if err != nil {
+			log.Errorf("Failed to get SNAT exceptions from provider: %v.", err)
+			return nil, err
+		}
+		snatExceptions = append(snatExceptions, providedExceptions...)
+	}
+	// ...or the destination is exempted for the endpoint.
+	snatExceptions = append(snatExceptions, ep.AdditionalSNATExceptions...)
+
+	err := nb.checkSNATExceptionLimit(nw, snatExceptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return snatExceptions, nil
+}
+
+// networkSNATExceptions is the SNAT exceptions derived from a network's settings, shared by its
+// endpoints. Values are never modified once cached, so concurrent callers can share them.
+type networkSNATExceptions struct {
+	// key identifies the settings the exceptions were derived from.
+	key        string
+	exceptions []string
+}
+
+// getNetworkSNATExceptions returns the SNAT exceptions derived from the network's settings. They
+// are derived once and cached on the builder, until the settings they depend on change.
+func (nb *BridgeBuilder) getNetworkSNATExceptions(nw *Network) []string {
+	networkName := nb.generateHNSNetworkName(nw)
+	key := nb.generateSNATExceptionKey(nw)
+	if cached, ok := nb.snatExceptions.Load(networkName); ok &&
+		cached.(*networkSNATExceptions).key == key {
+		return cached.(*networkSNATExceptions).exceptions
+	}
+
+	// Concurrent callers may derive the same exceptions, the last one is cached.
+	exceptions := nb.deriveNetworkSNATExceptions(nw)
+	nb.snatExceptions.Store(networkName, &networkSNATExceptions{key: key, exceptions: exceptions})
+
+	return exceptions
+}
+
+// generateSNATExceptionKey returns a key identifying the network settings the network's SNAT
+// exceptions are derived from.
+func (nb *BridgeBuilder) generateSNATExceptionKey(nw *Network) string {
+	return fmt.Sprintf("%s|%v|%s|%t|%t", nw.ENIIPAddresses[0].String(), nw.VPCCIDRs,
+		nw.ServiceCIDR, nw.ServiceCIDRRouteOnly, nw.DisableMulticastSNATExceptions)
+}
+
+// deriveNetworkSNATExceptions returns the SNAT exceptions derived from the network's settings.
+// Traffic to the VPC CIDRs and to the ENI subnet keeps the endpoint's IP address. The subnet is
+// listed separately only if no VPC CIDR contains it. Traffic to the service CIDR is routed to the
+// host, and is also exempted from SNAT unless the network relies on the service route only. The
+// service CIDR exception does not cover other subnets in the VPC, so networks without VPC CIDRs
+// SNAT cross-subnet traffic.
+func (nb *BridgeBuilder) deriveNetworkSNATExceptions(nw *Network) []string {
+	// SNAT endpoint traffic to ENI primary IP address...
+	var snatExceptions []string
+	subnet := vpc.GetSubnetPrefix(&nw.ENIIPAddresses[0])
+	if nw.VPCCIDRs == nil {
+		// ...except if the destination is in the same subnet as the ENI.
+		snatExceptions = []string{subnet.String()}
+	} else {
+		// ...or, if known, the same VPC.
+		subnetCovered := false
+		for _, cidr := range nw.VPCCIDRs {
+			snatExceptions = append(snatExceptions, cidr.String())
+			ones, _ := cidr.Mask.Size()
+			subnetOnes, _ := subnet.Mask.Size()
+			if cidr.Contains(subnet.IP) && ones <= subnetOnes {
+				subnetCovered = true
+			}
+		}
+		if !subnetCovered {
+			// Intra-subnet traffic must never be SNATed, even if the VPC CIDRs are misconfigured.
+			log.Warnf("VPC CIDRs %v do not contain ENI subnet %s, exempting it from SNAT.",
+				nw.VPCCIDRs, subnet.String())
+			snatExceptions = append(snatExceptions, subnet.String())
+		}
+	}
+	if nw.ServiceCIDR != "" && !nw.ServiceCIDRRouteOnly {
+		// ...or the destination is a service endpoint.
+		snatExceptions = append(snatExceptions, nw.ServiceCIDR)
+	}
+	if !nw.DisableMulticastSNATExceptions {
+		// ...or the destination is a multicast group or the subnet broadcast address.
+		subnetBroadcast := vpc.GetSubnetBroadcastAddress(vpc.GetSubnetPrefix(&nw.ENIIPAddresses[0]))
+		snatExceptions = append(snatExceptions, multicastPrefix, subnetBroadcast.String()+"/32")
+	}
+
+	return snatExceptions
+}
+
+// checkSNATExceptionLimit returns an error if there are more SNAT exceptions than the network's
+// limit and its limit action is to fail. Otherwise it logs a warning.
+func (nb *BridgeBuilder) checkSNATExceptionLimit(nw *Network, snatExceptions []string) error {
+	limit := nw.SNATExceptionLimit
+	if limit <= 0 {
+		limit = defaultSNATExceptionLimit
+	}
+	if len(snatExceptions) <= limit {
+		return nil
+	}
+
+	err := fmt.Errorf("%d SNAT exceptions exceed the limit of %d, "+
+		"coalesce adjacent CIDR blocks to shorten the list", len(snatExceptions), limit)
+	if nw.SNATExceptionLimitAction == SNATExceptionLimitError {
+		log.Errorf("Too many SNAT exceptions: %v.", err)
+		return err
+	}
+
+	log.Warnf("Too many SNAT exceptions: %v.", err)
+
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+
+	log "github.com/cihub/seelog"
+)
+
+// hnsState is the state of the HNS networks and endpoints on the host, exported for debugging.
+type hnsState struct {
+	Networks []hnsNetworkState
+}
+
+// hnsNetworkState is the state of an HNS network and its endpoints.
+type hnsNetworkState struct {
+	ID        string
+	Name      string
+	Type      string
+	Version   string            `json:",omitempty"`
+	Metadata  map[string]string `json:",omitempty"`
+	Endpoints []hnsEndpointState
+}
+
+// hnsEndpointState is the state of an HNS endpoint.
+type hnsEndpointState struct {
+	ID          string
+	Name        string
+	IPAddress   net.IP            `json:",omitempty"`
+	MACAddress  string            `json:",omitempty"`
+	PolicyTypes []string          `json:",omitempty"`
+	Policies    []json.RawMessage `json:",omitempty"`
+}
+
+// ExportStateOptions selects the parts of the exported state that can hold sensitive settings.
+type ExportStateOptions struct {
+	// IncludeMetadata exports the free-form metadata of HNS networks, which can hold settings of
+	// the orchestrator. By default only the network version is exported.
+	IncludeMetadata bool
+	// IncludePolicies exports the policy payloads of HNS endpoints, which list the addresses and
+	// ports the endpoints can reach. By default only the policy types are exported.
+	IncludePolicies bool
+}
+
+// ExportState returns the JSON encoding of all HNS networks and endpoints on the host, including
+// their IDs and, if requested, their metadata and policies, for troubleshooting.
+func (nb *BridgeBuilder) ExportState(options ExportStateOptions) ([]byte, error) {
+	hnsNetworks, err := nb.client().HNSListNetworkRequest()
+	if err != nil {
+		log.Errorf("Failed to list HNS networks: %v.", err)
+		return nil, err
+	}
+
+	hnsEndpoints, err := nb.client().HNSListEndpointRequest()
+	if err != nil {
+		log.Errorf("Failed to list HNS endpoints: %v.", err)
+		return nil, err
+	}
+
+	var state hnsState
+	for _, hnsNetwork := range hnsNetworks {
+		metadata, err := nb.getHNSNetworkMetadata(hnsNetwork.Id)
+		if err != nil {
+			log.Errorf("Failed to read metadata of HNS network %s: %v.", hnsNetwork.Id, err)
+			return nil, err
+		}
+
+		networkState := hnsNetworkState{
+			ID:      hnsNetwork.Id,
+			Name:    hnsNetwork.Name,
+			Type:    hnsNetwork.Type,
+			Version: metadata[hnsNetworkVersionKey],
+		}
+		if options.IncludeMetadata {
+			networkState.Metadata = metadata
+		}
+
+		for _, hnsEndpoint := range hnsEndpoints {
+			if hnsEndpoint.VirtualNetworkName != hnsNetwork.Name {
+				continue
+			}
+			endpointState := hnsEndpointState{
+				ID:          hnsEndpoint.Id,
+				Name:        hnsEndpoint.Name,
+				IPAddress:   hnsEndpoint.IPAddress,
+				MACAddress:  hnsEndpoint.MacAddress,
+				PolicyTypes: getPolicyTypes(hnsEndpoint.Policies),
+			}
+			if options.IncludePolicies {
+				endpointState.Policies = hnsEndpoint.Policies
+			}
+			networkState.Endpoints = append(networkState.Endpoints, endpointState)
+		}
+		sort.Slice(networkState.Endpoints, func(i, j int) bool {
+			return networkState.Endpoints[i].Name < networkState.Endpoints[j].Name
+		})
+
+		state.Networks = append(state.Networks, networkState)
+	}
+	sort.Slice(state.Networks, func(i, j int) bool {
+		return state.Networks[i].Name < state.Networks[j].Name
+	})
+
+	return json.MarshalIndent(state, "", "  ")
+}
+
+// getPolicyTypes returns the types of HNS policies, in order. Policies that cannot be decoded
+// have an empty type.
+func getPolicyTypes(policies []json.RawMessage) []string {
+	var types []string
+	for _, buf := range policies {
+		var policy struct{ Type string }
+		_ = json.Unmarshal(buf, &policy)
+		types = append(types, policy.Type)
+	}
+
+	return types
+}
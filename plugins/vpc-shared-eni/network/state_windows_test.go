@@ -0,0 +1,90 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build !integration_test && !e2e_test
+// +build !integration_test,!e2e_test
+
+package network
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportState(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container2", "10.0.1.12")))
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, newTestEndpoint("container1", "10.0.1.11")))
+
+	buf, err := nb.ExportState(ExportStateOptions{IncludeMetadata: true, IncludePolicies: true})
+	require.NoError(t, err)
+
+	var state hnsState
+	require.NoError(t, json.Unmarshal(buf, &state))
+	require.Len(t, state.Networks, 1)
+
+	networkState := state.Networks[0]
+	hnsNetwork, err := hns.GetHNSNetworkByName(nb.generateHNSNetworkName(nw))
+	require.NoError(t, err)
+	assert.Equal(t, hnsNetwork.Id, networkState.ID)
+	assert.Equal(t, hnsNetwork.Name, networkState.Name)
+	assert.Equal(t, hnsL2Bridge, networkState.Type)
+	assert.Equal(t, hnsNetworkVersion, networkState.Version)
+	assert.Equal(t, hnsNetworkVersion, networkState.Metadata[hnsNetworkVersionKey])
+
+	require.Len(t, networkState.Endpoints, 2)
+	for i, name := range []string{"cid-container1", "cid-container2"} {
+		hnsEndpoint, err := hns.GetHNSEndpointByName(name)
+		require.NoError(t, err)
+		endpointState := networkState.Endpoints[i]
+		assert.Equal(t, hnsEndpoint.Id, endpointState.ID)
+		assert.Equal(t, name, endpointState.Name)
+		assert.Equal(t, hnsEndpoint.IPAddress.String(), endpointState.IPAddress.String())
+		assert.Equal(t, len(hnsEndpoint.Policies), len(endpointState.Policies))
+	}
+}
+
+func TestExportStateRedacted(t *testing.T) {
+	hns := newMockHNS()
+	nb := &BridgeBuilder{hns: hns}
+	nw := newTestNetwork(t)
+	nw.VPCID = "vpc-12345678"
+	nw.ACLAllowRules = []ACLRule{{RemoteAddresses: "192.168.10.0/24", RemotePorts: "443"}}
+	require.NoError(t, nb.FindOrCreateNetwork(nw))
+	ep := newTestEndpoint("container1", "10.0.1.11")
+	ep.AdditionalSNATExceptions = []string{"172.16.0.0/16"}
+	require.NoError(t, nb.FindOrCreateEndpoint(nw, ep))
+
+	buf, err := nb.ExportState(ExportStateOptions{})
+	require.NoError(t, err)
+
+	// The metadata and the policy payloads are left out by default.
+	for _, sensitive := range []string{
+		"Metadata", "vpc-12345678", "Policies", "ExceptionList", "172.16.0.0/16", "192.168.10.0/24",
+	} {
+		assert.NotContains(t, string(buf), sensitive)
+	}
+
+	var state hnsState
+	require.NoError(t, json.Unmarshal(buf, &state))
+	require.Len(t, state.Networks, 1)
+	assert.Equal(t, hnsNetworkVersion, state.Networks[0].Version)
+	require.Len(t, state.Networks[0].Endpoints, 1)
+	assert.Equal(t, []string{"OutBoundNAT", "ACL"}, state.Networks[0].Endpoints[0].PolicyTypes)
+}
@@ -0,0 +1,219 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+// validateNetwork returns ValidationErrors listing the invalid settings of a network.
+func (nb *BridgeBuilder) validateNetwork(nw *Network) error {
+	var errs ValidationErrors
+
+	if nw.SharedENI == nil {
+		errs = errs.add("Network.SharedENI", "is required")
+	}
+	if len(nw.ENIIPAddresses) == 0 || nw.ENIIPAddresses[0].IP.To4() == nil {
+		errs = errs.add("Network.ENIIPAddresses", "requires an IPv4 address")
+	}
+	if err := nb.validateDNSServers(nw); err != nil {
+		errs = errs.add("Network.DNSServers", err.Error())
+	}
+	if nw.FallbackNetworkType != "" && nw.FallbackNetworkType != hnsNAT &&
+		nw.FallbackNetworkType != hnsTransparent {
+		errs = errs.add("Network.FallbackNetworkType",
+			fmt.Sprintf("must be %q or %q", hnsNAT, hnsTransparent))
+	}
+	if nw.DNSMismatchAction == NetworkMismatchUpdate {
+		errs = errs.add("Network.DNSMismatchAction", "HNS networks cannot be updated in place")
+	}
+	if nw.BridgeNetNSPath != "" {
+		// HNS API does not support creating virtual switches in compartments other than the host's.
+		errs = errs.add("Network.BridgeNetNSPath",
+			"must be empty, bridge must be in host network namespace on Windows")
+	}
+
+	return errs.errorOrNil()
+}
+
+// validateEndpoint returns ValidationErrors listing the invalid settings of an endpoint and of the
+// network settings applied to it.
+func (nb *BridgeBuilder) validateEndpoint(nw *Network, ep *Endpoint) error {
+	var errs ValidationErrors
+
+	if len(ep.IPAddresses) == 0 && !nw.AllocateEndpointIPs {
+		// Endpoints without an IP address are allocated a secondary IP address of the ENI, if
+		// enabled.
+		errs = errs.add("Endpoint.IPAddresses", "is required")
+	} else if len(ep.IPAddresses) > 1 ||
+		(len(ep.IPAddresses) == 1 && ep.IPAddresses[0].IP.To4() == nil) {
+		// This plugin does not yet support IPv6, or multiple IPv4 addresses.
+		errs = errs.add("Endpoint.IPAddresses",
+			"only a single IPv4 address per endpoint is supported on Windows")
+	}
+
+	// Endpoints in namespaces the orchestrator does not create are likely misconfigured.
+	isAppContainer := strings.HasPrefix(ep.NetNSName, containerNetNSPrefix)
+	isHCNNamespace := ep.NetNSName != "" && ep.NetNSName != "none" && !isAppContainer
+	if ep.Orchestrator == OrchestratorKubernetes && isAppContainer {
+		errs = errs.add("Endpoint.NetNSName", "app container namespaces are not used by Kubernetes")
+	} else if ep.Orchestrator == OrchestratorECS && isHCNNamespace {
+		errs = errs.add("Endpoint.NetNSName", "HCN namespaces are not used by ECS")
+	}
+
+	if isHCNNamespace && !nb.isFeatureEnabled(FeatureHCNNamespaces) {
+		errs = errs.add("Endpoint.NetNSName", featureDisabledMessage(FeatureHCNNamespaces))
+	}
+	if !nb.isFeatureEnabled(FeatureACLPolicies) {
+		if nw.DefaultDeny {
+			errs = errs.add("Network.DefaultDeny", featureDisabledMessage(FeatureACLPolicies))
+		}
+		if len(nw.ACLAllowRules) != 0 {
+			errs = errs.add("Network.ACLAllowRules", featureDisabledMessage(FeatureACLPolicies))
+		}
+		if len(ep.EgressAllowedCIDRs) != 0 {
+			errs = errs.add("Endpoint.EgressAllowedCIDRs", featureDisabledMessage(FeatureACLPolicies))
+		}
+	}
+
+	if ep.VNI != 0 && (ep.VNI < hnsMinVNI || ep.VNI > hnsMaxVNI) {
+		errs = errs.add("Endpoint.VNI",
+			fmt.Sprintf("%d is outside the valid range %d-%d", ep.VNI, hnsMinVNI, hnsMaxVNI))
+	}
+
+	if len(nw.ENIIPAddresses) == 0 {
+		errs = errs.add("Network.ENIIPAddresses", "requires an IPv4 address")
+	} else {
+		if err := nb.validateServiceCIDR(nw); err != nil {
+			errs = errs.add("Network.ServiceCIDR", err.Error())
+		}
+		if err := nb.validateEndpointRoutes(nw, ep); err != nil {
+			errs = errs.add("Endpoint.Routes", err.Error())
+		}
+	}
+	if err := nb.validateACLRules(nw); err != nil {
+		errs = errs.add("Network.ACLAllowRules", err.Error())
+	}
+	if err := nb.validateIPv4CIDRs(ep.EgressAllowedCIDRs); err != nil {
+		errs = errs.add("Endpoint.EgressAllowedCIDRs", err.Error())
+	}
+	if err := nb.validateIPv4CIDRs(ep.AdditionalSNATExceptions); err != nil {
+		errs = errs.add("Endpoint.AdditionalSNATExceptions", err.Error())
+	}
+
+	return errs.errorOrNil()
+}
+
+// featureDisabledMessage returns the validation message of a setting that requires a disabled
+// feature.
+func featureDisabledMessage(feature string) string {
+	return fmt.Sprintf("requires the %s feature, which is disabled", feature)
+}
+
+// validateIPv4CIDRs returns whether a list of an endpoint's destinations has IPv4 CIDR blocks
+// only.
+func (nb *BridgeBuilder) validateIPv4CIDRs(cidrs []string) error {
+	for _, cidr := range cidrs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil || ip.To4() == nil {
+			return fmt.Errorf("%s is not an IPv4 CIDR block", cidr)
+		}
+	}
+
+	return nil
+}
+
+// validateEndpointRoutes returns whether the routes scoped to an endpoint are consistent with
+// each other and with the network's routes.
+func (nb *BridgeBuilder) validateEndpointRoutes(nw *Network, ep *Endpoint) error {
+	destinations := make(map[string]bool)
+	for _, route := range ep.Routes {
+		destination := route.Destination.String()
+		if route.Destination.IP.To4() == nil {
+			return fmt.Errorf("destination %s is not an IPv4 CIDR block", destination)
+		}
+		if !route.Destination.IP.Equal(route.Destination.IP.Mask(route.Destination.Mask)) {
+			return fmt.Errorf("destination %s has host bits set", destination)
+		}
+
+		// HNS applies a single route policy per destination.
+		if destinations[destination] {
+			return fmt.Errorf("destination %s is routed more than once", destination)
+		}
+		destinations[destination] = true
+		if nb.shouldAddServiceRoute(nw) && destination == nw.ServiceCIDR {
+			return fmt.Errorf("destination %s is already routed as the service CIDR", destination)
+		}
+
+		// Next hops must be directly reachable on the ENI subnet.
+		if route.NextHop != nil {
+			eniSubnet := net.IPNet{
+				IP:   nw.ENIIPAddresses[0].IP.Mask(nw.ENIIPAddresses[0].Mask),
+				Mask: nw.ENIIPAddresses[0].Mask,
+			}
+			if route.NextHop.To4() == nil || !eniSubnet.Contains(route.NextHop) {
+				return fmt.Errorf("next hop %s of destination %s is outside the ENI subnet %s",
+					route.NextHop, destination, eniSubnet.String())
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateDNSServers returns whether the network's DNS servers are IPv4 addresses, the only
+// address family of endpoints on Windows. Servers the endpoints cannot reach are only logged,
+// as the DNS settings of the endpoint may still be overridden in the container.
+func (nb *BridgeBuilder) validateDNSServers(nw *Network) error {
+	if nw.DisableDNS {
+		return nil
+	}
+
+	for _, dnsServer := range nw.DNSServers {
+		ipAddress := net.ParseIP(dnsServer)
+		if ipAddress == nil {
+			return fmt.Errorf("%q is not an IP address", dnsServer)
+		}
+		if ipAddress.To4() == nil {
+			return fmt.Errorf("%s is not an IPv4 address", dnsServer)
+		}
+		if ipAddress.IsUnspecified() || ipAddress.IsLoopback() || ipAddress.IsMulticast() ||
+			ipAddress.Equal(net.IPv4bcast) {
+			log.Warnf("DNS server %s is not reachable from endpoints.", dnsServer)
+		}
+	}
+
+	return nil
+}
+
+// validateACLRules returns whether the network's ACL rules can take effect. Allow rules evaluated
+// after the default-deny rules would never match.
+func (nb *BridgeBuilder) validateACLRules(nw *Network) error {
+	if !nw.DefaultDeny {
+		return nil
+	}
+
+	for _, rule := range nw.ACLAllowRules {
+		if rule.Priority >= hnsACLPriorityDefaultDeny {
+			return fmt.Errorf("rule for %q has priority %d, not before the default-deny "+
+				"priority %d", rule.RemoteAddresses, rule.Priority, hnsACLPriorityDefaultDeny)
+		}
+	}
+
+	return nil
+}